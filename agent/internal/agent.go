@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
@@ -20,25 +21,31 @@ type task struct {
 	ID            int           `json:"id"`
 	Arg1          float64       `json:"arg1"`
 	Arg2          float64       `json:"arg2"`
+	Args          []float64     `json:"args"`
 	Operation     string        `json:"operation"`
 	OperationTime time.Duration `json:"operation_time"`
+	AttemptToken  string        `json:"attempt_token"`
 }
 
 type solvedTask struct {
-	ID     int     `json:"id"`
-	Result float64 `json:"result"`
+	ID           int     `json:"id"`
+	Result       float64 `json:"result"`
+	AttemptToken string  `json:"attempt_token"` // оркестратор принимает результат только с токеном выдачи
 }
 
 func solveTask(t task) solvedTask {
-	solved := solvedTask{ID: t.ID}
-
-	time.Sleep(t.OperationTime)
+	solved := solvedTask{ID: t.ID, AttemptToken: t.AttemptToken}
 
 	switch t.Operation {
 	case "+":
 		solved.Result = t.Arg1 + t.Arg2
 	case "-":
 		solved.Result = t.Arg1 - t.Arg2
+	// Процент как на калькуляторе: 200 + 15% = 230
+	case "+%":
+		solved.Result = t.Arg1 + t.Arg1*t.Arg2/100
+	case "-%":
+		solved.Result = t.Arg1 - t.Arg1*t.Arg2/100
 	case "*":
 		solved.Result = t.Arg1 * t.Arg2
 	case "/":
@@ -48,6 +55,43 @@ func solveTask(t task) solvedTask {
 		} else {
 			solved.Result = t.Arg1 / t.Arg2
 		}
+	case "pmt":
+		solved.Result = pmt(t.Args[0], t.Args[1], t.Args[2])
+	case "fv":
+		var presentValue float64
+		if len(t.Args) > 3 {
+			presentValue = t.Args[3]
+		}
+		solved.Result = fv(t.Args[0], t.Args[1], t.Args[2], presentValue)
+	case "npv":
+		solved.Result = npv(t.Args[0], t.Args[1:])
+	case "fact":
+		solved.Result = factorial(t.Args[0])
+	case "nCr":
+		solved.Result = combinations(t.Args[0], t.Args[1])
+	case "nPr":
+		solved.Result = permutations(t.Args[0], t.Args[1])
+	case "gcd":
+		solved.Result = gcd(t.Args)
+	case "lcm":
+		solved.Result = lcm(t.Args)
+	case "sum":
+		solved.Result = sum(t.Args)
+	case "mean":
+		solved.Result = mean(t.Args)
+	case "median":
+		solved.Result = median(t.Args)
+	case "stddev":
+		solved.Result = stddev(t.Args)
+	case "dot":
+		solved.Result = dot(t.Args)
+	case "det":
+		solved.Result = det(t.Args)
+	case "isprime":
+		solved.Result = 0
+		if isPrime(t.Args[0]) {
+			solved.Result = 1
+		}
 	default:
 		log.Printf("Ошибка: неизвестная операция %s в задаче ID %d\n", t.Operation, t.ID)
 	}
@@ -55,17 +99,96 @@ func solveTask(t task) solvedTask {
 	return solved
 }
 
-func worker(tasks <-chan task, results chan<- solvedTask, wg *sync.WaitGroup) {
+// Задачи, которые сейчас считают воркеры. Через канал воркеру сообщают, что выражение отменили
+type cancellations struct {
+	mu      sync.Mutex
+	running map[int]chan struct{}
+}
+
+func newCancellations() *cancellations {
+	return &cancellations{running: map[int]chan struct{}{}}
+}
+
+func (c *cancellations) start(id int) <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan struct{})
+	c.running[id] = ch
+	return ch
+}
+
+func (c *cancellations) finish(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.running, id)
+}
+
+// Отменяет задачу, если она еще считается. Повторная отмена ничего не делает
+func (c *cancellations) cancel(id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.running[id]
+	if ok {
+		close(ch)
+		delete(c.running, id)
+	}
+	return ok
+}
+
+// Воркер ждет OperationTime и решает задачу. Аренда на оркестраторе рассчитана ровно на это ожидание,
+// поэтому других пауз здесь быть не должно. Освободившись, воркер кладет отметку в idle
+func worker(tasks <-chan task, results chan<- solvedTask, idle chan<- struct{}, cancelled *cancellations, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for t := range tasks {
+		abort := cancelled.start(t.ID)
 		timer := time.NewTimer(t.OperationTime)
-		<-timer.C
-		solved := solveTask(t)
-		results <- solved
+		select {
+		case <-timer.C:
+			solved := solveTask(t)
+			cancelled.finish(t.ID)
+			results <- solved
+		case <-abort:
+			timer.Stop()
+			log.Printf("Выражение задачи ID %d отменено, бросаем задачу", t.ID)
+		}
+		idle <- struct{}{}
+	}
+}
+
+// Пауза, которую прерывает отмена ctx. Возвращает false, если ctx отменили
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
+// Причина отказа оркестратора из ErrorInfo, та же строка, что в orchestrator/internal/grpc
+const reasonExpressionCancelled = "EXPRESSION_CANCELLED"
+
+// Причина отказа из ErrorInfo в ошибке, пустая, если ее нет
+func rejectReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+func newAgentID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "agent"
+	}
+	return hostname + "-" + strconv.Itoa(os.Getpid())
+}
+
 func RunAgent() {
 	// Берем из env разные переменные
 	taskPort, exists := os.LookupEnv("TASKS_PORT")
@@ -93,36 +216,75 @@ func RunAgent() {
 
 	// создаем клиента
 	client := pb.NewTasksClient(conn)
+	// по этому ID оркестратор знает, какому агенту отдал задачу
+	agentID := newAgentID()
+	log.Printf("ID агента: %s", agentID)
 
-	inputCh := make(chan task, workerCount)
+	run(context.Background(), client, agentID, workerCount)
+}
+
+// Основной цикл агента: берет задачи, раздает их воркерам и отправляет решения. Работает, пока не отменят ctx
+func run(ctx context.Context, client pb.TasksClient, agentID string, workerCount int) {
+	// Канал без буфера: аренда идет с момента выдачи, поэтому задача не должна ждать в очереди агента
+	inputCh := make(chan task)
 	outputCh := make(chan solvedTask, workerCount)
+	// Отметки свободных воркеров. Задачу просим, только забрав отметку, то есть когда воркер свободен
+	idle := make(chan struct{}, workerCount)
+	for i := 0; i < workerCount; i++ {
+		idle <- struct{}{}
+	}
 	var wg sync.WaitGroup
+	cancelled := newCancellations()
+
+	// эта горутина раз в секунду спрашивает, какие из наших задач отменены
+	go func() {
+		for sleep(ctx, time.Second) {
+			reqCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+			resp, err := client.CancelledTasks(reqCtx, &pb.CancelledTasksRequest{AgentId: agentID})
+			cancel()
+			if err != nil {
+				continue
+			}
+			for _, id := range resp.Ids {
+				cancelled.cancel(int(id))
+			}
+		}
+	}()
 
 	// эта горутина постоянно просит задачи
 	go func() {
 		defer close(inputCh)
 		for {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-			
-			resp, err := client.SendTask(ctx, &pb.SendTaskRequest{})
+			select {
+			case <-ctx.Done():
+				return
+			case <-idle:
+			}
+			reqCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+
+			resp, err := client.SendTask(reqCtx, &pb.SendTaskRequest{AgentId: agentID})
 			cancel()
 			if err != nil {
+				// Задачу не получили, воркер так и остался свободным
+				idle <- struct{}{}
+				var pause time.Duration
 				st, ok := status.FromError(err)
 				if ok {
+					pause = time.Second
 					switch st.Code() {
 					case codes.NotFound:
 						log.Print("Задач нет, ждем...")
-						time.Sleep(time.Second)
 					case codes.Unavailable:
 						log.Print("Сервер недоступен")
-						time.Sleep(time.Second)
 					default:
 						log.Printf("gRPC ошибка: %v (%s)", st.Message(), st.Code())
-						time.Sleep(time.Second)
 					}
 				} else {
 					log.Printf("Неизвестная ошибка: %v", err)
 				}
+				if !sleep(ctx, pause) {
+					return
+				}
 				continue
 			}
 
@@ -132,6 +294,8 @@ func RunAgent() {
 				Arg2:          resp.Arg2,
 				Operation:     resp.Operation,
 				OperationTime: time.Duration(resp.OperationTimeMs),
+				Args:          resp.Args,
+				AttemptToken:  resp.AttemptToken,
 			}
 			log.Printf("Получена задача: %+v", t)
 			inputCh <- t
@@ -141,24 +305,43 @@ func RunAgent() {
 	// Запускаем воркеров
 	for i := 0; i < workerCount; i++ {
 		wg.Add(1)
-		go worker(inputCh, outputCh, &wg)
+		go worker(inputCh, outputCh, idle, cancelled, &wg)
 	}
 
 	// горутина, которая отправляет решения
+	sent := make(chan struct{})
 	go func() {
+		defer close(sent)
 		for res := range outputCh {
 			log.Printf("Отправляем решение %v", res)
 			req := pb.ReceiveTaskRequest{
 				Id: int64(res.ID),
 				Result: res.Result,
+				AttemptToken: res.AttemptToken,
 			}
 
 			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-			client.ReceiveTask(ctx, &req)
+			_, err := client.ReceiveTask(ctx, &req)
 			cancel()
+			switch status.Code(err) {
+			case codes.OK:
+			case codes.FailedPrecondition:
+				if rejectReason(err) == reasonExpressionCancelled {
+					log.Printf("Выражение задачи ID %d отменено, решение отброшено", res.ID)
+				} else {
+					log.Printf("Не успели решить задачу ID %d, она вернулась в очередь", res.ID)
+				}
+			case codes.Aborted:
+				log.Printf("Задачу ID %d уже отдали другому агенту, решение устарело", res.ID)
+			case codes.AlreadyExists:
+				log.Printf("Решение задачи ID %d уже принято", res.ID)
+			default:
+				log.Printf("Не удалось отправить решение задачи ID %d: %v", res.ID, err)
+			}
 		}
 	}()
 
 	wg.Wait()
 	close(outputCh)
+	<-sent
 }
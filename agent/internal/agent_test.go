@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/RichCake/calc_api_go/protos/gen/go/orchestrator"
+)
+
+func TestRejectReason(t *testing.T) {
+	st, err := status.New(codes.FailedPrecondition, "expression cancelled").
+		WithDetails(&errdetails.ErrorInfo{Reason: reasonExpressionCancelled})
+	assert.NoError(t, err)
+	assert.Equal(t, reasonExpressionCancelled, rejectReason(st.Err()))
+
+	// Без ErrorInfo, например у старого оркестратора, причины нет
+	assert.Empty(t, rejectReason(status.Error(codes.FailedPrecondition, "task lease expired")))
+	assert.Empty(t, rejectReason(errors.New("connection refused")))
+	assert.Empty(t, rejectReason(nil))
+}
+
+// Оркестратор для теста: выдает задачи с арендой на operationTime + leaseGrace, как настоящий,
+// и отказывает в приеме решения, если аренда истекла
+type leaseClient struct {
+	mu         sync.Mutex
+	pending    []*pb.SendTaskResponse
+	leaseUntil map[int64]time.Time
+	accepted   map[int64]float64
+	expired    []int64
+	leaseGrace time.Duration
+}
+
+func (c *leaseClient) SendTask(ctx context.Context, in *pb.SendTaskRequest, opts ...grpc.CallOption) (*pb.SendTaskResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		return nil, status.Error(codes.NotFound, "no pending tasks")
+	}
+	resp := c.pending[0]
+	c.pending = c.pending[1:]
+	c.leaseUntil[resp.Id] = time.Now().Add(time.Duration(resp.OperationTimeMs) + c.leaseGrace)
+	return resp, nil
+}
+
+func (c *leaseClient) ReceiveTask(ctx context.Context, in *pb.ReceiveTaskRequest, opts ...grpc.CallOption) (*pb.ReceiveTaskResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().After(c.leaseUntil[in.Id]) {
+		c.expired = append(c.expired, in.Id)
+		return nil, status.Error(codes.FailedPrecondition, "task lease expired")
+	}
+	c.accepted[in.Id] = in.Result
+	return &pb.ReceiveTaskResponse{}, nil
+}
+
+func (c *leaseClient) CancelledTasks(ctx context.Context, in *pb.CancelledTasksRequest, opts ...grpc.CallOption) (*pb.CancelledTasksResponse, error) {
+	return &pb.CancelledTasksResponse{}, nil
+}
+
+func (c *leaseClient) answered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.accepted) + len(c.expired)
+}
+
+func TestRunWithinLease(t *testing.T) {
+	// Время операции больше запаса аренды: агент успевает, только если ждет ровно OperationTime
+	// и берет задачу, когда воркер уже свободен
+	operationTime := 300 * time.Millisecond
+	client := &leaseClient{
+		leaseUntil: map[int64]time.Time{},
+		accepted:   map[int64]float64{},
+		leaseGrace: 100 * time.Millisecond,
+	}
+	for id := int64(1); id <= 4; id++ {
+		client.pending = append(client.pending, &pb.SendTaskResponse{
+			Id: id, Arg1: float64(id), Arg2: 1, Operation: "+", OperationTimeMs: operationTime.Nanoseconds(),
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(ctx, client, "test-agent", 2)
+	}()
+	assert.Eventually(t, func() bool { return client.answered() == 4 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Empty(t, client.expired)
+	assert.Equal(t, map[int64]float64{1: 2, 2: 3, 3: 4, 4: 5}, client.accepted)
+}
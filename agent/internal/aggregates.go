@@ -0,0 +1,40 @@
+package agent
+
+// Агрегаты над списком чисел. Списки из выражения приходят в args одним рядом
+
+import (
+	"math"
+	"sort"
+)
+
+func sum(values []float64) float64 {
+	var result float64
+	for _, v := range values {
+		result += v
+	}
+	return result
+}
+
+func mean(values []float64) float64 {
+	return sum(values) / float64(len(values))
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// Выборочное стандартное отклонение: sqrt(sum((x - mean)^2) / (n - 1))
+func stddev(values []float64) float64 {
+	m := mean(values)
+	var squares float64
+	for _, v := range values {
+		squares += (v - m) * (v - m)
+	}
+	return math.Sqrt(squares / float64(len(values)-1))
+}
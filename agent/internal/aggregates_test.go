@@ -0,0 +1,18 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregates(t *testing.T) {
+	values := []float64{3, 5, 8, 13}
+	assert.Equal(t, 29.0, sum(values))
+	assert.Equal(t, 7.25, mean(values))
+	assert.Equal(t, 6.5, median(values))
+	assert.Equal(t, 5.0, median([]float64{8, 5, 3}))
+	assert.InDelta(t, 4.3493, stddev(values), 1e-4)
+	// median не должен менять порядок в задаче
+	assert.Equal(t, []float64{3, 5, 8, 13}, values)
+}
@@ -0,0 +1,35 @@
+package agent
+
+// Финансовые функции. Оркестратор уже проверил аргументы,
+// поэтому здесь только формулы
+
+import "math"
+
+// Платеж по аннуитетному кредиту:
+// pmt(r, n, pv) = pv * r / (1 - (1 + r)^-n), при r = 0 это pv / n
+func pmt(rate, periods, presentValue float64) float64 {
+	if rate == 0 {
+		return presentValue / periods
+	}
+	return presentValue * rate / (1 - math.Pow(1+rate, -periods))
+}
+
+// Будущая стоимость регулярных взносов с начальной суммой:
+// fv(r, n, pmt, pv) = pv * (1 + r)^n + pmt * ((1 + r)^n - 1) / r, при r = 0 это pv + pmt * n
+func fv(rate, periods, payment, presentValue float64) float64 {
+	if rate == 0 {
+		return presentValue + payment*periods
+	}
+	growth := math.Pow(1+rate, periods)
+	return presentValue*growth + payment*(growth-1)/rate
+}
+
+// Чистая приведенная стоимость, первый поток дисконтируется на один период:
+// npv(r, cf1, ..., cfn) = sum(cf_i / (1 + r)^i)
+func npv(rate float64, cashFlows []float64) float64 {
+	var result float64
+	for i, cf := range cashFlows {
+		result += cf / math.Pow(1+rate, float64(i+1))
+	}
+	return result
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPmt(t *testing.T) {
+	// Кредит 1000 на 12 месяцев под 1% в месяц
+	assert.InDelta(t, 88.85, pmt(0.01, 12, 1000), 0.01)
+	// Без процентов просто делим сумму на число платежей
+	assert.InDelta(t, 100, pmt(0, 10, 1000), 1e-9)
+}
+
+func TestFv(t *testing.T) {
+	// Взносы по 100 в течение 10 периодов под 5%
+	assert.InDelta(t, 1257.79, fv(0.05, 10, 100, 0), 0.01)
+	// С начальной суммой 1000
+	assert.InDelta(t, 2886.68, fv(0.05, 10, 100, 1000), 0.01)
+	assert.InDelta(t, 1500, fv(0, 10, 100, 500), 1e-9)
+}
+
+func TestNpv(t *testing.T) {
+	assert.InDelta(t, 1000*0.9090909+2000*0.8264463, npv(0.1, []float64{1000, 2000}), 0.01)
+	assert.InDelta(t, -1000+300+400+500, npv(0, []float64{-1000, 300, 400, 500}), 1e-9)
+}
+
+func TestSolveTask(t *testing.T) {
+	tests := []struct {
+		name     string
+		task     task
+		expected float64
+	}{
+		{name: "percent addition", task: task{Operation: "+%", Arg1: 200, Arg2: 15}, expected: 230},
+		{name: "percent subtraction", task: task{Operation: "-%", Arg1: 200, Arg2: 15}, expected: 170},
+		{name: "pmt", task: task{Operation: "pmt", Args: []float64{0, 4, 100}}, expected: 25},
+		{name: "fv without present value", task: task{Operation: "fv", Args: []float64{0, 4, 100}}, expected: 400},
+		{name: "npv", task: task{Operation: "npv", Args: []float64{0, 1, 2, 3}}, expected: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			solved := solveTask(tt.task)
+			assert.InDelta(t, tt.expected, solved.Result, 1e-9)
+		})
+	}
+}
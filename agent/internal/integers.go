@@ -0,0 +1,70 @@
+package agent
+
+// Комбинаторика и теория чисел. Оркестратор гарантирует,
+// что аргументы - неотрицательные целые числа
+
+func factorial(n float64) float64 {
+	result := 1.0
+	for i := 2.0; i <= n; i++ {
+		result *= i
+	}
+	return result
+}
+
+// C(n, k) = n! / (k! * (n - k)!), считаем без больших факториалов
+func combinations(n, k float64) float64 {
+	if k > n-k {
+		k = n - k
+	}
+	result := 1.0
+	for i := 1.0; i <= k; i++ {
+		result = result * (n - k + i) / i
+	}
+	return result
+}
+
+// P(n, k) = n! / (n - k)!
+func permutations(n, k float64) float64 {
+	result := 1.0
+	for i := n - k + 1; i <= n; i++ {
+		result *= i
+	}
+	return result
+}
+
+func gcd(args []float64) float64 {
+	result := uint64(args[0])
+	for _, arg := range args[1:] {
+		a, b := result, uint64(arg)
+		for b != 0 {
+			a, b = b, a%b
+		}
+		result = a
+	}
+	return float64(result)
+}
+
+// НОК через НОД: lcm(a, b) = a / gcd(a, b) * b, с нулем НОК равен нулю
+func lcm(args []float64) float64 {
+	result := args[0]
+	for _, arg := range args[1:] {
+		if result == 0 || arg == 0 {
+			return 0
+		}
+		result = result / gcd([]float64{result, arg}) * arg
+	}
+	return result
+}
+
+func isPrime(n float64) bool {
+	value := uint64(n)
+	if value < 2 {
+		return false
+	}
+	for d := uint64(2); d*d <= value; d++ {
+		if value%d == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,29 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFactorial(t *testing.T) {
+	assert.Equal(t, 1.0, factorial(0))
+	assert.Equal(t, 120.0, factorial(5))
+}
+
+func TestCombinatorics(t *testing.T) {
+	assert.Equal(t, 10.0, combinations(5, 2))
+	assert.Equal(t, 1.0, combinations(5, 0))
+	assert.Equal(t, 20.0, permutations(5, 2))
+	assert.Equal(t, 1.0, permutations(5, 0))
+}
+
+func TestNumberTheory(t *testing.T) {
+	assert.Equal(t, 6.0, gcd([]float64{12, 18, 24}))
+	assert.Equal(t, 5.0, gcd([]float64{0, 5}))
+	assert.Equal(t, 12.0, lcm([]float64{4, 6}))
+	assert.Equal(t, 0.0, lcm([]float64{4, 0}))
+	assert.True(t, isPrime(97))
+	assert.False(t, isPrime(1))
+	assert.False(t, isPrime(91))
+}
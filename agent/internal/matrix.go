@@ -0,0 +1,49 @@
+package agent
+
+// Векторы и матрицы приходят в args одним рядом чисел
+
+import "math"
+
+// dot(a, b): первая половина args - вектор a, вторая - вектор b
+func dot(args []float64) float64 {
+	n := len(args) / 2
+	var result float64
+	for i := 0; i < n; i++ {
+		result += args[i] * args[n+i]
+	}
+	return result
+}
+
+// Определитель матрицы n x n, записанной по строкам. Метод Гаусса с выбором главного элемента
+func det(args []float64) float64 {
+	n := int(math.Round(math.Sqrt(float64(len(args)))))
+	m := make([][]float64, n)
+	for i := range m {
+		m[i] = append([]float64(nil), args[i*n:(i+1)*n]...)
+	}
+
+	result := 1.0
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if m[pivot][col] == 0 {
+			return 0
+		}
+		if pivot != col {
+			m[pivot], m[col] = m[col], m[pivot]
+			result = -result
+		}
+		result *= m[col][col]
+		for row := col + 1; row < n; row++ {
+			factor := m[row][col] / m[col][col]
+			for k := col; k < n; k++ {
+				m[row][k] -= factor * m[col][k]
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,20 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDot(t *testing.T) {
+	assert.Equal(t, 32.0, dot([]float64{1, 2, 3, 4, 5, 6}))
+}
+
+func TestDet(t *testing.T) {
+	assert.InDelta(t, -2, det([]float64{1, 2, 3, 4}), 1e-9)
+	assert.InDelta(t, 7, det([]float64{7}), 1e-9)
+	// Нужна перестановка строк: на диагонали ноль
+	assert.InDelta(t, -1, det([]float64{0, 1, 1, 0}), 1e-9)
+	assert.InDelta(t, 0, det([]float64{1, 2, 3, 2, 4, 6, 1, 1, 1}), 1e-9)
+	assert.InDelta(t, -306, det([]float64{6, 1, 1, 4, -2, 5, 2, 8, 7}), 1e-9)
+}
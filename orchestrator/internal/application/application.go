@@ -9,6 +9,7 @@ import (
 	"github.com/RichCake/calc_api_go/orchestrator/internal/config"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/webhook"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
 )
 
@@ -23,6 +24,7 @@ func setUpLogger(logFile *os.File) error {
 type Application struct {
 	config   *config.Config
 	service  *expression.ExpressionService // здесь только для graceful shutdown
+	webhooks *webhook.Service
 	forTests bool
 }
 
@@ -56,16 +58,27 @@ func (a *Application) RunServer() error {
 	// А вот и сервис по работе с выражениями. Он используется в хендлерах для обработки запросов
 	expressionService := expression.NewExpressionService(storage, a.config.TimeConf)
 	a.service = expressionService
+	// Чиним то, что осталось от прошлого запуска, до того как агенты начнут брать задачи
+	if _, err := expressionService.Recover(); err != nil {
+		slog.Error("Recovery failed", "error", err)
+	}
+	// Задачи пропавших агентов возвращаются в очередь
+	go expressionService.RunLeaseReaper(a.config.TimeConf.ReapInterval)
+	// Вебхуки о закрытых выражениях уходят в фоне
+	webhookService := webhook.NewService(storage, a.config.Webhooks)
+	a.webhooks = webhookService
+	go webhookService.Run(a.config.Webhooks.Interval)
 	// Сервис авторизации
-	authService := auth.NewAuthService(storage, []byte(a.config.SecretKey))
+	authService := auth.NewAuthService(storage, []byte(a.config.SecretKey), a.config.AuthCon.AdminLogins)
 
 	// Запуск HTTP и gRPC серверов в разных горутинах
-	go httpserver.RunHTTPServer(authService, expressionService, *a.config)
+	go httpserver.RunHTTPServer(authService, expressionService, webhookService, *a.config)
 	grpcserver.RunGRPCServer(expressionService, *a.config)
 	return nil
 }
 
 func (a *Application) Close() {
 	slog.Info("Application shutdown")
+	a.webhooks.Close()
 	a.service.Close()
 }
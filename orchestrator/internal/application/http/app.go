@@ -5,14 +5,16 @@ import (
 	"net/http"
 
 	"github.com/RichCake/calc_api_go/orchestrator/internal/config"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/webhook"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/transport/handlers"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/transport/middlewares"
 	"github.com/gorilla/mux"
 )
 
-func RunHTTPServer(authService *auth.AuthService, expressionService *expression.ExpressionService, config config.Config) {
+func RunHTTPServer(authService *auth.AuthService, expressionService *expression.ExpressionService, webhookService *webhook.Service, config config.Config) {
 	slog.Info("Starting server", "port", config.Addr)
 	r := mux.NewRouter()
 	r.Use(middlewares.LoggingMiddleware)
@@ -21,11 +23,32 @@ func RunHTTPServer(authService *auth.AuthService, expressionService *expression.
 	r.Handle("/api/v1/register", handlers.NewRegisterHandler(authService)).Methods(http.MethodPost)
 
 	authRequired := r.NewRoute().Subrouter()
-	authRequired.Use(middlewares.NewAuthMiddleware([]byte(config.SecretKey)))
+	authRequired.Use(middlewares.NewAuthMiddleware([]byte(config.SecretKey), authService))
 
 	authRequired.Handle("/api/v1/calculate", handlers.NewCalcHandler(expressionService)).Methods(http.MethodPost)
+	authRequired.Handle("/api/v1/calculate/batch", handlers.NewBatchHandler(expressionService)).Methods(http.MethodPost)
+	authRequired.Handle("/api/v1/batches/{id:[0-9]+}", handlers.NewGetBatchHandler(expressionService)).Methods(http.MethodGet)
 	authRequired.Handle("/api/v1/expressions", handlers.NewExpressionListHandler(expressionService)).Methods(http.MethodGet)
 	authRequired.Handle("/api/v1/expressions/{id:[0-9]+}", handlers.NewExpressionHandler(expressionService)).Methods(http.MethodGet)
+	authRequired.Handle("/api/v1/expressions/{id:[0-9]+}", handlers.NewCancelHandler(expressionService)).Methods(http.MethodDelete)
+	authRequired.Handle("/api/v1/expressions/{id:[0-9]+}/cancel", handlers.NewCancelHandler(expressionService)).Methods(http.MethodPost)
+	authRequired.Handle("/api/v1/expressions/{id:[0-9]+}/timeline", handlers.NewTimelineHandler(expressionService)).Methods(http.MethodGet)
+	authRequired.Handle("/api/v1/expressions/{id:[0-9]+}/events", handlers.NewExpressionEventsHandler(expressionService)).Methods(http.MethodGet)
+	authRequired.Handle("/api/v1/events", handlers.NewEventsHandler(expressionService)).Methods(http.MethodGet)
+	authRequired.Handle("/api/v1/ws", handlers.NewWebSocketHandler(expressionService, config.WebSocket.AllowedOrigins)).Methods(http.MethodGet)
+	authRequired.Handle("/api/v1/settings", handlers.NewSettingsHandler(authService)).Methods(http.MethodGet, http.MethodPut)
+	authRequired.Handle("/api/v1/webhooks", handlers.NewWebhooksHandler(webhookService)).Methods(http.MethodGet, http.MethodPost)
+	authRequired.Handle("/api/v1/webhooks/{id:[0-9]+}", handlers.NewDeleteWebhookHandler(webhookService)).Methods(http.MethodDelete)
+	authRequired.Handle("/api/v1/webhooks/secret", handlers.NewWebhookSecretHandler(webhookService)).Methods(http.MethodPost)
+	authRequired.Handle("/api/v1/webhooks/deliveries", handlers.NewWebhookDeliveriesHandler(webhookService)).Methods(http.MethodGet)
+
+	adminRequired := authRequired.PathPrefix("/api/v1/admin").Subrouter()
+	adminRequired.Use(middlewares.NewRoleMiddleware(models.RoleAdmin))
+
+	adminRequired.Handle("/recovery", handlers.NewRecoveryHandler(expressionService)).Methods(http.MethodGet, http.MethodPost)
+	adminRequired.Handle("/dead-tasks", handlers.NewDeadTasksHandler(expressionService)).Methods(http.MethodGet)
+	adminRequired.Handle("/dead-tasks/{id:[0-9]+}/requeue", handlers.NewRequeueHandler(expressionService)).Methods(http.MethodPost)
+	adminRequired.Handle("/cache", handlers.NewCacheHandler(expressionService)).Methods(http.MethodGet)
 
 	http.Handle("/", r)
 	if err := http.ListenAndServe(":"+config.Addr, nil); err != nil {
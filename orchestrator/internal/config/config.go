@@ -11,10 +11,74 @@ type TimeConfig struct {
 	TimeSub time.Duration `env:"TIME_SUBTRACTION_MS" env-default:"1s"`
 	TimeMul time.Duration `env:"TIME_MULTIPLICATIONS_MS" env-default:"1s"`
 	TimeDiv time.Duration `env:"TIME_DIVISIONS_MS" env-default:"1s"`
+	// Финансовые функции pmt, fv, npv
+	TimeFinance time.Duration `env:"TIME_FINANCIAL_MS" env-default:"1s"`
+	// Факториал
+	TimeFactorial time.Duration `env:"TIME_FACTORIAL_MS" env-default:"1s"`
+	// nCr, nPr
+	TimeCombinatorics time.Duration `env:"TIME_COMBINATORICS_MS" env-default:"1s"`
+	// gcd, lcm, isprime
+	TimeNumberTheory time.Duration `env:"TIME_NUMBER_THEORY_MS" env-default:"1s"`
+	// sum, mean, median, stddev
+	TimeAggregate time.Duration `env:"TIME_AGGREGATE_MS" env-default:"1s"`
+	// dot, det и каждая ячейка matmul
+	TimeMatrix time.Duration `env:"TIME_MATRIX_MS" env-default:"1s"`
+	// Сколько ждем результат сверх времени операции, прежде чем отдать задачу другому агенту
+	LeaseGrace time.Duration `env:"TASK_LEASE_GRACE" env-default:"5s"`
+	// Как часто ищем задачи с истекшей арендой и выражения с истекшим сроком
+	ReapInterval time.Duration `env:"TASK_REAP_INTERVAL" env-default:"1s"`
+	// Сколько раз выдаем задачу, прежде чем отправить ее в dead-letter. 0 - без ограничения
+	MaxAttempts int `env:"TASK_MAX_ATTEMPTS" env-default:"5"`
+	// Пауза перед повторной выдачей, удваивается с каждой попыткой до RetryBackoffMax
+	RetryBackoff    time.Duration `env:"TASK_RETRY_BACKOFF" env-default:"1s"`
+	RetryBackoffMax time.Duration `env:"TASK_RETRY_BACKOFF_MAX" env-default:"1m"`
+	// За каждый такой промежуток ожидания приоритет задачи растет на единицу, чтобы низкий приоритет не ждал вечно. 0 - без старения
+	PriorityAging time.Duration `env:"TASK_PRIORITY_AGING" env-default:"10s"`
+	// Веса пользователей при выдаче задач: логин:вес через запятую, например alice:3,bob:1.
+	// Пока у нескольких пользователей есть задачи, каждый получает агентов пропорционально весу
+	UserWeights map[string]int `env:"FAIR_USER_WEIGHTS" env-separator:","`
+	// Вес пользователей, которых нет в UserWeights
+	DefaultUserWeight int `env:"FAIR_DEFAULT_WEIGHT" env-default:"1"`
+	// Срок решения выражения, если в запросе timeout не указан. 0 - без срока
+	DefaultTimeout time.Duration `env:"EXPRESSION_DEFAULT_TIMEOUT" env-default:"5m"`
+	// Больший timeout пользователь указать не может. 0 - без ограничения
+	MaxTimeout time.Duration `env:"EXPRESSION_MAX_TIMEOUT" env-default:"1h"`
+	// Дольше ?wait= запрос ждать результата не может. 0 - без ограничения
+	MaxWait time.Duration `env:"EXPRESSION_MAX_WAIT" env-default:"1m"`
+	// Сколько помним результат задачи, чтобы не отдавать агентам ту же операцию с теми же аргументами
+	CacheTTL time.Duration `env:"RESULT_CACHE_TTL" env-default:"10m"`
+	// Сколько результатов помним. 0 - кэш выключен
+	CacheSize int `env:"RESULT_CACHE_SIZE" env-default:"10000"`
+	// Сколько выражений можно отправить одним пакетом. 0 - без ограничения
+	MaxBatchSize int `env:"BATCH_MAX_SIZE" env-default:"5000"`
 }
 
 type AuthConfig struct {
 	TokenTTL time.Duration `env:"AUTH_TOKEN_TTL" env-default:"1h"`
+	// Логины администраторов через запятую. Роль выдается при регистрации или входе
+	AdminLogins []string `env:"ADMIN_LOGINS" env-separator:","`
+}
+
+// Доставка вебхуков о закрытии выражений
+type WebhookConfig struct {
+	// Сколько раз пытаемся доставить вебхук, прежде чем сдаться
+	MaxAttempts int `env:"WEBHOOK_MAX_ATTEMPTS" env-default:"6"`
+	// Пауза перед повторной попыткой, удваивается с каждой попыткой до RetryBackoffMax
+	RetryBackoff    time.Duration `env:"WEBHOOK_RETRY_BACKOFF" env-default:"5s"`
+	RetryBackoffMax time.Duration `env:"WEBHOOK_RETRY_BACKOFF_MAX" env-default:"10m"`
+	// Сколько ждем ответа получателя
+	Timeout time.Duration `env:"WEBHOOK_TIMEOUT" env-default:"10s"`
+	// Как часто ищем доставки, которым пора уйти
+	Interval time.Duration `env:"WEBHOOK_INTERVAL" env-default:"1s"`
+	// Внутренние адреса, куда все же можно слать вебхуки: хосты, адреса и подсети через запятую,
+	// например localhost,10.0.0.0/8. Остальные loopback, частные и link-local адреса запрещены
+	AllowedHosts []string `env:"WEBHOOK_ALLOWED_HOSTS" env-separator:","`
+}
+
+type WebSocketConfig struct {
+	// Страницы, которым кроме страниц самого API можно открывать сессию /api/v1/ws:
+	// origin через запятую, например https://app.example.com
+	AllowedOrigins []string `env:"WS_ALLOWED_ORIGINS" env-separator:","`
 }
 
 type Config struct {
@@ -23,6 +87,8 @@ type Config struct {
 	SecretKey string `env:"SECRET_KEY"`
 	TimeConf  TimeConfig
 	AuthCon   AuthConfig
+	Webhooks  WebhookConfig
+	WebSocket WebSocketConfig
 }
 
 func ConfigFromEnv() (*Config, error) {
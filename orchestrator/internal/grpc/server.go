@@ -7,11 +7,20 @@ import (
 
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
 	orchestrator "github.com/RichCake/calc_api_go/protos/gen/go/orchestrator"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// Причины отказа в ErrorInfo. По одному коду агент не отличит отмену выражения от истекшей аренды:
+// оба случая - FailedPrecondition
+const (
+	ErrorDomain               = "calc_api.orchestrator"
+	ReasonLeaseExpired        = "LEASE_EXPIRED"
+	ReasonExpressionCancelled = "EXPRESSION_CANCELLED"
+)
+
 type serverAPI struct {
 	orchestrator.TasksServer
 	service *expression.ExpressionService
@@ -25,19 +34,21 @@ func (s *serverAPI) SendTask(
 	ctx context.Context,
 	req *orchestrator.SendTaskRequest,
 ) (*orchestrator.SendTaskResponse, error) {
-	task, err := s.service.GetPendingTask()
+	task, err := s.service.ClaimPendingTask(req.AgentId)
 	if errors.Is(err, expression.ErrPendingTaskNotFount) {
 		return nil, status.Errorf(codes.NotFound, "no pending task found")
 	} else if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to get pending task: %v", err)
 	}
-	slog.Info("GRPC. Send task", "task", task)
+	slog.Info("GRPC. Send task", "task", task, "agent_id", req.AgentId)
 	response := orchestrator.SendTaskResponse{
 		Id: int64(task.ID),
 		Arg1: task.Arg1,
 		Arg2: task.Arg2,
 		Operation: task.Operation,
 		OperationTimeMs: task.OperationTime.Nanoseconds(),
+		Args: task.Args,
+		AttemptToken: task.AttemptToken,
 	}
 	return &response, nil
 }
@@ -47,6 +58,50 @@ func (s *serverAPI) ReceiveTask(
 	req *orchestrator.ReceiveTaskRequest,
 ) (*orchestrator.ReceiveTaskResponse, error) {
 	slog.Info("GRPC. Receive task", "request", req)
-	s.service.ProcessIncomingTask(int(req.Id), req.Result)
+	err := s.service.ProcessIncomingTask(int(req.Id), req.AttemptToken, req.Result)
+	if errors.Is(err, expression.ErrTaskNotFound) {
+		return nil, status.Errorf(codes.NotFound, "task not found")
+	} else if errors.Is(err, expression.ErrLeaseExpired) {
+		// Агент не успел, задача вернулась в очередь
+		return nil, reasonError(codes.FailedPrecondition, ReasonLeaseExpired, "task lease expired")
+	} else if errors.Is(err, expression.ErrStaleAttempt) {
+		// Задачу уже отдали другому агенту
+		return nil, status.Errorf(codes.Aborted, "stale task attempt")
+	} else if errors.Is(err, expression.ErrDuplicateResult) {
+		return nil, status.Errorf(codes.AlreadyExists, "task result already accepted")
+	} else if errors.Is(err, expression.ErrExpressionCancelled) {
+		// Выражение отменили, результат отброшен. Canceled тут не подходит: его клиент gRPC
+		// выставляет сам, когда отменен его собственный вызов
+		return nil, reasonError(codes.FailedPrecondition, ReasonExpressionCancelled, "expression cancelled, task result discarded")
+	} else if errors.Is(err, expression.ErrExpressionTimeout) {
+		// Срок выражения истек, оно закрыто с ошибкой timeout
+		return nil, status.Errorf(codes.DeadlineExceeded, "expression deadline exceeded")
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to process task result: %v", err)
+	}
 	return &orchestrator.ReceiveTaskResponse{}, nil
 }
+
+// Ошибка с кодом code и причиной reason в ErrorInfo
+func reasonError(code codes.Code, reason string, message string) error {
+	st, err := status.New(code, message).WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: ErrorDomain})
+	if err != nil {
+		return status.Error(code, message)
+	}
+	return st.Err()
+}
+
+func (s *serverAPI) CancelledTasks(
+	ctx context.Context,
+	req *orchestrator.CancelledTasksRequest,
+) (*orchestrator.CancelledTasksResponse, error) {
+	ids, err := s.service.CancelledTasks(req.AgentId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get cancelled tasks: %v", err)
+	}
+	response := orchestrator.CancelledTasksResponse{Ids: make([]int64, 0, len(ids))}
+	for _, id := range ids {
+		response.Ids = append(response.Ids, int64(id))
+	}
+	return &response, nil
+}
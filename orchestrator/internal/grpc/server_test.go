@@ -0,0 +1,119 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/config"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
+	orchestrator "github.com/RichCake/calc_api_go/protos/gen/go/orchestrator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSendTaskConcurrent(t *testing.T) {
+	// База в файле, чтобы агенты шли через разные соединения, как в работе
+	service := expression.NewExpressionService(storage.Open(filepath.Join(t.TempDir(), "store.db")), config.TimeConfig{LeaseGrace: time.Minute})
+	defer service.Close()
+	server := &serverAPI{service: service}
+
+	const tasksCount = 100
+	for i := 0; i < tasksCount; i++ {
+		_, err := service.ProcessExpression(fmt.Sprintf("%d + 1", i), 1)
+		require.NoError(t, err)
+	}
+
+	// Агенты опрашивают сервер одновременно, пока задачи не кончатся
+	const agentsCount = 20
+	var mu sync.Mutex
+	received := map[int64]string{}
+	var wg sync.WaitGroup
+	for i := 0; i < agentsCount; i++ {
+		wg.Add(1)
+		go func(agentID string) {
+			defer wg.Done()
+			for {
+				resp, err := server.SendTask(context.Background(), &orchestrator.SendTaskRequest{AgentId: agentID})
+				if status.Code(err) == codes.NotFound {
+					return
+				}
+				// require нельзя вызывать не из горутины теста
+				if !assert.NoError(t, err) {
+					return
+				}
+				mu.Lock()
+				if previous, ok := received[resp.Id]; ok {
+					t.Errorf("task %d sent twice: to %s and %s", resp.Id, previous, agentID)
+				}
+				received[resp.Id] = agentID
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("agent-%d", i))
+	}
+	wg.Wait()
+
+	require.Len(t, received, tasksCount)
+}
+
+func TestReceiveTaskStatusCodes(t *testing.T) {
+	service := expression.NewExpressionService(storage.NewStorage(true), config.TimeConfig{LeaseGrace: time.Minute})
+	defer service.Close()
+	server := &serverAPI{service: service}
+
+	_, err := service.ProcessExpression("2 + 2", 1)
+	require.NoError(t, err)
+	task, err := server.SendTask(context.Background(), &orchestrator.SendTaskRequest{AgentId: "agent"})
+	require.NoError(t, err)
+
+	receive := func(id int64, token string) codes.Code {
+		_, err := server.ReceiveTask(context.Background(), &orchestrator.ReceiveTaskRequest{Id: id, Result: 4, AttemptToken: token})
+		return status.Code(err)
+	}
+	require.Equal(t, codes.Aborted, receive(task.Id, "stale"))
+	require.Equal(t, codes.OK, receive(task.Id, task.AttemptToken))
+	require.Equal(t, codes.AlreadyExists, receive(task.Id, task.AttemptToken))
+	require.Equal(t, codes.NotFound, receive(task.Id+1, task.AttemptToken))
+}
+
+func TestCancelledTasks(t *testing.T) {
+	service := expression.NewExpressionService(storage.NewStorage(true), config.TimeConfig{LeaseGrace: time.Minute})
+	defer service.Close()
+	server := &serverAPI{service: service}
+
+	expression_id, err := service.ProcessExpression("2 + 2", 1)
+	require.NoError(t, err)
+	task, err := server.SendTask(context.Background(), &orchestrator.SendTaskRequest{AgentId: "agent"})
+	require.NoError(t, err)
+
+	resp, err := server.CancelledTasks(context.Background(), &orchestrator.CancelledTasksRequest{AgentId: "agent"})
+	require.NoError(t, err)
+	require.Empty(t, resp.Ids)
+
+	_, err = service.CancelExpression(expression_id, 1)
+	require.NoError(t, err)
+
+	resp, err = server.CancelledTasks(context.Background(), &orchestrator.CancelledTasksRequest{AgentId: "agent"})
+	require.NoError(t, err)
+	require.Equal(t, []int64{task.Id}, resp.Ids)
+
+	_, err = server.ReceiveTask(context.Background(), &orchestrator.ReceiveTaskRequest{Id: task.Id, Result: 4, AttemptToken: task.AttemptToken})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Equal(t, ReasonExpressionCancelled, errorReason(err))
+}
+
+func errorReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
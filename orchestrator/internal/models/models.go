@@ -1,27 +1,94 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
 )
 
 type Expression struct {
-	ID         int               `json:"id"`
-	Status     string            `json:"status"`
-	Result     float64           `json:"result"`
-	UserID     int               `json:"-"`
-	BinaryTree *calculation.Tree `json:"-"`
+	ID              int               `json:"id"`
+	Status          ExpressionStatus  `json:"status"`
+	ErrorCode       string            `json:"error_code,omitempty"`    // машиночитаемая причина ошибки, см. ErrorCode*
+	ErrorMessage    string            `json:"error_message,omitempty"` // например "division by zero"
+	Result          float64           `json:"result"`
+	Value           any               `json:"value,omitempty"` // результат-вектор или матрица, у чисел пусто
+	UserID          int               `json:"-"`
+	BinaryTree      *calculation.Tree `json:"-"`
+	FormattedResult string            `json:"formatted_result,omitempty"` // результат в формате локали, в базе не хранится
+	FormattedValue  any               `json:"formatted_value,omitempty"`
+	Deadline        *time.Time        `json:"deadline,omitempty"` // если выражение не решено к этому времени, оно закрывается с ошибкой timeout
+	Priority        int               `json:"priority"`           // от 0 до 9, чем больше, тем раньше выдаются задачи
+	TotalTasks      int               `json:"-"`                  // сколько задач в выражении, считается по дереву при отправке
+	CreatedAt       time.Time         `json:"-"`
+	FinishedAt      *time.Time        `json:"-"`                      // когда выражение решено, закрыто с ошибкой или отменено
+	Progress        *Progress         `json:"progress,omitempty"`     // считается при запросе, в базе не хранится
+	CallbackURL     string            `json:"callback_url,omitempty"` // сюда уходит вебхук, когда выражение решено или закрыто с ошибкой
+	NoCache         bool              `json:"no_cache,omitempty"`     // все задачи считают агенты, кэш результатов не используется
+	BatchID         int               `json:"batch_id,omitempty"`     // пакет, в котором выражение отправлено
+	ClientID        string            `json:"client_id,omitempty"`    // ID, который клиент дал выражению в пакете
+	DependsOn       []int             `json:"depends_on,omitempty"`   // выражения, на которые ссылается это ($42), считается при запросе
+}
+
+// Ход решения выражения для полосы прогресса
+type Progress struct {
+	TotalTasks int     `json:"total_tasks"`
+	Completed  int     `json:"completed"`
+	InProgress int     `json:"in_progress"` // задачи, которые сейчас считают агенты
+	Pending    int     `json:"pending"`     // задачи в очереди и те, что ждут результатов своих аргументов
+	Percent    float64 `json:"percent"`
+	ElapsedMS  int64   `json:"elapsed_ms"`
+	ETAMS      int64   `json:"eta_ms"` // оценка по критическому пути, если агентов хватает на все задачи сразу
+}
+
+const (
+	BatchProcessing = "processing" // хотя бы одно выражение пакета еще считается
+	BatchDone       = "done"
+)
+
+// Выражения, отправленные одним запросом. Counts и Expressions считаются при запросе
+type Batch struct {
+	ID          int                      `json:"id"`
+	UserID      int                      `json:"-"`
+	Status      string                   `json:"status"` // BatchProcessing или BatchDone
+	Total       int                      `json:"total"`
+	Counts      map[ExpressionStatus]int `json:"counts"` // сколько выражений в каждом статусе
+	CreatedAt   time.Time                `json:"created_at"`
+	Expressions []Expression             `json:"expressions"`
 }
 
 type Task struct {
 	ID            int           `json:"id"`
 	ExpressionID  int           `json:"-"`
-	Status        string        `json:"-"`
+	UserID        int           `json:"-"` // владелец выражения, по нему задачи делятся между пользователями поровну
+	Status        TaskStatus    `json:"-"`
 	Arg1          float64       `json:"arg1"`
 	Arg2          float64       `json:"arg2"`
+	Args          []float64     `json:"args,omitempty"` // аргументы функции, у бинарных операций пусто
 	Operation     string        `json:"operation"`
 	OperationTime time.Duration `json:"operation_time"`
+	LeaseUntil    time.Time     `json:"-"` // до этого времени ждем результат от агента, который взял задачу
+	AgentID       string        `json:"-"`
+	AttemptToken  string        `json:"attempt_token"` // выдается при каждой раздаче, агент возвращает его с результатом
+	Attempts      int           `json:"-"`             // сколько раз задачу выдавали агентам
+	AvailableAt   time.Time     `json:"-"`             // после неудачной попытки задачу не выдаем до этого времени
+	Priority      int           `json:"-"`             // приоритет выражения
+	QueuedAt      time.Time     `json:"-"`             // когда задача встала в очередь, от этого считается старение приоритета
+}
+
+// Запись в истории задачи: создание, выдача агенту, результат
+type TaskEvent struct {
+	ID           int       `json:"id"`
+	ExpressionID int       `json:"-"`
+	TaskID       int       `json:"task_id"`
+	Event        string    `json:"event"` // created, dispatched, completed, expired или dead
+	AgentID      string    `json:"agent_id,omitempty"`
+	Operation    string    `json:"operation"`
+	Args         []float64 `json:"args"`             // операнды задачи
+	Result       *float64  `json:"result,omitempty"` // только у completed
+	Attempt      int       `json:"attempt,omitempty"`
+	Time         time.Time `json:"time"`
 }
 
 type User struct {
@@ -29,4 +96,51 @@ type User struct {
 	Login        string
 	PasswordHash string
 	Password     string
+	Locale       string // формат чисел во вводе и выводе, пусто значит по умолчанию
+	Role         string // RoleUser или RoleAdmin
+}
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Вебхук пользователя по умолчанию: сюда уходят результаты всех его выражений
+type Webhook struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"-"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	WebhookPending   = "pending"   // ждет первой или повторной попытки
+	WebhookDelivered = "delivered" // получатель ответил 2xx
+	WebhookFailed    = "failed"    // попытки кончились
+)
+
+// Одно уведомление о закрытии выражения на один адрес
+type WebhookDelivery struct {
+	ID            int              `json:"id"`
+	UserID        int              `json:"-"`
+	ExpressionID  int              `json:"expression_id"`
+	Event         string           `json:"event"`
+	URL           string           `json:"url"`
+	Payload       json.RawMessage  `json:"payload"` // тело запроса, оно же подписывается
+	Status        string           `json:"status"`  // WebhookPending, WebhookDelivered или WebhookFailed
+	Attempts      int              `json:"attempts"`
+	NextAttemptAt *time.Time       `json:"next_attempt_at,omitempty"` // только у pending
+	CreatedAt     time.Time        `json:"created_at"`
+	DeliveredAt   *time.Time       `json:"delivered_at,omitempty"`
+	History       []WebhookAttempt `json:"history"`
+}
+
+type WebhookAttempt struct {
+	ID         int       `json:"-"`
+	DeliveryID int       `json:"-"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"` // пусто, если ответа не было
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	Time       time.Time `json:"time"`
 }
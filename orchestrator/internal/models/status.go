@@ -0,0 +1,98 @@
+package models
+
+// Статусы выражений и задач и разрешенные переходы между ними
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+type ExpressionStatus string
+
+const (
+	ExpressionProcessing ExpressionStatus = "processing"
+	ExpressionSolved     ExpressionStatus = "solve"
+	ExpressionError      ExpressionStatus = "error" // причина в ErrorCode и ErrorMessage
+	ExpressionCancelled  ExpressionStatus = "cancelled"
+)
+
+type TaskStatus string
+
+const (
+	TaskPending    TaskStatus = "pending"
+	TaskInProgress TaskStatus = "in progress"
+	TaskDone       TaskStatus = "done"
+	TaskCancelled  TaskStatus = "cancelled" // выражение отменили, пока задачу считал агент
+	TaskDead       TaskStatus = "dead"      // попытки кончились, задача в dead-letter
+)
+
+// Коды ошибок выражения. Сообщение для человека лежит рядом в ErrorMessage
+const (
+	ErrorCodeDivisionByZero   = "division_by_zero"
+	ErrorCodeInvalidArgument  = "invalid_argument"  // аргумент функции вне области определения
+	ErrorCodeInvalidOperation = "invalid_operation" // прочие ошибки в аргументах операции
+	ErrorCodeTimeout          = "timeout"
+	ErrorCodeTaskFailed       = "task_failed"       // задача ушла в dead-letter
+	ErrorCodeDependencyFailed = "dependency_failed" // выражение, на которое ссылается это, не решилось
+	ErrorCodeInternal         = "internal"
+)
+
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// Куда можно перейти из каждого статуса. Статусов, которых здесь нет, никто не покидает
+var expressionTransitions = map[ExpressionStatus][]ExpressionStatus{
+	ExpressionProcessing: {ExpressionSolved, ExpressionError, ExpressionCancelled},
+	// Администратор вернул в очередь задачу из dead-letter, выражение досчитывается
+	ExpressionError: {ExpressionProcessing},
+}
+
+var taskTransitions = map[TaskStatus][]TaskStatus{
+	TaskPending: {TaskInProgress},
+	// Аренда истекла - обратно в очередь, а если попыток больше нет - в dead-letter
+	TaskInProgress: {TaskDone, TaskPending, TaskCancelled, TaskDead},
+	TaskDead:       {TaskPending},
+}
+
+func (s ExpressionStatus) CanTransition(to ExpressionStatus) bool {
+	return slices.Contains(expressionTransitions[s], to)
+}
+
+func (s TaskStatus) CanTransition(to TaskStatus) bool {
+	return slices.Contains(taskTransitions[s], to)
+}
+
+// Законченное выражение больше не считается, хотя ошибку еще можно исправить через dead-letter
+func (s ExpressionStatus) Finished() bool {
+	return s != ExpressionProcessing
+}
+
+func (e *Expression) SetStatus(to ExpressionStatus) error {
+	if !e.Status.CanTransition(to) {
+		return fmt.Errorf("%w: expression %d: %s -> %s", ErrInvalidTransition, e.ID, e.Status, to)
+	}
+	e.Status = to
+	if to != ExpressionError {
+		e.ErrorCode = ""
+		e.ErrorMessage = ""
+	}
+	return nil
+}
+
+// Закрывает выражение с ошибкой
+func (e *Expression) Fail(code string, message string) error {
+	if err := e.SetStatus(ExpressionError); err != nil {
+		return err
+	}
+	e.ErrorCode = code
+	e.ErrorMessage = message
+	return nil
+}
+
+func (t *Task) SetStatus(to TaskStatus) error {
+	if !t.Status.CanTransition(to) {
+		return fmt.Errorf("%w: task %d: %s -> %s", ErrInvalidTransition, t.ID, t.Status, to)
+	}
+	t.Status = to
+	return nil
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskTransitions(t *testing.T) {
+	task := Task{ID: 1, Status: TaskPending}
+	require.NoError(t, task.SetStatus(TaskInProgress))
+	require.NoError(t, task.SetStatus(TaskDone))
+
+	// Решенная задача в очередь не возвращается
+	err := task.SetStatus(TaskPending)
+	require.ErrorIs(t, err, ErrInvalidTransition)
+	require.EqualError(t, err, "invalid status transition: task 1: done -> pending")
+	require.Equal(t, TaskDone, task.Status)
+
+	dead := Task{Status: TaskInProgress}
+	require.NoError(t, dead.SetStatus(TaskDead))
+	require.NoError(t, dead.SetStatus(TaskPending))
+	require.ErrorIs(t, dead.SetStatus(TaskDone), ErrInvalidTransition)
+}
+
+func TestExpressionTransitions(t *testing.T) {
+	expression := Expression{ID: 1, Status: ExpressionProcessing}
+	require.NoError(t, expression.Fail(ErrorCodeTaskFailed, "task 3 failed after 5 attempts"))
+	require.Equal(t, ExpressionError, expression.Status)
+	require.Equal(t, ErrorCodeTaskFailed, expression.ErrorCode)
+
+	// После requeue из dead-letter выражение снова считается, старая ошибка стирается
+	require.NoError(t, expression.SetStatus(ExpressionProcessing))
+	require.Empty(t, expression.ErrorCode)
+	require.Empty(t, expression.ErrorMessage)
+	require.NoError(t, expression.SetStatus(ExpressionSolved))
+
+	require.ErrorIs(t, expression.SetStatus(ExpressionProcessing), ErrInvalidTransition)
+	require.ErrorIs(t, expression.Fail(ErrorCodeTimeout, "timeout"), ErrInvalidTransition)
+	require.Equal(t, ExpressionSolved, expression.Status)
+
+	cancelled := Expression{Status: ExpressionCancelled}
+	require.ErrorIs(t, cancelled.SetStatus(ExpressionProcessing), ErrInvalidTransition)
+}
@@ -6,28 +6,44 @@ import (
 	"time"
 
 	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
 	"github.com/golang-jwt/jwt/v5"
 )
 type ContextKey string
 const ContextKeyUserID ContextKey = "user_id"
+const ContextKeyRole ContextKey = "role"
 
 type AuthService struct {
 	storage *storage.Storage
 	secret_key []byte
+	admins  map[string]bool // логины, которым положена роль администратора
 }
 
-func NewAuthService(storage *storage.Storage, secret_key []byte) *AuthService {
+func NewAuthService(storage *storage.Storage, secret_key []byte, adminLogins []string) *AuthService {
+	admins := map[string]bool{}
+	for _, login := range adminLogins {
+		admins[login] = true
+	}
 	return &AuthService{
 		storage: storage,
 		secret_key: secret_key,
+		admins: admins,
+	}
+}
+
+func (s *AuthService) roleFor(login string) string {
+	if s.admins[login] {
+		return models.RoleAdmin
 	}
+	return models.RoleUser
 }
 
 func (s *AuthService) Register(login string, password string) (int, error) {
 	var newUser models.User
 	newUser.Login = login
 	newUser.Password = password
+	newUser.Role = s.roleFor(login)
 	passwordHash, err := generate(password)
 	if err != nil {
 		slog.Error("Encryption failed", "error", err.Error())
@@ -55,8 +71,17 @@ func (s *AuthService) Login(login string, password string) (string, error) {
 	if compare(user.PasswordHash, password) != nil {
 		return "", ErrBadCredentials
 	}
+	// Список администраторов в конфиге могли поменять после регистрации: роль и повышается, и снимается
+	if role := s.roleFor(login); user.Role != role {
+		user.Role = role
+		if _, err := s.storage.SaveUser(&user); err != nil {
+			slog.Error("Login failed", "error", err.Error())
+			return "", ErrStorage
+		}
+	}
 	payload := jwt.MapClaims{
 		"sub": user.ID,
+		"role": user.Role,
 		"exp": time.Now().Add(time.Hour*24).Unix(),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, payload)
@@ -67,3 +92,47 @@ func (s *AuthService) Login(login string, password string) (string, error) {
 	}
 	return t, nil
 }
+
+// Роль пользователя по текущему ADMIN_LOGINS. Ни роли из токена, ни роли в хранилище не верим:
+// логин могли убрать из списка администраторов, пока токен еще действует
+func (s *AuthService) GetRole(user_id int) (string, error) {
+	user, err := s.storage.GetUserByID(user_id)
+	if errors.Is(err, storage.ErrItemNotFound) {
+		return "", ErrUserNotFound
+	} else if err != nil {
+		slog.Error("AuthService.GetRole: error in storage", "error", err.Error())
+		return "", ErrStorage
+	}
+	return s.roleFor(user.Login), nil
+}
+
+// Локаль пользователя: формат чисел в выражениях и результатах. Пустая строка - локаль по умолчанию
+func (s *AuthService) GetLocale(user_id int) (string, error) {
+	user, err := s.storage.GetUserByID(user_id)
+	if errors.Is(err, storage.ErrItemNotFound) {
+		return "", ErrUserNotFound
+	} else if err != nil {
+		slog.Error("AuthService.GetLocale: error in storage", "error", err.Error())
+		return "", ErrStorage
+	}
+	return user.Locale, nil
+}
+
+func (s *AuthService) SetLocale(user_id int, locale string) error {
+	if _, ok := calculation.LookupLocale(locale); locale != "" && !ok {
+		return calculation.ErrUnknownLocale
+	}
+	user, err := s.storage.GetUserByID(user_id)
+	if errors.Is(err, storage.ErrItemNotFound) {
+		return ErrUserNotFound
+	} else if err != nil {
+		slog.Error("AuthService.SetLocale: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	user.Locale = locale
+	if _, err = s.storage.SaveUser(&user); err != nil {
+		slog.Error("AuthService.SetLocale: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	return nil
+}
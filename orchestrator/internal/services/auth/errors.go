@@ -5,6 +5,7 @@ import "errors"
 var (
 	ErrUserExists     = errors.New("user already exists")
 	ErrBadCredentials = errors.New("login or password is incorrect")
+	ErrUserNotFound   = errors.New("user not found")
 	ErrEncryption     = errors.New("unknown encryption error")
 	ErrService        = errors.New("unknown service error")
 	ErrStorage        = errors.New("unknown storage error")
@@ -0,0 +1,16 @@
+package backoff
+
+import "time"
+
+// Пауза перед следующей попыткой: base после первой попытки, дальше удваивается с каждой попыткой до max.
+// max 0 - без ограничения, base 0 - без паузы
+func Doubling(base, max time.Duration, attempts int) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff > 0; i++ {
+		backoff *= 2
+		if max > 0 && backoff >= max {
+			return max
+		}
+	}
+	return backoff
+}
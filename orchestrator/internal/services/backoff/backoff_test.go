@@ -0,0 +1,21 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoubling(t *testing.T) {
+	require.Equal(t, time.Second, Doubling(time.Second, 5*time.Second, 0))
+	require.Equal(t, time.Second, Doubling(time.Second, 5*time.Second, 1))
+	require.Equal(t, 2*time.Second, Doubling(time.Second, 5*time.Second, 2))
+	require.Equal(t, 4*time.Second, Doubling(time.Second, 5*time.Second, 3))
+	require.Equal(t, 5*time.Second, Doubling(time.Second, 5*time.Second, 4))
+	require.Equal(t, 5*time.Second, Doubling(time.Second, 5*time.Second, 1000))
+
+	// Без ограничения растет дальше, без паузы так и остается нулем
+	require.Equal(t, 8*time.Second, Doubling(time.Second, 0, 4))
+	require.Zero(t, Doubling(0, time.Minute, 10))
+}
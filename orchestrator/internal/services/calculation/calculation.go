@@ -13,11 +13,15 @@ type Tree struct {
 	Root *TreeNode `json:"Root"`
 }
 
+// Значение Val у вершины-списка, элементы лежат в Args
+const ListVal = "[]"
+
 type TreeNode struct {
-	Val    string    `json:"Val"`
-	Left   *TreeNode `json:"Left"`
-	Right  *TreeNode `json:"Right"`
-	TaskID int       `json:"TaskID"`
+	Val    string      `json:"Val"`
+	Left   *TreeNode   `json:"Left"`
+	Right  *TreeNode   `json:"Right"`
+	Args   []*TreeNode `json:"Args,omitempty"` // аргументы функции или элементы списка, у бинарных операций пусто
+	TaskID int         `json:"TaskID"`
 }
 
 func SerializeTree(tree Tree) ([]byte, error) {
@@ -33,17 +37,85 @@ func DeserializeTree(data []byte) (Tree, error) {
 	return tree, err
 }
 
+func isNumber(val string) bool {
+	_, err := strconv.ParseFloat(val, 64)
+	return err == nil
+}
+
+// Дети вершины в порядке аргументов операции
+func (node TreeNode) children() []*TreeNode {
+	if node.Args != nil {
+		return node.Args
+	}
+	if node.Left != nil && node.Right != nil {
+		return []*TreeNode{node.Left, node.Right}
+	}
+	return nil
+}
+
+// Список - это значение, а не операция. Задачу из него не сделать
+func (node TreeNode) IsList() bool {
+	return node.Val == ListVal
+}
+
+// Значение уже известно: число или список из чисел
+func (node TreeNode) IsResolved() bool {
+	if node.IsList() {
+		for _, element := range node.Args {
+			if !element.IsResolved() {
+				return false
+			}
+		}
+		return true
+	}
+	return isNumber(node.Val)
+}
+
+// Значение посчитанной вершины: число, вектор []any или матрица из векторов
+func (node TreeNode) Value() any {
+	if node.IsList() {
+		values := make([]any, len(node.Args))
+		for i, element := range node.Args {
+			values[i] = element.Value()
+		}
+		return values
+	}
+	val, _ := strconv.ParseFloat(node.Val, 64)
+	return val
+}
+
 // Проверка на готовность функции родить задачу.
-// Если у вершины оба потомка - числа, то вершина готова
+// Если у вершины все потомки - числа или списки чисел, то вершина готова
 func (node TreeNode) IsSpare() bool {
-	if node.Right != nil && node.Left != nil {
-		_, err1 := strconv.ParseFloat(node.Left.Val, 64)
-		_, err2 := strconv.ParseFloat(node.Right.Val, 64)
-		if err1 == nil && err2 == nil {
-			return true
+	children := node.children()
+	if len(children) == 0 || node.IsList() || isStructural(node.Val) {
+		return false
+	}
+	for _, child := range children {
+		if !child.IsResolved() {
+			return false
+		}
+	}
+	return true
+}
+
+// Аргументы готовой вершины в виде чисел. Списки разворачиваются в общий ряд
+func (node TreeNode) Operands() []float64 {
+	operands := []float64{}
+	for _, child := range node.children() {
+		if child.IsList() {
+			operands = append(operands, child.Operands()...)
+			continue
 		}
+		operand, _ := strconv.ParseFloat(child.Val, 64)
+		operands = append(operands, operand)
 	}
-	return false
+	return operands
+}
+
+// Функция это вершина с аргументами, а не бинарная операция
+func (node TreeNode) IsFunction() bool {
+	return node.Args != nil && !node.IsList()
 }
 
 // Поиск всех вершин, готовых родить задачу
@@ -56,11 +128,9 @@ func (t *Tree) FindSpareNodes() []*TreeNode {
 		if node.IsSpare() {
 			spare_nodes = append(spare_nodes, node)
 		} else {
-			if node.Right != nil {
-				stack = append(stack, node.Right)
-			}
-			if node.Left != nil {
-				stack = append(stack, node.Left)
+			children := node.children()
+			for i := len(children) - 1; i >= 0; i-- {
+				stack = append(stack, children[i])
 			}
 		}
 	}
@@ -72,44 +142,110 @@ func (t *Tree) FindSpareNodes() []*TreeNode {
 func (t *Tree) ReplaceNodeWithValue(node *TreeNode, val float64) {
 	node.Left = nil
 	node.Right = nil
+	node.Args = nil
 	arg := strconv.FormatFloat(val, 'f', -1, 64)
 	node.Val = arg
 }
 
 // Поиск родительской вершины и вершины по ID задачи.
-// Нужно для замены вершины на число после решения задачи
+// Нужно для замены вершины на число после решения задачи.
+// Списки пропускаются: родитель элемента списка - операция, которая этот список принимает
 func (t *Tree) FindParentAndNodeByTaskID(task_id int) (*TreeNode, *TreeNode) {
 	if t.Root.TaskID == task_id {
 		return nil, t.Root
 	}
 
-	stack := []*TreeNode{t.Root}
+	type item struct {
+		node   *TreeNode
+		parent *TreeNode // ближайшая операция выше node
+	}
+	stack := []item{{node: t.Root}}
 	for len(stack) > 0 {
-		node := stack[len(stack)-1]
+		it := stack[len(stack)-1]
 		stack = stack[:len(stack)-1]
-		if node.Right != nil && node.Right.TaskID == task_id {
-			return node, node.Right
-		}
-		if node.Left != nil && node.Left.TaskID == task_id {
-			return node, node.Left
-		}
-
-		if node.Right != nil {
-			stack = append(stack, node.Right)
+		parent := it.node
+		if it.node.IsList() {
+			parent = it.parent
 		}
-		if node.Left != nil {
-			stack = append(stack, node.Left)
+		for _, child := range it.node.children() {
+			if child.TaskID == task_id {
+				return parent, child
+			}
+			stack = append(stack, item{node: child, parent: parent})
 		}
 	}
 	return nil, nil
 }
 
+// Открытая скобка в ToPostfix. Для вызова функции и списка считаем аргументы
+type bracket struct {
+	function  string
+	list      bool
+	argsCount int
+}
+
+// Токен списка в постфиксной записи хранит число элементов: [4]
+func listToken(length int) string {
+	return "[" + strconv.Itoa(length) + "]"
+}
+
+func parseListToken(token string) (int, bool) {
+	if !strings.HasPrefix(token, "[") || !strings.HasSuffix(token, "]") {
+		return 0, false
+	}
+	length, err := strconv.Atoi(token[1 : len(token)-1])
+	return length, err == nil
+}
+
+// Закрытие скобки или списка: выталкиваем операции до открывающей скобки open
+func popUntil(output, stack []string, open string) ([]string, []string, error) {
+	for len(stack) > 0 && stack[len(stack)-1] != "(" && stack[len(stack)-1] != "[" {
+		output = append(output, stack[len(stack)-1])
+		stack = stack[:len(stack)-1]
+	}
+	if len(stack) == 0 || stack[len(stack)-1] != open {
+		return nil, nil, ErrMismatchedBracket
+	}
+	return output, stack[:len(stack)-1], nil
+}
+
+// Операторы, которые часто вставляют из текстовых редакторов и таблиц
+var unicodeOperators = map[rune]string{
+	'×': "*",
+	'·': "*",
+	'÷': "/",
+	'−': "-",
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// Символ выражения в том виде, который понимает разбор: операторы приводятся к ASCII,
+// а разделитель аргументов локали становится запятой
+func (l Locale) normalize(r rune) string {
+	if op, ok := unicodeOperators[r]; ok {
+		return op
+	}
+	if r == l.ArgSep {
+		return ","
+	}
+	return string(r)
+}
+
 // Переводит из инфиксной в постфиксную запись (знаю умные слова)
 // А еще по пути проверяет выражение на валидность
 func ToPostfix(expression string) ([]string, error) {
-	expression = strings.ReplaceAll(expression, " ", "")
+	return ToPostfixLocale(expression, locales[DefaultLocale])
+}
+
+// То же самое, но числа и разделители записаны в формате локали.
+// В постфиксной записи числа всегда с точкой и без разделителей разрядов
+func ToPostfixLocale(str string, locale Locale) ([]string, error) {
+	expression := stripSpaces(str, locale)
 	var output []string
 	var stack []string
+	var brackets []bracket
 
 	priority := map[string]int{
 		"+": 1,
@@ -123,44 +259,146 @@ func ToPostfix(expression string) ([]string, error) {
 	}
 
 	var prevToken string
+	// После этих токенов ожидается операнд, а не операция
+	expectOperand := func() bool {
+		return prevToken == "" || prevToken == "(" || prevToken == "[" || prevToken == "," || priority[prevToken] > 0
+	}
 
 	for i := 0; i < len(expression); i++ {
-		char := string(expression[i])
+		char := locale.normalize(expression[i])
 
-		if unicode.IsDigit(rune(expression[i])) || char == "." ||
-			(char == "-" && (i == 0 || prevToken == "(" || priority[prevToken] > 0)) {
+		if isDigit(expression[i]) || expression[i] == locale.Decimal ||
+			(char == "-" && expectOperand()) {
 
-			number := char
-			for i+1 < len(expression) && (unicode.IsDigit(rune(expression[i+1])) || string(expression[i+1]) == ".") {
-				i++
-				number += string(expression[i])
+			// Число сразу после операнда: 5%3, 5!3, (1)2
+			if !expectOperand() {
+				return nil, ErrInvalidOperationsPlacement
 			}
+			number, end, err := scanNumber(expression, i, locale)
+			if err != nil {
+				return nil, err
+			}
+			i = end
 			output = append(output, number)
 			prevToken = number
 
+		} else if char == referencePrefix {
+			if !expectOperand() {
+				return nil, ErrInvalidOperationsPlacement
+			}
+			token, end, err := scanReference(expression, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			output = append(output, token)
+			prevToken = token
+
+		} else if unicode.IsLetter(expression[i]) {
+			name := char
+			for i+1 < len(expression) && unicode.IsLetter(expression[i+1]) {
+				i++
+				name += string(expression[i])
+			}
+			// Имя без скобки после него - это не вызов функции
+			if !IsFunction(name) || i+1 >= len(expression) || expression[i+1] != '(' {
+				return nil, ErrInvalidSymbols
+			}
+			if !expectOperand() {
+				return nil, ErrInvalidOperationsPlacement
+			}
+			i++
+			stack = append(stack, name, "(")
+			brackets = append(brackets, bracket{function: name})
+			prevToken = "("
+
 		} else if char == "(" {
+			// Скобка сразу после процента или факториала: 10%(2), 5!(2)
+			if prevToken == "%" || prevToken == "!" {
+				return nil, ErrInvalidOperationsPlacement
+			}
 			stack = append(stack, char)
+			brackets = append(brackets, bracket{})
 			prevToken = char
 
-		} else if char == ")" {
-			if prevToken == "" || priority[prevToken] > 0 || prevToken == "(" {
-				return nil, ErrMismatchedBracket
+		} else if char == "[" {
+			if !expectOperand() {
+				return nil, ErrInvalidOperationsPlacement
 			}
+			stack = append(stack, char)
+			brackets = append(brackets, bracket{list: true})
+			prevToken = char
 
-			for len(stack) > 0 && stack[len(stack)-1] != "(" {
+		} else if char == "," {
+			if len(brackets) == 0 || (brackets[len(brackets)-1].function == "" && !brackets[len(brackets)-1].list) {
+				return nil, ErrInvalidSymbols
+			}
+			if expectOperand() {
+				return nil, ErrInvalidExpression
+			}
+			for stack[len(stack)-1] != "(" && stack[len(stack)-1] != "[" {
 				output = append(output, stack[len(stack)-1])
 				stack = stack[:len(stack)-1]
 			}
+			brackets[len(brackets)-1].argsCount++
+			prevToken = char
 
-			if len(stack) == 0 {
+		} else if char == "]" {
+			if prevToken == "[" || prevToken == "," {
+				// Пустой список или пропущенный элемент
+				return nil, ErrInvalidExpression
+			}
+			if expectOperand() {
 				return nil, ErrMismatchedBracket
 			}
 
-			stack = stack[:len(stack)-1]
+			var err error
+			output, stack, err = popUntil(output, stack, "[")
+			if err != nil {
+				return nil, err
+			}
+			b := brackets[len(brackets)-1]
+			brackets = brackets[:len(brackets)-1]
+			output = append(output, listToken(b.argsCount+1))
+			prevToken = char
+
+		} else if char == ")" {
+			if expectOperand() {
+				return nil, ErrMismatchedBracket
+			}
+
+			var err error
+			output, stack, err = popUntil(output, stack, "(")
+			if err != nil {
+				return nil, err
+			}
 			prevToken = ")"
 
+			// Закрылся вызов функции - выталкиваем ее вместе с количеством аргументов
+			b := brackets[len(brackets)-1]
+			brackets = brackets[:len(brackets)-1]
+			if b.function != "" {
+				if err := checkArgsCount(b.function, b.argsCount+1); err != nil {
+					return nil, err
+				}
+				stack = stack[:len(stack)-1]
+				output = append(output, functionToken(b.function, b.argsCount+1))
+			}
+
+		} else if char == "%" || char == "!" {
+			// Постфиксные процент и факториал относятся к операнду слева
+			if expectOperand() {
+				return nil, ErrInvalidOperationsPlacement
+			}
+			if char == "!" {
+				output = append(output, functionToken("fact", 1))
+			} else {
+				output = append(output, char)
+			}
+			prevToken = char
+
 		} else if priority[char] > 0 {
-			if prevToken == "" || priority[prevToken] > 0 || prevToken == "(" {
+			if expectOperand() {
 				return nil, ErrInvalidOperationsPlacement
 			}
 
@@ -176,46 +414,152 @@ func ToPostfix(expression string) ([]string, error) {
 		}
 	}
 
-	if prevToken == "" || priority[prevToken] > 0 {
+	// Незакрытую скобку в конце выражения отловим ниже
+	if prevToken != "(" && prevToken != "[" && expectOperand() {
 		return nil, ErrInvalidExpression
 	}
 
 	for len(stack) > 0 {
-		if stack[len(stack)-1] == "(" {
+		if stack[len(stack)-1] == "(" || stack[len(stack)-1] == "[" {
 			return nil, ErrMismatchedBracket
 		}
 		output = append(output, stack[len(stack)-1])
 		stack = stack[:len(stack)-1]
 	}
 
+	if err := checkTypes(output); err != nil {
+		return nil, err
+	}
 	return output, nil
 }
 
-// Строит бинарное дерево из постфиксной записи
-func BuildTree(postfix []string) *Tree {
+// Убирает пробелы. Разделитель разрядов локали тоже пробел (неразрывный в ru и fr),
+// поэтому между цифрами он остается: его проверит scanNumber, и 1\u00a02,5 не станет 12,5
+func stripSpaces(str string, locale Locale) []rune {
+	runes := []rune(str)
+	expression := make([]rune, 0, len(runes))
+	for i, r := range runes {
+		if unicode.IsSpace(r) {
+			betweenDigits := len(expression) > 0 && isDigit(expression[len(expression)-1]) &&
+				i+1 < len(runes) && isDigit(runes[i+1])
+			if !(r == locale.Group && locale.groupsInput() && betweenDigits) {
+				continue
+			}
+		}
+		expression = append(expression, r)
+	}
+	return expression
+}
+
+// Читает число, которое начинается с позиции start. Возвращает число в виде для strconv
+// и позицию его последнего символа.
+// Разделитель разрядов допустим только перед группой ровно из трех цифр: 1.234,5 - да, 1.5 - нет
+func scanNumber(expression []rune, start int, locale Locale) (string, int, error) {
+	var b strings.Builder
+	i := start
+	if locale.normalize(expression[i]) == "-" {
+		b.WriteString("-")
+	} else if expression[i] == locale.Decimal {
+		b.WriteString(".")
+	} else {
+		b.WriteRune(expression[i])
+	}
+	for i+1 < len(expression) {
+		next := expression[i+1]
+		if isDigit(next) {
+			b.WriteRune(next)
+		} else if next == locale.Decimal {
+			b.WriteString(".")
+		} else if locale.groupsInput() && next == locale.Group {
+			if i+4 >= len(expression) || !isDigit(expression[i+2]) || !isDigit(expression[i+3]) || !isDigit(expression[i+4]) ||
+				(i+5 < len(expression) && isDigit(expression[i+5])) {
+				return "", 0, ErrInvalidSymbols
+			}
+		} else {
+			break
+		}
+		i++
+	}
+	number := b.String()
+	if number == "-" {
+		// Минус перед скобкой или функцией
+		return "", 0, ErrInvalidOperationsPlacement
+	}
+	if !isNumber(number) {
+		return "", 0, ErrInvalidSymbols
+	}
+	return number, i, nil
+}
+
+// Строит бинарное дерево из постфиксной записи.
+// Запись, которую не выдал бы ToPostfix, дает ErrInvalidExpression
+func BuildTree(postfix []string) (*Tree, error) {
 	stack := []*TreeNode{}
 
 	for _, token := range postfix {
-		_, err := strconv.ParseFloat(token, 64)
-		if err == nil {
+		if _, ok := parseReference(token); ok || isNumber(token) {
 			stack = append(stack, &TreeNode{Val: token})
+		} else if token == "%" {
+			if len(stack) < 1 {
+				return nil, ErrInvalidExpression
+			}
+			// Пока не знаем, к чему относится процент, поэтому оставляем пометку.
+			// Процент от процента (10%%) - это уже просто деление на 100
+			stack[len(stack)-1] = &TreeNode{Val: "%", Left: resolvePercent(stack[len(stack)-1])}
+		} else if length, ok := parseListToken(token); ok {
+			if len(stack) < length {
+				return nil, ErrInvalidExpression
+			}
+			elements := make([]*TreeNode, length)
+			copy(elements, stack[len(stack)-length:])
+			stack = stack[:len(stack)-length]
+			for i := range elements {
+				elements[i] = resolvePercent(elements[i])
+			}
+			stack = append(stack, &TreeNode{Val: ListVal, Args: elements})
+		} else if name, argsCount, ok := parseFunctionToken(token); ok {
+			if len(stack) < argsCount {
+				return nil, ErrInvalidExpression
+			}
+			args := make([]*TreeNode, argsCount)
+			copy(args, stack[len(stack)-argsCount:])
+			stack = stack[:len(stack)-argsCount]
+			for i := range args {
+				args[i] = resolvePercent(args[i])
+			}
+			stack = append(stack, &TreeNode{Val: name, Args: args})
 		} else {
 			if len(stack) < 2 {
-				panic("Invalid expression: not enough operands")
+				return nil, ErrInvalidExpression
 			}
 			right := stack[len(stack)-1]
 			stack = stack[:len(stack)-1]
-			left := stack[len(stack)-1]
+			left := resolvePercent(stack[len(stack)-1])
 			stack = stack[:len(stack)-1]
 
-			node := &TreeNode{Val: token, Left: left, Right: right}
+			// Как на калькуляторе: 200 + 15% = 200 + 200*15/100
+			if right.Val == "%" && (token == "+" || token == "-") {
+				node := &TreeNode{Val: token + "%", Left: left, Right: right.Left}
+				stack = append(stack, node)
+				continue
+			}
+
+			node := &TreeNode{Val: token, Left: left, Right: resolvePercent(right)}
 			stack = append(stack, node)
 		}
 	}
 
 	if len(stack) != 1 {
-		panic("Invalid expression: leftover nodes in stack")
+		return nil, ErrInvalidExpression
 	}
 
-	return &Tree{Root: stack[0]}
+	return &Tree{Root: resolvePercent(stack[0])}, nil
+}
+
+// Процент без сложения или вычитания слева - это просто деление на 100
+func resolvePercent(node *TreeNode) *TreeNode {
+	if node.Val == "%" {
+		return &TreeNode{Val: "/", Left: node.Left, Right: &TreeNode{Val: "100"}}
+	}
+	return node
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIsSpare(t *testing.T) {
@@ -12,6 +13,22 @@ func TestIsSpare(t *testing.T) {
 
 	node = &TreeNode{Val: "*", Left: &TreeNode{Val: "*"}, Right: &TreeNode{Val: "5"}}
 	assert.False(t, node.IsSpare(), "Expected node not to be spare")
+
+	node = &TreeNode{Val: "pmt", Args: []*TreeNode{{Val: "0.1"}, {Val: "12"}, {Val: "100"}}}
+	assert.True(t, node.IsSpare(), "Expected function node to be spare")
+	assert.Equal(t, []float64{0.1, 12, 100}, node.Operands())
+
+	node = &TreeNode{Val: "npv", Args: []*TreeNode{{Val: "0.1"}, {Val: "+"}}}
+	assert.False(t, node.IsSpare(), "Expected function node not to be spare")
+
+	list := &TreeNode{Val: ListVal, Args: []*TreeNode{{Val: "1"}, {Val: "2"}}}
+	assert.False(t, list.IsSpare(), "Expected list not to be spare")
+	node = &TreeNode{Val: "sum", Args: []*TreeNode{list, {Val: "3"}}}
+	assert.True(t, node.IsSpare(), "Expected aggregate of resolved list to be spare")
+	assert.Equal(t, []float64{1, 2, 3}, node.Operands())
+
+	list.Args[1] = &TreeNode{Val: "+", Left: &TreeNode{Val: "1"}, Right: &TreeNode{Val: "1"}}
+	assert.False(t, node.IsSpare(), "Expected aggregate of unresolved list not to be spare")
 }
 
 func TestFindSpareNodes(t *testing.T) {
@@ -48,6 +65,30 @@ func TestFindParentAndNodeByTaskID(t *testing.T) {
 	if node == nil || node.TaskID != 2 || parent.TaskID != 1 {
 		t.Errorf("Parent or node lookup failed")
 	}
+
+	tree = &Tree{
+		Root: &TreeNode{
+			TaskID: 1,
+			Args:   []*TreeNode{{Val: "1"}, {TaskID: 4}},
+		},
+	}
+	parent, node = tree.FindParentAndNodeByTaskID(4)
+	if node == nil || node.TaskID != 4 || parent.TaskID != 1 {
+		t.Errorf("Parent or node lookup in function arguments failed")
+	}
+
+	// Родитель элемента списка - функция, которой передан список
+	tree = &Tree{
+		Root: &TreeNode{
+			Val:    "mean",
+			TaskID: 1,
+			Args:   []*TreeNode{{Val: ListVal, Args: []*TreeNode{{Val: "1"}, {TaskID: 5}}}},
+		},
+	}
+	parent, node = tree.FindParentAndNodeByTaskID(5)
+	if node == nil || node.TaskID != 5 || parent.TaskID != 1 {
+		t.Errorf("Parent or node lookup in list failed")
+	}
 }
 
 func TestToPostfix(t *testing.T) {
@@ -73,8 +114,102 @@ func TestToPostfix(t *testing.T) {
 
 func TestBuildTree(t *testing.T) {
 	postfix := []string{"3", "4", "+"}
-	tree := BuildTree(postfix)
+	tree, err := BuildTree(postfix)
+	require.NoError(t, err)
 	if tree.Root.Val != "+" || tree.Root.Left.Val != "3" || tree.Root.Right.Val != "4" {
 		t.Errorf("Tree building failed")
 	}
+
+	// Неверная запись - ошибка, а не паника
+	_, err = BuildTree([]string{"5", "3", "%"})
+	assert.ErrorIs(t, err, ErrInvalidExpression)
+	_, err = BuildTree([]string{"5", "+"})
+	assert.ErrorIs(t, err, ErrInvalidExpression)
+	_, err = BuildTree([]string{"%"})
+	assert.ErrorIs(t, err, ErrInvalidExpression)
+	_, err = BuildTree([]string{"5", "fact(1)", "3"})
+	assert.ErrorIs(t, err, ErrInvalidExpression)
+}
+
+func TestBuildTreeWithPercent(t *testing.T) {
+	// 200 + 15% превращается в одну операцию "+%"
+	tree := buildTree(t, "200 + 15%")
+	assert.Equal(t, "+%", tree.Root.Val)
+	assert.Equal(t, []float64{200, 15}, tree.Root.Operands())
+
+	// Без сложения процент - это деление на 100
+	tree = buildTree(t, "50 * 10%")
+	assert.Equal(t, "*", tree.Root.Val)
+	assert.Equal(t, "/", tree.Root.Right.Val)
+	assert.Equal(t, []float64{10, 100}, tree.Root.Right.Operands())
+
+	tree = buildTree(t, "15%")
+	assert.Equal(t, "/", tree.Root.Val)
+
+	// Процент от процента: внутренний сразу становится делением, и дереву есть что считать
+	tree = buildTree(t, "10%%")
+	assert.Equal(t, "/", tree.Root.Val)
+	assert.Equal(t, []*TreeNode{tree.Root.Left}, tree.FindSpareNodes())
+	assert.Equal(t, []float64{10, 100}, tree.Root.Left.Operands())
+
+	tree = buildTree(t, "200 + 10%%")
+	assert.Equal(t, "+%", tree.Root.Val)
+	assert.Equal(t, []*TreeNode{tree.Root.Right}, tree.FindSpareNodes())
+	assert.Equal(t, []float64{10, 100}, tree.Root.Right.Operands())
+}
+
+func TestBuildTreeWithFunction(t *testing.T) {
+	tree := buildTree(t, "pmt(0.01, 12, 1000)")
+	assert.Equal(t, "pmt", tree.Root.Val)
+	assert.True(t, tree.Root.IsSpare())
+	assert.Equal(t, []float64{0.01, 12, 1000}, tree.Root.Operands())
+}
+
+func TestBuildTreeWithList(t *testing.T) {
+	tree := buildTree(t, "mean([3, 5, 8])")
+	assert.Equal(t, "mean", tree.Root.Val)
+	assert.True(t, tree.Root.Args[0].IsList())
+	assert.Equal(t, []*TreeNode{tree.Root}, tree.FindSpareNodes())
+	assert.Equal(t, []float64{3, 5, 8}, tree.Root.Operands())
+}
+
+func TestCheckOperation(t *testing.T) {
+	assert.ErrorIs(t, CheckOperation("/", []float64{1, 0}), ErrZeroDivision)
+	assert.NoError(t, CheckOperation("/", []float64{1, 2}))
+	assert.ErrorIs(t, CheckOperation("pmt", []float64{0.01, 0, 1000}), ErrInvalidArgument)
+	assert.ErrorIs(t, CheckOperation("fv", []float64{-1, 12, 100}), ErrInvalidArgument)
+	assert.ErrorIs(t, CheckOperation("npv", []float64{-1, 100}), ErrInvalidArgument)
+	assert.NoError(t, CheckOperation("npv", []float64{0.1, -1000, 500, 600}))
+}
+
+func TestCheckIntegerOperation(t *testing.T) {
+	tests := []struct {
+		operation string
+		args      []float64
+		expected  string
+	}{
+		{"fact", []float64{5}, ""},
+		{"fact", []float64{-1}, "invalid function argument: fact: arguments must be non-negative integers"},
+		{"fact", []float64{2.5}, "invalid function argument: fact: arguments must be non-negative integers"},
+		{"fact", []float64{171}, "invalid function argument: fact: argument must not exceed 170"},
+		{"nCr", []float64{5, 2}, ""},
+		{"nCr", []float64{2, 5}, "invalid function argument: nCr: k must not exceed n"},
+		{"nPr", []float64{5, -2}, "invalid function argument: nPr: arguments must be non-negative integers"},
+		{"gcd", []float64{12, 18, 0}, ""},
+		{"lcm", []float64{4, 1.5}, "invalid function argument: lcm: arguments must be non-negative integers"},
+		{"isprime", []float64{1e300}, "invalid function argument: isprime: argument is too large"},
+		{"gcd", []float64{12}, "invalid function argument: gcd: at least two values are required"},
+		{"stddev", []float64{1}, "invalid function argument: stddev: at least two values are required"},
+		{"median", []float64{1}, ""},
+	}
+
+	for _, tt := range tests {
+		err := CheckOperation(tt.operation, tt.args)
+		if tt.expected == "" {
+			assert.NoError(t, err, tt.operation)
+		} else {
+			assert.ErrorIs(t, err, ErrInvalidArgument)
+			assert.EqualError(t, err, tt.expected)
+		}
+	}
 }
@@ -8,8 +8,17 @@ var (
 	ErrInvalidOperationsPlacement = errors.New("invalid operations placement")
 	ErrZeroDivision               = errors.New("division by zero")
 	ErrInvalidExpression          = errors.New("invalid expression")
+	ErrInvalidArgumentsCount      = errors.New("invalid number of function arguments")
+	ErrInvalidArgument            = errors.New("invalid function argument")
+	ErrInvalidOperandType         = errors.New("list is not allowed here")
+	ErrInvalidShape               = errors.New("incompatible list or matrix dimensions")
+	ErrUnknownLocale              = errors.New("unknown locale")
 	ErrCalculation                = errors.Join(
 		ErrInvalidExpression,
+		ErrInvalidArgumentsCount,
+		ErrInvalidArgument,
+		ErrInvalidOperandType,
+		ErrInvalidShape,
 		ErrInvalidOperationsPlacement,
 		ErrInvalidSymbols,
 		ErrMismatchedBracket,
@@ -0,0 +1,221 @@
+package calculation
+
+// Здесь описаны функции, которые можно вызывать внутри выражения, например pmt(0.01, 12, 1000).
+// Считает их агент, а оркестратор только проверяет количество и допустимость аргументов
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type function struct {
+	minArgs int
+	maxArgs int  // -1 значит, что аргументов может быть сколько угодно
+	lists   bool // аргументами могут быть списки, агенту они придут одним рядом чисел
+	check   func(args []float64) error
+	// Для функций над векторами и матрицами: проверка размеров аргументов и вид результата
+	signature func(args []value) (value, error)
+	// Функцию выполняет сам оркестратор, перестраивая дерево (см. Tree.Expand)
+	structural bool
+}
+
+var functions = map[string]function{
+	// pmt(rate, n, pv) - платеж по аннуитетному кредиту
+	"pmt": {minArgs: 3, maxArgs: 3, check: checkPeriodicRate},
+	// fv(rate, n, pmt[, pv]) - будущая стоимость регулярных взносов
+	"fv": {minArgs: 3, maxArgs: 4, check: checkPeriodicRate},
+	// npv(rate, cf1, ..., cfn) - чистая приведенная стоимость денежных потоков
+	"npv": {minArgs: 2, maxArgs: -1, check: checkDiscountRate},
+
+	// fact(n) - факториал, в выражении его можно записать как n!
+	"fact": {minArgs: 1, maxArgs: 1, check: checkFactorial},
+	// nCr(n, k) - число сочетаний, nPr(n, k) - число размещений
+	"nCr": {minArgs: 2, maxArgs: 2, check: checkCombinatorics},
+	"nPr": {minArgs: 2, maxArgs: 2, check: checkCombinatorics},
+	// gcd(a, b, ...) и lcm(a, b, ...) - НОД и НОК
+	"gcd": {minArgs: 1, maxArgs: -1, lists: true, check: checkIntegerList},
+	"lcm": {minArgs: 1, maxArgs: -1, lists: true, check: checkIntegerList},
+	// isprime(n) - 1, если n простое, иначе 0
+	"isprime": {minArgs: 1, maxArgs: 1, check: checkNonNegativeIntegers},
+
+	// Агрегаты над списком или несколькими числами: sum([1, 2, 3]), mean(1, 2, [3, 4])
+	"sum":    {minArgs: 1, maxArgs: -1, lists: true},
+	"mean":   {minArgs: 1, maxArgs: -1, lists: true},
+	"median": {minArgs: 1, maxArgs: -1, lists: true},
+	// stddev - выборочное стандартное отклонение, для него нужно хотя бы два числа
+	"stddev": {minArgs: 1, maxArgs: -1, lists: true, check: checkSample},
+
+	// dot(a, b) - скалярное произведение векторов одной длины
+	"dot": {minArgs: 2, maxArgs: 2, signature: dotSignature},
+	// det(A) - определитель квадратной матрицы
+	"det": {minArgs: 1, maxArgs: 1, signature: detSignature},
+	// matmul(A, B) - произведение матриц, каждая ячейка результата считается отдельной задачей dot
+	"matmul": {minArgs: 2, maxArgs: 2, signature: matmulSignature, structural: true},
+	// transpose(A) - транспонирование, агенту тут считать нечего
+	"transpose": {minArgs: 1, maxArgs: 1, signature: transposeSignature, structural: true},
+}
+
+// Самое большое целое, которое float64 хранит без потерь
+const maxExactInteger = 1 << 53
+
+// Больший факториал не помещается в float64
+const maxFactorialArg = 170
+
+func IsFunction(name string) bool {
+	_, ok := functions[name]
+	return ok
+}
+
+// Функции, которые выполняет оркестратор, задачами не становятся
+func isStructural(name string) bool {
+	return functions[name].structural
+}
+
+// Токен функции в постфиксной записи хранит число аргументов: pmt(3)
+func functionToken(name string, argsCount int) string {
+	return name + "(" + strconv.Itoa(argsCount) + ")"
+}
+
+func parseFunctionToken(token string) (string, int, bool) {
+	name, rest, found := strings.Cut(token, "(")
+	if !found || !IsFunction(name) {
+		return "", 0, false
+	}
+	argsCount, err := strconv.Atoi(strings.TrimSuffix(rest, ")"))
+	if err != nil {
+		return "", 0, false
+	}
+	return name, argsCount, true
+}
+
+func checkArgsCount(name string, argsCount int) error {
+	f := functions[name]
+	if argsCount < f.minArgs || (f.maxArgs != -1 && argsCount > f.maxArgs) {
+		return ErrInvalidArgumentsCount
+	}
+	return nil
+}
+
+// Проверка аргументов операции перед тем, как отдать ее агенту.
+// Ошибка отсюда закрывает выражение
+func CheckOperation(operation string, args []float64) error {
+	if operation == "/" && args[1] == 0 {
+		return ErrZeroDivision
+	}
+	f, ok := functions[operation]
+	if !ok || f.check == nil {
+		return nil
+	}
+	if err := f.check(args); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidArgument, operation, err)
+	}
+	return nil
+}
+
+// pmt и fv: ставка больше -100% и положительное число периодов
+func checkPeriodicRate(args []float64) error {
+	if args[0] <= -1 {
+		return errors.New("rate must be greater than -1")
+	}
+	if args[1] <= 0 {
+		return errors.New("number of periods must be positive")
+	}
+	return nil
+}
+
+// npv: при ставке -100% дисконтирующий множитель делит на ноль
+func checkDiscountRate(args []float64) error {
+	if args[0] <= -1 {
+		return errors.New("rate must be greater than -1")
+	}
+	return nil
+}
+
+// Целочисленные функции принимают только неотрицательные целые числа
+func checkNonNegativeIntegers(args []float64) error {
+	for _, arg := range args {
+		if arg < 0 || arg != math.Trunc(arg) {
+			return errors.New("arguments must be non-negative integers")
+		}
+		if arg > maxExactInteger {
+			return errors.New("argument is too large")
+		}
+	}
+	return nil
+}
+
+func checkFactorial(args []float64) error {
+	if err := checkNonNegativeIntegers(args); err != nil {
+		return err
+	}
+	if args[0] > maxFactorialArg {
+		return fmt.Errorf("argument must not exceed %d", maxFactorialArg)
+	}
+	return nil
+}
+
+// gcd и lcm считаются хотя бы для двух чисел
+func checkIntegerList(args []float64) error {
+	if len(args) < 2 {
+		return errors.New("at least two values are required")
+	}
+	return checkNonNegativeIntegers(args)
+}
+
+func checkSample(args []float64) error {
+	if len(args) < 2 {
+		return errors.New("at least two values are required")
+	}
+	return nil
+}
+
+// nCr и nPr: выбрать больше k элементов, чем есть, нельзя
+func checkCombinatorics(args []float64) error {
+	if err := checkNonNegativeIntegers(args); err != nil {
+		return err
+	}
+	if args[1] > args[0] {
+		return errors.New("k must not exceed n")
+	}
+	return nil
+}
+
+func dotSignature(args []value) (value, error) {
+	if args[0].kind != vectorValue || args[1].kind != vectorValue {
+		return value{}, ErrInvalidOperandType
+	}
+	if args[0].cols != args[1].cols {
+		return value{}, ErrInvalidShape
+	}
+	return value{kind: scalarValue}, nil
+}
+
+func detSignature(args []value) (value, error) {
+	if args[0].kind != matrixValue {
+		return value{}, ErrInvalidOperandType
+	}
+	if args[0].rows != args[0].cols {
+		return value{}, ErrInvalidShape
+	}
+	return value{kind: scalarValue}, nil
+}
+
+func matmulSignature(args []value) (value, error) {
+	if args[0].kind != matrixValue || args[1].kind != matrixValue {
+		return value{}, ErrInvalidOperandType
+	}
+	if args[0].cols != args[1].rows {
+		return value{}, ErrInvalidShape
+	}
+	return matrix(args[0].rows, args[1].cols), nil
+}
+
+func transposeSignature(args []value) (value, error) {
+	if args[0].kind != matrixValue {
+		return value{}, ErrInvalidOperandType
+	}
+	return matrix(args[0].cols, args[0].rows), nil
+}
@@ -0,0 +1,76 @@
+package calculation
+
+// Форматы чисел. От локали зависят десятичный разделитель и разделитель разрядов.
+// Там, где запятая - десятичный разделитель, аргументы функций и элементы списков,
+// как в таблицах, разделяются точкой с запятой: mean([1,5; 2,5])
+
+import (
+	"strconv"
+	"strings"
+)
+
+type Locale struct {
+	Decimal rune // десятичный разделитель
+	Group   rune // разделитель разрядов
+	ArgSep  rune // разделитель аргументов и элементов списка
+}
+
+const DefaultLocale = "en"
+
+var locales = map[string]Locale{
+	"en": {Decimal: '.', Group: ',', ArgSep: ','},
+	"de": {Decimal: ',', Group: '.', ArgSep: ';'},
+	"ru": {Decimal: ',', Group: '\u00a0', ArgSep: ';'},
+	"fr": {Decimal: ',', Group: '\u202f', ArgSep: ';'},
+}
+
+func LookupLocale(name string) (Locale, bool) {
+	l, ok := locales[name]
+	return l, ok
+}
+
+// Разделитель разрядов во вводе понимаем, только если его нельзя спутать с разделителем аргументов.
+// В en запятая разделяет аргументы, поэтому 1,234 там не число
+func (l Locale) groupsInput() bool {
+	return l.Group != l.ArgSep
+}
+
+// Число в формате локали: 1234.5 -> 1.234,5 для de
+func (l Locale) FormatNumber(v float64) string {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	intPart, fracPart, hasFrac := strings.Cut(s, ".")
+
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, digit := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteRune(l.Group)
+		}
+		b.WriteRune(digit)
+	}
+	if hasFrac {
+		b.WriteRune(l.Decimal)
+		b.WriteString(fracPart)
+	}
+	return b.String()
+}
+
+// Значение в формате локали: число становится строкой, у векторов и матриц форматируется каждый элемент
+func (l Locale) FormatValue(value any) any {
+	switch v := value.(type) {
+	case float64:
+		return l.FormatNumber(v)
+	case []any:
+		formatted := make([]any, len(v))
+		for i, element := range v {
+			formatted[i] = l.FormatValue(element)
+		}
+		return formatted
+	default:
+		return value
+	}
+}
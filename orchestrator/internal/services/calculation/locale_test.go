@@ -0,0 +1,81 @@
+package calculation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToPostfixUnicodeOperators(t *testing.T) {
+	postfix, err := ToPostfix("3 × 4 − 2 ÷ 5")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3", "4", "*", "2", "5", "/", "-"}, postfix)
+
+	postfix, err = ToPostfix("2·(−1)")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "-1", "*"}, postfix)
+
+	_, err = ToPostfix("2 ≠ 3")
+	assert.ErrorIs(t, err, ErrInvalidSymbols)
+}
+
+func TestToPostfixLocale(t *testing.T) {
+	de := locales["de"]
+	cases := []struct {
+		name     string
+		locale   Locale
+		expr     string
+		expected []string
+	}{
+		{"de decimal and group", de, "1.234,5 + 0,5", []string{"1234.5", "0.5", "+"}},
+		{"de arguments", de, "mean([1,5; 2,5])", []string{"1.5", "2.5", "[2]", "mean(1)"}},
+		{"ru group", locales["ru"], "1\u00a0000,25 × 2", []string{"1000.25", "2", "*"}},
+		{"fr group", locales["fr"], "1\u202f000 − 1", []string{"1000", "1", "-"}},
+		{"en arguments", locales["en"], "nCr(5, 2)", []string{"5", "2", "nCr(2)"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			postfix, err := ToPostfixLocale(tc.expr, tc.locale)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, postfix)
+		})
+	}
+
+	// Точка в de - разделитель разрядов, за ним должно идти ровно три цифры
+	_, err := ToPostfixLocale("1.5", de)
+	assert.ErrorIs(t, err, ErrInvalidSymbols)
+	_, err = ToPostfixLocale("1.2345", de)
+	assert.ErrorIs(t, err, ErrInvalidSymbols)
+	_, err = ToPostfix("1.2.3")
+	assert.ErrorIs(t, err, ErrInvalidSymbols)
+
+	// Неразрывный пробел в ru и fr - тоже разделитель разрядов, а не просто пробел
+	for _, name := range []string{"ru", "fr"} {
+		group := string(locales[name].Group)
+		_, err = ToPostfixLocale("1"+group+"2,5", locales[name])
+		assert.ErrorIs(t, err, ErrInvalidSymbols, name)
+		_, err = ToPostfixLocale("1"+group+"0000", locales[name])
+		assert.ErrorIs(t, err, ErrInvalidSymbols, name)
+		// Между операцией и числом это обычный пробел
+		postfix, err := ToPostfixLocale("1"+group+"000"+group+"+"+group+"2", locales[name])
+		assert.NoError(t, err, name)
+		assert.Equal(t, []string{"1000", "2", "+"}, postfix, name)
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	assert.Equal(t, "1,234,567.5", locales["en"].FormatNumber(1234567.5))
+	assert.Equal(t, "1.234.567,5", locales["de"].FormatNumber(1234567.5))
+	assert.Equal(t, "-1\u00a0000", locales["ru"].FormatNumber(-1000))
+	assert.Equal(t, "999", locales["de"].FormatNumber(999))
+	assert.Equal(t, "0,25", locales["fr"].FormatNumber(0.25))
+}
+
+func TestFormatValue(t *testing.T) {
+	de := locales["de"]
+	assert.Equal(t, "1.000,5", de.FormatValue(1000.5))
+	assert.Equal(t,
+		[]any{[]any{"1,5", "2"}, []any{"3.000", "4"}},
+		de.FormatValue([]any{[]any{1.5, 2.0}, []any{3000.0, 4.0}}),
+	)
+}
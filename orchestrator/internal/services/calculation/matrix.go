@@ -0,0 +1,75 @@
+package calculation
+
+// Матричные операции, которые оркестратор выполняет сам, перестраивая дерево
+
+// Раскрывает в дереве transpose и matmul.
+// transpose просто переставляет элементы матрицы, поэтому раскрывается сразу.
+// matmul ждет, пока обе матрицы будут посчитаны, и превращается в матрицу из dot(строка, столбец),
+// так что каждая ячейка произведения уходит отдельной задачей и считается параллельно
+func (t *Tree) Expand() {
+	t.Root = expand(t.Root)
+}
+
+func expand(node *TreeNode) *TreeNode {
+	if node.Left != nil {
+		node.Left = expand(node.Left)
+	}
+	if node.Right != nil {
+		node.Right = expand(node.Right)
+	}
+	for i, arg := range node.Args {
+		node.Args[i] = expand(arg)
+	}
+
+	switch node.Val {
+	case "transpose":
+		if node.Args[0].IsList() {
+			return transpose(node.Args[0])
+		}
+	case "matmul":
+		a, b := node.Args[0], node.Args[1]
+		if a.IsList() && b.IsList() && a.IsResolved() && b.IsResolved() {
+			return multiply(a, b)
+		}
+	}
+	return node
+}
+
+func listNode(elements []*TreeNode) *TreeNode {
+	return &TreeNode{Val: ListVal, Args: elements}
+}
+
+func transpose(m *TreeNode) *TreeNode {
+	rows := make([]*TreeNode, len(m.Args[0].Args))
+	for j := range rows {
+		column := make([]*TreeNode, len(m.Args))
+		for i, row := range m.Args {
+			column[i] = row.Args[j]
+		}
+		rows[j] = listNode(column)
+	}
+	return listNode(rows)
+}
+
+// Ячейка (i, j) произведения - это dot(i-я строка a, j-й столбец b).
+// Матрицы уже посчитаны, поэтому числа просто копируются в новые вершины
+func multiply(a, b *TreeNode) *TreeNode {
+	columns := transpose(b)
+	rows := make([]*TreeNode, len(a.Args))
+	for i, row := range a.Args {
+		cells := make([]*TreeNode, len(columns.Args))
+		for j, column := range columns.Args {
+			cells[j] = &TreeNode{Val: "dot", Args: []*TreeNode{copyList(row), copyList(column)}}
+		}
+		rows[i] = listNode(cells)
+	}
+	return listNode(rows)
+}
+
+func copyList(list *TreeNode) *TreeNode {
+	elements := make([]*TreeNode, len(list.Args))
+	for i, e := range list.Args {
+		elements[i] = &TreeNode{Val: e.Val}
+	}
+	return listNode(elements)
+}
@@ -0,0 +1,53 @@
+package calculation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildTree(t *testing.T, expression string) *Tree {
+	postfix, err := ToPostfix(expression)
+	require.NoError(t, err)
+	tree, err := BuildTree(postfix)
+	require.NoError(t, err)
+	return tree
+}
+
+func TestExpandTranspose(t *testing.T) {
+	tree := buildTree(t, "transpose([[1, 2, 3], [4, 5, 6]])")
+	tree.Expand()
+	assert.True(t, tree.Root.IsResolved())
+	assert.Equal(t, []any{[]any{1.0, 4.0}, []any{2.0, 5.0}, []any{3.0, 6.0}}, tree.Root.Value())
+}
+
+func TestExpandMatmul(t *testing.T) {
+	tree := buildTree(t, "matmul([[1, 2], [3, 4]], [[5, 6], [7, 8]])")
+	tree.Expand()
+
+	// Каждая ячейка произведения - отдельная задача dot
+	spareNodes := tree.FindSpareNodes()
+	require.Len(t, spareNodes, 4)
+	assert.Equal(t, "dot", spareNodes[0].Val)
+	assert.Equal(t, []float64{1, 2, 5, 7}, spareNodes[0].Operands())
+	assert.Equal(t, []float64{3, 4, 6, 8}, spareNodes[3].Operands())
+	assert.False(t, tree.Root.IsResolved())
+}
+
+func TestExpandMatmulWaitsForOperands(t *testing.T) {
+	tree := buildTree(t, "matmul([[1 + 1]], [[2]])")
+	tree.Expand()
+	assert.Equal(t, "matmul", tree.Root.Val)
+
+	// Пока матрица не посчитана, задачу дает только 1 + 1, а не сам matmul
+	spareNodes := tree.FindSpareNodes()
+	require.Len(t, spareNodes, 1)
+	assert.Equal(t, "+", spareNodes[0].Val)
+
+	tree.ReplaceNodeWithValue(spareNodes[0], 2)
+	tree.Expand()
+	spareNodes = tree.FindSpareNodes()
+	require.Len(t, spareNodes, 1)
+	assert.Equal(t, "dot", spareNodes[0].Val)
+}
@@ -0,0 +1,76 @@
+package calculation
+
+// Оценка оставшейся работы по дереву: сколько задач еще будет и сколько ждать при полном параллелизме
+
+import "time"
+
+// Сколько задач агентам еще предстоит решить. Посчитанные вершины уже заменены числами и не учитываются.
+// matmul сам задачей не является, но раскроется в dot по одной на ячейку произведения
+func (t *Tree) CountTasks() int {
+	if t.Root == nil {
+		return 0
+	}
+	return countTasks(t.Root)
+}
+
+func countTasks(node *TreeNode) int {
+	count := 0
+	for _, child := range node.children() {
+		count += countTasks(child)
+	}
+	switch {
+	case node.Val == "matmul":
+		rows, _ := shape(node.Args[0])
+		_, cols := shape(node.Args[1])
+		count += rows * cols
+	case node.IsList() || isStructural(node.Val) || len(node.children()) == 0:
+	default:
+		count++
+	}
+	return count
+}
+
+// Размер значения вершины: строки и столбцы матрицы, у вектора столбцов 0, у числа оба 0
+func shape(node *TreeNode) (int, int) {
+	switch node.Val {
+	case ListVal:
+		if len(node.Args) == 0 {
+			return 0, 0
+		}
+		cols, _ := shape(node.Args[0])
+		return len(node.Args), cols
+	case "transpose":
+		rows, cols := shape(node.Args[0])
+		return cols, rows
+	case "matmul":
+		rows, _ := shape(node.Args[0])
+		_, cols := shape(node.Args[1])
+		return rows, cols
+	}
+	return 0, 0
+}
+
+// Критический путь: самая долгая цепочка задач, которые нельзя считать параллельно.
+// Столько займет остаток выражения, если свободных агентов хватает. cost - время задачи вершины
+func (t *Tree) CriticalPath(cost func(node *TreeNode) time.Duration) time.Duration {
+	if t.Root == nil {
+		return 0
+	}
+	return criticalPath(t.Root, cost)
+}
+
+func criticalPath(node *TreeNode, cost func(node *TreeNode) time.Duration) time.Duration {
+	var longest time.Duration
+	for _, child := range node.children() {
+		longest = max(longest, criticalPath(child, cost))
+	}
+	switch {
+	case node.Val == "matmul":
+		// Все ячейки произведения считаются параллельно, так что это одна задача dot
+		longest += cost(&TreeNode{Val: "dot"})
+	case node.IsList() || isStructural(node.Val) || len(node.children()) == 0:
+	default:
+		longest += cost(node)
+	}
+	return longest
+}
@@ -0,0 +1,52 @@
+package calculation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountTasks(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       int
+	}{
+		{"2", 0},
+		{"2 + 2 * 2", 2},
+		{"sum([1 + 1, 2, 3]) - 1", 3},
+		{"200 + 15%", 1},
+		{"transpose([[1, 2], [3, 4]])", 0},
+		// 2x3 на 3x2 дает четыре dot и еще сложение внутри матрицы
+		{"matmul([[1, 2, 3], [4, 5, 6]], [[1, 2], [3, 4], [5 + 1, 6]])", 5},
+		{"matmul(transpose([[1, 2, 3]]), [[1, 2]])", 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			tree := buildTree(t, tt.expression)
+			assert.Equal(t, tt.want, tree.CountTasks())
+			// Раскрытие дерева не меняет число будущих задач
+			tree.Expand()
+			assert.Equal(t, tt.want, tree.CountTasks())
+		})
+	}
+}
+
+func TestCriticalPath(t *testing.T) {
+	cost := func(node *TreeNode) time.Duration {
+		if node.Val == "*" {
+			return 3 * time.Second
+		}
+		return time.Second
+	}
+
+	// (1 + 2) * (3 + 4) - 5: сложения идут параллельно, потом умножение и вычитание
+	tree := buildTree(t, "(1 + 2) * (3 + 4) - 5")
+	assert.Equal(t, 5*time.Second, tree.CriticalPath(cost))
+
+	// Ячейки произведения считаются одновременно, так что после сложения это одна задача dot
+	tree = buildTree(t, "matmul([[1 + 1, 2]], [[3], [4]])")
+	assert.Equal(t, 2*time.Second, tree.CriticalPath(cost))
+
+	assert.Equal(t, time.Duration(0), buildTree(t, "42").CriticalPath(cost))
+}
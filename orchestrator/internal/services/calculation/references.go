@@ -0,0 +1,79 @@
+package calculation
+
+// Ссылки на результаты других выражений: $42 - результат выражения 42.
+// В дереве ссылка - это лист, который не считается решенным, пока вместо него не подставят число.
+// Поэтому вершина над ссылкой не становится свободной и задачу для нее не создают
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const referencePrefix = "$"
+
+func referenceToken(id int) string {
+	return referencePrefix + strconv.Itoa(id)
+}
+
+func parseReference(token string) (int, bool) {
+	digits, found := strings.CutPrefix(token, referencePrefix)
+	if !found || digits == "" {
+		return 0, false
+	}
+	for _, r := range digits {
+		if !isDigit(r) {
+			return 0, false
+		}
+	}
+	id, err := strconv.Atoi(digits)
+	return id, err == nil && id > 0
+}
+
+// Ссылка в выражении начинается с позиции i. Возвращает токен и индекс его последнего символа
+func scanReference(expression []rune, i int) (string, int, error) {
+	end := i
+	for end+1 < len(expression) && isDigit(expression[end+1]) {
+		end++
+	}
+	token := string(expression[i : end+1])
+	if _, ok := parseReference(token); !ok {
+		return "", 0, ErrInvalidSymbols
+	}
+	return token, end, nil
+}
+
+// ID выражений, на которые ссылается дерево, по возрастанию и без повторов
+func (t *Tree) References() []int {
+	ids := []int{}
+	if t.Root == nil {
+		return ids
+	}
+	t.Root.walk(func(node *TreeNode) {
+		if id, ok := parseReference(node.Val); ok && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	})
+	slices.Sort(ids)
+	return ids
+}
+
+// Подставляет результат выражения id вместо всех ссылок на него
+func (t *Tree) ResolveReference(id int, val float64) {
+	if t.Root == nil {
+		return
+	}
+	token := referenceToken(id)
+	t.Root.walk(func(node *TreeNode) {
+		if node.Val == token {
+			t.ReplaceNodeWithValue(node, val)
+		}
+	})
+}
+
+func (node *TreeNode) walk(fn func(node *TreeNode)) {
+	fn(node)
+	for _, child := range node.children() {
+		child.walk(fn)
+	}
+}
@@ -0,0 +1,49 @@
+package calculation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToPostfixReferences(t *testing.T) {
+	postfix, err := ToPostfix("$42 * 1.2 + $43")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$42", "1.2", "*", "$43", "+"}, postfix)
+
+	postfix, err = ToPostfix("sum($1, $2) + 200 + 15%")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$1", "$2", "sum(2)", "200", "+", "15", "%", "+"}, postfix)
+
+	for expression, want := range map[string]error{
+		"$":       ErrInvalidSymbols,
+		"$0 + 1":  ErrInvalidSymbols,
+		"$x":      ErrInvalidSymbols,
+		"2 $1":    ErrInvalidOperationsPlacement,
+		"$1 $2":   ErrInvalidOperationsPlacement,
+		"det($1)": ErrInvalidOperandType,
+	} {
+		_, err := ToPostfix(expression)
+		assert.ErrorIs(t, err, want, expression)
+	}
+}
+
+func TestTreeReferences(t *testing.T) {
+	tree := buildTree(t, "($7 + 1) * $3 - $7")
+	assert.Equal(t, []int{3, 7}, tree.References())
+	assert.Equal(t, 3, tree.CountTasks())
+	// Пока ссылки не подставлены, задачи есть только у вершин без ссылок
+	assert.Empty(t, tree.FindSpareNodes())
+
+	tree.ResolveReference(7, 2)
+	assert.Equal(t, []int{3}, tree.References())
+	spare := tree.FindSpareNodes()
+	require.Len(t, spare, 1)
+	assert.Equal(t, "+", spare[0].Val)
+	assert.Equal(t, []float64{2, 1}, spare[0].Operands())
+
+	tree.ResolveReference(3, 4)
+	assert.Empty(t, tree.References())
+	assert.Empty(t, (&Tree{}).References())
+}
@@ -46,6 +46,91 @@ var (
 			Expression:      "-2*(-4+2)",
 			Expected_answer: []string{"-2", "-4", "2", "+", "*"},
 		},
+		{
+			Name:            "Valid expression with percent",
+			Expression:      "200 + 15%",
+			Expected_answer: []string{"200", "15", "%", "+"},
+		},
+		{
+			Name:            "Valid expression with percent of bracket",
+			Expression:      "(100+100)*10%",
+			Expected_answer: []string{"100", "100", "+", "10", "%", "*"},
+		},
+		{
+			Name:            "Valid percent of percent",
+			Expression:      "200 + 10%%",
+			Expected_answer: []string{"200", "10", "%", "%", "+"},
+		},
+		{
+			Name:            "Valid function call",
+			Expression:      "pmt(0.01, 12, 1000)",
+			Expected_answer: []string{"0.01", "12", "1000", "pmt(3)"},
+		},
+		{
+			Name:            "Valid function call with expressions in arguments",
+			Expression:      "2*fv(6%/12, 2*12, -100)",
+			Expected_answer: []string{"2", "6", "%", "12", "/", "2", "12", "*", "-100", "fv(3)", "*"},
+		},
+		{
+			Name:            "Valid variadic function call",
+			Expression:      "npv(0.1, -1000, 300, 400, 500)",
+			Expected_answer: []string{"0.1", "-1000", "300", "400", "500", "npv(5)"},
+		},
+		{
+			Name:            "Valid factorial",
+			Expression:      "2*5!",
+			Expected_answer: []string{"2", "5", "fact(1)", "*"},
+		},
+		{
+			Name:            "Valid factorial of bracket",
+			Expression:      "(1+2)!",
+			Expected_answer: []string{"1", "2", "+", "fact(1)"},
+		},
+		{
+			Name:            "Valid double factorial",
+			Expression:      "3!!",
+			Expected_answer: []string{"3", "fact(1)", "fact(1)"},
+		},
+		{
+			Name:            "Valid combinatorics",
+			Expression:      "nCr(5, 2) + nPr(5, 2)",
+			Expected_answer: []string{"5", "2", "nCr(2)", "5", "2", "nPr(2)", "+"},
+		},
+		{
+			Name:            "Valid number theory",
+			Expression:      "gcd(12, 18, 24) * isprime(lcm(2, 3) + 1)",
+			Expected_answer: []string{"12", "18", "24", "gcd(3)", "2", "3", "lcm(2)", "1", "+", "isprime(1)", "*"},
+		},
+		{
+			Name:            "Valid aggregate of list",
+			Expression:      "mean([3, 5, 8, 13])",
+			Expected_answer: []string{"3", "5", "8", "13", "[4]", "mean(1)"},
+		},
+		{
+			Name:            "Valid aggregate of list with expressions and numbers",
+			Expression:      "1 + sum([1+2, 3*4], -5)",
+			Expected_answer: []string{"1", "1", "2", "+", "3", "4", "*", "[2]", "-5", "sum(2)", "+"},
+		},
+		{
+			Name:            "Valid vector",
+			Expression:      "[1, 2]",
+			Expected_answer: []string{"1", "2", "[2]"},
+		},
+		{
+			Name:            "Valid matrix",
+			Expression:      "[[1, 2], [3, 4]]",
+			Expected_answer: []string{"1", "2", "[2]", "3", "4", "[2]", "[2]"},
+		},
+		{
+			Name:            "Valid dot product",
+			Expression:      "dot([1, 2, 3], [4, 5, 6])",
+			Expected_answer: []string{"1", "2", "3", "[3]", "4", "5", "6", "[3]", "dot(2)"},
+		},
+		{
+			Name:            "Valid matrix functions",
+			Expression:      "det(matmul([[1, 2]], transpose([[3, 4]])))",
+			Expected_answer: []string{"1", "2", "[2]", "[1]", "3", "4", "[2]", "[1]", "transpose(1)", "matmul(2)", "det(1)"},
+		},
 	}
 	InvalidTestSet = []struct {
 		Name           string
@@ -122,6 +207,166 @@ var (
 			Expression:     "2*(*2+2)",
 			Expected_error: ErrInvalidOperationsPlacement,
 		},
+		{
+			Name:           "Invalid symbols 5",
+			Expression:     "foo(1, 2)",
+			Expected_error: ErrInvalidSymbols,
+		},
+		{
+			Name:           "Invalid symbols 6",
+			Expression:     "pmt",
+			Expected_error: ErrInvalidSymbols,
+		},
+		{
+			Name:           "Invalid symbols 7",
+			Expression:     "(1, 2)",
+			Expected_error: ErrInvalidSymbols,
+		},
+		{
+			Name:           "Invalid operations placement 4",
+			Expression:     "%5",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid operations placement 5",
+			Expression:     "2npv(1, 2)",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid operations placement 6",
+			Expression:     "!5",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid operations placement 7",
+			Expression:     "2+!",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid arguments count 3",
+			Expression:     "nCr(5)",
+			Expected_error: ErrInvalidArgumentsCount,
+		},
+		{
+			Name:           "Invalid arguments count 4",
+			Expression:     "isprime(7, 11)",
+			Expected_error: ErrInvalidArgumentsCount,
+		},
+		{
+			Name:           "Invalid operations placement 8",
+			Expression:     "2[1]",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid operations placement 9",
+			Expression:     "5%3",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid operations placement 10",
+			Expression:     "10%(2)",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid operations placement 11",
+			Expression:     "10%$1",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid operations placement 12",
+			Expression:     "(1+2)3",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid operations placement 13",
+			Expression:     "5!3",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid operations placement 14",
+			Expression:     "5!(2)",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid operations placement 15",
+			Expression:     "3!nCr(5, 2)",
+			Expected_error: ErrInvalidOperationsPlacement,
+		},
+		{
+			Name:           "Invalid operand type 1",
+			Expression:     "[1, 2] + 1",
+			Expected_error: ErrInvalidOperandType,
+		},
+		{
+			Name:           "Invalid operand type 2",
+			Expression:     "[[1], 2]",
+			Expected_error: ErrInvalidOperandType,
+		},
+		{
+			Name:           "Invalid operand type 3",
+			Expression:     "pmt([0.1], 12, 1000)",
+			Expected_error: ErrInvalidOperandType,
+		},
+		{
+			Name:           "Invalid operand type 4",
+			Expression:     "det([1, 2])",
+			Expected_error: ErrInvalidOperandType,
+		},
+		{
+			Name:           "Invalid operand type 5",
+			Expression:     "transpose([[1, 2]]) * 2",
+			Expected_error: ErrInvalidOperandType,
+		},
+		{
+			Name:           "Invalid shape 1",
+			Expression:     "dot([1, 2], [1])",
+			Expected_error: ErrInvalidShape,
+		},
+		{
+			Name:           "Invalid shape 2",
+			Expression:     "[[1, 2], [3]]",
+			Expected_error: ErrInvalidShape,
+		},
+		{
+			Name:           "Invalid shape 3",
+			Expression:     "det([[1, 2]])",
+			Expected_error: ErrInvalidShape,
+		},
+		{
+			Name:           "Invalid shape 4",
+			Expression:     "matmul([[1, 2]], [[1, 2]])",
+			Expected_error: ErrInvalidShape,
+		},
+		{
+			Name:           "Invalid list 1",
+			Expression:     "mean([])",
+			Expected_error: ErrInvalidExpression,
+		},
+		{
+			Name:           "Invalid list 2",
+			Expression:     "mean([1, 2)",
+			Expected_error: ErrMismatchedBracket,
+		},
+		{
+			Name:           "Invalid list 3",
+			Expression:     "mean((1, 2])",
+			Expected_error: ErrInvalidSymbols,
+		},
+		{
+			Name:           "Invalid arguments count 1",
+			Expression:     "pmt(0.01, 12)",
+			Expected_error: ErrInvalidArgumentsCount,
+		},
+		{
+			Name:           "Invalid arguments count 2",
+			Expression:     "fv(0.01, 12, 100, 1, 2)",
+			Expected_error: ErrInvalidArgumentsCount,
+		},
+		{
+			Name:           "Invalid expression 5",
+			Expression:     "npv(0.1,,2)",
+			Expected_error: ErrInvalidExpression,
+		},
 		{
 			Name:           "Invalid expression 1",
 			Expression:     "2-2-",
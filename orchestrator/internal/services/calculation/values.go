@@ -0,0 +1,101 @@
+package calculation
+
+// Проверка видов значений: число, вектор или матрица.
+// Все списки в выражении записаны явно, поэтому размеры известны еще до вычисления
+
+const (
+	scalarValue = iota
+	vectorValue
+	matrixValue
+)
+
+type value struct {
+	kind int
+	rows int // у вектора и числа 0
+	cols int // длина вектора или число столбцов матрицы
+}
+
+func vector(length int) value {
+	return value{kind: vectorValue, cols: length}
+}
+
+func matrix(rows, cols int) value {
+	return value{kind: matrixValue, rows: rows, cols: cols}
+}
+
+// Список из чисел - вектор, список из векторов одной длины - матрица
+func listOf(elements []value) (value, error) {
+	switch elements[0].kind {
+	case scalarValue:
+		for _, e := range elements {
+			if e.kind != scalarValue {
+				return value{}, ErrInvalidOperandType
+			}
+		}
+		return vector(len(elements)), nil
+	case vectorValue:
+		for _, e := range elements {
+			if e.kind != vectorValue {
+				return value{}, ErrInvalidOperandType
+			}
+			if e.cols != elements[0].cols {
+				return value{}, ErrInvalidShape
+			}
+		}
+		return matrix(len(elements), elements[0].cols), nil
+	default:
+		return value{}, ErrInvalidOperandType
+	}
+}
+
+// Прогоняет постфиксную запись как вычисление, но вместо чисел считает виды значений.
+// Так проверяем, что списки передаются только в функции, которые их принимают, и размеры подходят
+func checkTypes(postfix []string) error {
+	var stack []value
+	pop := func(n int) []value {
+		values := stack[len(stack)-n:]
+		stack = stack[:len(stack)-n]
+		return values
+	}
+	for _, token := range postfix {
+		if _, ok := parseReference(token); ok || isNumber(token) {
+			// Ссылаться можно только на выражения с числовым результатом
+			stack = append(stack, value{kind: scalarValue})
+		} else if length, ok := parseListToken(token); ok {
+			list, err := listOf(pop(length))
+			if err != nil {
+				return err
+			}
+			stack = append(stack, list)
+		} else if name, argsCount, ok := parseFunctionToken(token); ok {
+			args := pop(argsCount)
+			f := functions[name]
+			if f.signature != nil {
+				result, err := f.signature(args)
+				if err != nil {
+					return err
+				}
+				stack = append(stack, result)
+				continue
+			}
+			for _, arg := range args {
+				if arg.kind != scalarValue && !f.lists {
+					return ErrInvalidOperandType
+				}
+			}
+			stack = append(stack, value{kind: scalarValue})
+		} else if token == "%" {
+			if stack[len(stack)-1].kind != scalarValue {
+				return ErrInvalidOperandType
+			}
+		} else {
+			for _, arg := range pop(2) {
+				if arg.kind != scalarValue {
+					return ErrInvalidOperandType
+				}
+			}
+			stack = append(stack, value{kind: scalarValue})
+		}
+	}
+	return nil
+}
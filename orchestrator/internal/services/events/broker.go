@@ -0,0 +1,132 @@
+package events
+
+// Pub/sub внутри процесса: ExpressionService публикует изменения выражений,
+// а потоковые обработчики (SSE и другие) подписываются на нужные им события
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+)
+
+const (
+	ExpressionCreated  = "expression_created"
+	TaskCompleted      = "task_completed"
+	TreeUpdated        = "tree_updated" // выражение продвинулось: появились новые задачи или оно вернулось в работу
+	ExpressionFinished = "expression_finished"
+)
+
+type Event struct {
+	ID           int64             `json:"id"` // порядковый номер, растет с каждым событием
+	Type         string            `json:"type"`
+	ExpressionID int               `json:"expression_id"`
+	UserID       int               `json:"-"`
+	TaskID       int               `json:"task_id,omitempty"`
+	Result       *float64          `json:"result,omitempty"` // результат задачи у task_completed
+	Expression   models.Expression `json:"expression"`       // выражение сразу после изменения
+	Time         time.Time         `json:"time"`
+}
+
+// Сколько событий ждут в очереди подписчика. Если он не успевает, новые события для него теряются,
+// а в Lagged приходит сигнал, что состояние пора перечитать
+const subscriptionBuffer = 64
+
+type Broker struct {
+	mu          sync.Mutex
+	lastID      int64
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+type Subscription struct {
+	C      <-chan Event    // закрывается при Close или остановке брокера
+	Lagged <-chan struct{} // сигнал, что события для подписчика терялись. Несколько потерь подряд дают один сигнал
+	ch     chan Event
+	lagged chan struct{}
+	filter func(Event) bool
+	broker *Broker
+}
+
+func NewBroker() *Broker {
+	return &Broker{subscribers: map[*Subscription]struct{}{}}
+}
+
+// Подписка на события, для которых filter вернул true. nil значит все события
+func (b *Broker) Subscribe(filter func(Event) bool) *Subscription {
+	ch := make(chan Event, subscriptionBuffer)
+	lagged := make(chan struct{}, 1)
+	sub := &Subscription{C: ch, Lagged: lagged, ch: ch, lagged: lagged, filter: filter, broker: b}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return sub
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Рассылает событие подписчикам. Не блокируется на медленных подписчиках
+func (b *Broker) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.lastID++
+	event.ID = b.lastID
+	for sub := range b.subscribers {
+		if sub.filter != nil && !sub.filter(event) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			slog.Warn("events.Broker: subscriber is too slow, event dropped", "event_id", event.ID, "type", event.Type)
+			select {
+			case sub.lagged <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Закрывает все подписки. После этого события никуда не уходят
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for sub := range b.subscribers {
+		close(sub.ch)
+		delete(b.subscribers, sub)
+	}
+}
+
+// Выбрасывает события, которые ждут в очереди. Нужно после потери событий:
+// подписчик перечитывает состояние, и старые события ему уже не нужны
+func (s *Subscription) Drain() {
+	for {
+		select {
+		case _, ok := <-s.ch:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	if _, ok := s.broker.subscribers[s]; ok {
+		delete(s.broker.subscribers, s)
+		close(s.ch)
+	}
+}
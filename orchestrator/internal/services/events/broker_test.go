@@ -0,0 +1,53 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroker(t *testing.T) {
+	broker := NewBroker()
+	all := broker.Subscribe(nil)
+	mine := broker.Subscribe(func(event Event) bool { return event.UserID == 1 })
+
+	broker.Publish(Event{Type: ExpressionCreated, UserID: 1, ExpressionID: 10})
+	broker.Publish(Event{Type: ExpressionCreated, UserID: 2, ExpressionID: 20})
+
+	first := <-all.C
+	require.Equal(t, int64(1), first.ID)
+	require.Equal(t, 10, first.ExpressionID)
+	second := <-all.C
+	require.Equal(t, int64(2), second.ID)
+	require.Equal(t, 10, (<-mine.C).ExpressionID)
+	require.Empty(t, mine.C)
+
+	// Отписавшийся больше ничего не получает
+	mine.Close()
+	mine.Close()
+	_, ok := <-mine.C
+	require.False(t, ok)
+	broker.Publish(Event{UserID: 1})
+	require.Len(t, all.C, 1)
+
+	// Медленный подписчик не задерживает остальных, но узнает, что события терялись
+	require.Empty(t, all.Lagged)
+	for range subscriptionBuffer * 2 {
+		broker.Publish(Event{})
+	}
+	require.Len(t, all.C, subscriptionBuffer)
+	require.Len(t, all.Lagged, 1)
+	<-all.Lagged
+	all.Drain()
+	require.Empty(t, all.C)
+	broker.Publish(Event{})
+	require.Len(t, all.C, 1)
+	require.Empty(t, all.Lagged)
+
+	broker.Close()
+	for range all.C {
+	}
+	_, ok = <-broker.Subscribe(nil).C
+	require.False(t, ok)
+	all.Close()
+}
@@ -0,0 +1,125 @@
+package expression
+
+// Пакетная отправка выражений. Каждое выражение проверяется отдельно, ошибка в одном не мешает остальным,
+// а все прошедшие проверку сохраняются в одной транзакции вместе с пакетом
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
+)
+
+// Выражение в пакете
+type BatchItem struct {
+	ClientID   string // необязательный ID, по которому клиент найдет выражение в ответе
+	Expression string
+	Options    ProcessOptions
+	// Ошибка, найденная до сервиса, например при разборе параметров. Такое выражение не отправляется
+	Err error
+}
+
+// Итог по выражению пакета: ID выражения или ошибка
+type BatchResult struct {
+	Index    int    `json:"index"` // номер выражения в запросе
+	ClientID string `json:"client_id,omitempty"`
+	ID       int    `json:"id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Отправляет выражения пакетом. Если ни одно не прошло проверку, пакет не создается и batch.ID остается 0
+func (s *ExpressionService) ProcessBatch(items []BatchItem, user_id int) (models.Batch, []BatchResult, error) {
+	batch := models.Batch{UserID: user_id, CreatedAt: s.now()}
+	if len(items) == 0 {
+		return batch, nil, ErrEmptyBatch
+	}
+	if s.timeConfig.MaxBatchSize > 0 && len(items) > s.timeConfig.MaxBatchSize {
+		return batch, nil, ErrBatchTooLarge
+	}
+
+	results := make([]BatchResult, len(items))
+	prepared := map[int]models.Expression{}
+	seen := map[string]bool{}
+	for i, item := range items {
+		results[i] = BatchResult{Index: i, ClientID: item.ClientID}
+		err := item.Err
+		if err == nil && item.ClientID != "" && seen[item.ClientID] {
+			err = ErrDuplicateClientID
+		}
+		if err == nil {
+			var expression models.Expression
+			expression, err = s.newExpression(item.Expression, user_id, item.Options)
+			expression.ClientID = item.ClientID
+			prepared[i] = expression
+		}
+		if err == nil {
+			// Неверная ссылка внутри транзакции откатила бы весь пакет, поэтому проверяем заранее
+			_, err = s.loadReferences(prepared[i].BinaryTree.References(), user_id)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			delete(prepared, i)
+			continue
+		}
+		seen[item.ClientID] = true
+	}
+	if len(prepared) == 0 {
+		return batch, results, nil
+	}
+
+	batch.Total = len(prepared)
+	err := s.inTx(func(tx *ExpressionService) error {
+		if err := tx.storage.SaveBatch(&batch); err != nil {
+			slog.Error("ExpressionService.ProcessBatch: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		for i := range items {
+			expression, ok := prepared[i]
+			if !ok {
+				continue
+			}
+			expression.BatchID = batch.ID
+			if err := tx.submit(&expression); err != nil {
+				return err
+			}
+			results[i].ID = expression.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return models.Batch{}, nil, err
+	}
+	slog.Info("ExpressionService.ProcessBatch: batch submitted", "batch_id", batch.ID, "total", batch.Total, "rejected", len(items)-batch.Total)
+	return batch, results, nil
+}
+
+// Пакет пользователя со сводкой по статусам выражений
+func (s *ExpressionService) GetBatch(batch_id int, user_id int) (models.Batch, error) {
+	batch, err := s.storage.GetBatch(batch_id)
+	if errors.Is(err, storage.ErrItemNotFound) || batch.UserID != user_id {
+		return batch, ErrBatchNotFound
+	} else if err != nil {
+		slog.Error("ExpressionService.GetBatch: error in storage", "error", err.Error())
+		return batch, ErrStorage
+	}
+	batch.Expressions, err = s.storage.GetBatchExpressions(batch_id)
+	if err != nil {
+		slog.Error("ExpressionService.GetBatch: error in storage", "error", err.Error())
+		return batch, ErrStorage
+	}
+	batch.Status = models.BatchDone
+	batch.Counts = map[models.ExpressionStatus]int{
+		models.ExpressionProcessing: 0,
+		models.ExpressionSolved:     0,
+		models.ExpressionError:      0,
+		models.ExpressionCancelled:  0,
+	}
+	for _, expression := range batch.Expressions {
+		batch.Counts[expression.Status]++
+		if !expression.Status.Finished() {
+			batch.Status = models.BatchProcessing
+		}
+	}
+	return batch, nil
+}
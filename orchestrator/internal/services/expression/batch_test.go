@@ -0,0 +1,106 @@
+package expression
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceProcessBatch(t *testing.T) {
+	service := setUpService()
+	service.timeConfig.MaxBatchSize = 5
+	user_id, err := service.storage.SaveUser(&models.User{Login: "batch"})
+	require.NoError(t, err)
+	other_id, err := service.storage.SaveUser(&models.User{Login: "other"})
+	require.NoError(t, err)
+
+	_, _, err = service.ProcessBatch(nil, user_id)
+	require.ErrorIs(t, err, ErrEmptyBatch)
+	_, _, err = service.ProcessBatch(make([]BatchItem, 6), user_id)
+	require.ErrorIs(t, err, ErrBatchTooLarge)
+
+	// Ни одно выражение не прошло проверку, пакета нет
+	batch, results, err := service.ProcessBatch([]BatchItem{{Expression: "2 +"}}, user_id)
+	require.NoError(t, err)
+	require.Zero(t, batch.ID)
+	require.Len(t, results, 1)
+	require.NotEmpty(t, results[0].Error)
+
+	batch, results, err = service.ProcessBatch([]BatchItem{
+		{ClientID: "A1", Expression: "2 + 2"},
+		{ClientID: "A2", Expression: "2 +"},
+		{ClientID: "A3", Expression: "1 / 0"},
+		{ClientID: "A1", Expression: "3 + 3"},
+		{Expression: "4 * 4", Err: errors.New("invalid timeout")},
+	}, user_id)
+	require.NoError(t, err)
+	require.NotZero(t, batch.ID)
+	require.Equal(t, 2, batch.Total)
+	require.Len(t, results, 5)
+	require.NotZero(t, results[0].ID)
+	require.Empty(t, results[0].Error)
+	require.Zero(t, results[1].ID)
+	require.NotEmpty(t, results[1].Error)
+	// Деление на ноль проверку проходит, выражение сразу закрывается с ошибкой
+	require.NotZero(t, results[2].ID)
+	require.Equal(t, ErrDuplicateClientID.Error(), results[3].Error)
+	require.Equal(t, "invalid timeout", results[4].Error)
+	for i, result := range results {
+		require.Equal(t, i, result.Index)
+	}
+
+	expression, err := service.GetExpressionByID(results[0].ID, user_id)
+	require.NoError(t, err)
+	require.Equal(t, batch.ID, expression.BatchID)
+	require.Equal(t, "A1", expression.ClientID)
+
+	got, err := service.GetBatch(batch.ID, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.BatchProcessing, got.Status)
+	require.Len(t, got.Expressions, 2)
+	require.Equal(t, 1, got.Counts[models.ExpressionProcessing])
+	require.Equal(t, 1, got.Counts[models.ExpressionError])
+	require.Equal(t, 0, got.Counts[models.ExpressionSolved])
+
+	task, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 4))
+	got, err = service.GetBatch(batch.ID, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.BatchDone, got.Status)
+	require.Equal(t, 1, got.Counts[models.ExpressionSolved])
+
+	_, err = service.GetBatch(batch.ID, other_id)
+	require.ErrorIs(t, err, ErrBatchNotFound)
+	_, err = service.GetBatch(batch.ID+1, user_id)
+	require.ErrorIs(t, err, ErrBatchNotFound)
+}
+
+func TestServiceProcessBatchIsAtomic(t *testing.T) {
+	service := setUpService()
+	user_id, err := service.storage.SaveUser(&models.User{Login: "batch"})
+	require.NoError(t, err)
+
+	// Падение посреди пакета откатывает все выражения, а не только последнее
+	saved := 0
+	service.crashAt = func(step string) {
+		if step == "expression saved" {
+			saved++
+			if saved == 2 {
+				panic("crash at second expression")
+			}
+		}
+	}
+	runUntilCrash(t, func() {
+		service.ProcessBatch([]BatchItem{{Expression: "1 + 1"}, {Expression: "2 + 2"}}, user_id)
+	})
+	service.crashAt = nil
+	expressions, err := service.GetExpressions(user_id)
+	require.NoError(t, err)
+	require.Empty(t, expressions)
+	require.Empty(t, service.storage.GetTasks())
+	_, err = service.GetBatch(1, user_id)
+	require.ErrorIs(t, err, ErrBatchNotFound)
+}
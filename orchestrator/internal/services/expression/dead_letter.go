@@ -0,0 +1,143 @@
+package expression
+
+// Dead-letter: задачи, которые агенты так и не решили за TASK_MAX_ATTEMPTS попыток.
+// Выражение такой задачи закрывается с ошибкой, а сама задача остается в хранилище,
+// чтобы администратор мог посмотреть на нее и вернуть в очередь
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/events"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
+)
+
+// Задача из dead-letter для администратора
+type DeadTask struct {
+	ID               int                     `json:"id"`
+	ExpressionID     int                     `json:"expression_id"`
+	ExpressionStatus models.ExpressionStatus `json:"expression_status"`
+	Operation        string                  `json:"operation"`
+	Arg1             float64                 `json:"arg1"`
+	Arg2             float64                 `json:"arg2"`
+	Args             []float64               `json:"args,omitempty"`
+	Attempts         int                     `json:"attempts"`
+	AgentID          string                  `json:"agent_id"` // агент последней попытки
+}
+
+// Отправляет задачу в dead-letter и закрывает ее выражение с ошибкой
+func (s *ExpressionService) deadLetterTask(task models.Task) error {
+	if err := s.recordEvent(task, "dead", nil); err != nil {
+		return err
+	}
+	if err := task.SetStatus(models.TaskDead); err != nil {
+		return transitionError(err)
+	}
+	task.LeaseUntil = time.Time{}
+	if _, err := s.storage.SaveTask(&task); err != nil {
+		slog.Error("ExpressionService.deadLetterTask: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	expression, err := s.storage.GetExpression(task.ExpressionID)
+	if errors.Is(err, storage.ErrItemNotFound) {
+		return nil
+	} else if err != nil {
+		slog.Error("ExpressionService.deadLetterTask: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	if expression.Status.Finished() {
+		return nil
+	}
+	return s.closeExpressionWithError(&expression, models.ErrorCodeTaskFailed, fmt.Sprintf("task %d failed after %d attempts", task.ID, task.Attempts))
+}
+
+// Все задачи из dead-letter
+func (s *ExpressionService) DeadTasks() ([]DeadTask, error) {
+	tasks, err := s.storage.GetTasksByStatus(models.TaskDead)
+	if err != nil {
+		slog.Error("ExpressionService.DeadTasks: error in storage", "error", err.Error())
+		return nil, ErrStorage
+	}
+	dead := make([]DeadTask, 0, len(tasks))
+	for _, task := range tasks {
+		expression, err := s.storage.GetExpression(task.ExpressionID)
+		if err != nil && !errors.Is(err, storage.ErrItemNotFound) {
+			slog.Error("ExpressionService.DeadTasks: error in storage", "error", err.Error())
+			return nil, ErrStorage
+		}
+		dead = append(dead, DeadTask{
+			ID:               task.ID,
+			ExpressionID:     task.ExpressionID,
+			ExpressionStatus: expression.Status,
+			Operation:        task.Operation,
+			Arg1:             task.Arg1,
+			Arg2:             task.Arg2,
+			Args:             task.Args,
+			Attempts:         task.Attempts,
+			AgentID:          task.AgentID,
+		})
+	}
+	return dead, nil
+}
+
+// Возвращает задачу из dead-letter в очередь с новым счетчиком попыток.
+// Выражение снова считается: задачи, удаленные при его закрытии, создаются заново, как при восстановлении
+func (s *ExpressionService) RequeueDeadTask(task_id int) (models.Expression, error) {
+	var expression models.Expression
+	err := s.inTx(func(tx *ExpressionService) error {
+		task, err := tx.storage.GetTask(task_id)
+		if errors.Is(err, storage.ErrItemNotFound) {
+			return ErrTaskNotFound
+		} else if err != nil {
+			slog.Error("ExpressionService.RequeueDeadTask: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if task.Status != models.TaskDead {
+			return ErrTaskNotDead
+		}
+		expression, err = tx.storage.GetExpression(task.ExpressionID)
+		if errors.Is(err, storage.ErrItemNotFound) {
+			return ErrExpressionNotFound
+		} else if err != nil {
+			slog.Error("ExpressionService.RequeueDeadTask: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		// Решенное или отмененное выражение заново не считаем, а с истекшим сроком оно сразу закроется снова
+		if expression.Status != models.ExpressionError {
+			return ErrExpressionFinished
+		}
+		if tx.expired(expression) {
+			return ErrExpressionTimeout
+		}
+
+		if err := task.SetStatus(models.TaskPending); err != nil {
+			return transitionError(err)
+		}
+		task.Attempts = 0
+		task.AvailableAt = time.Time{}
+		task.AgentID = ""
+		if _, err := tx.storage.SaveTask(&task); err != nil {
+			slog.Error("ExpressionService.RequeueDeadTask: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if err := expression.SetStatus(models.ExpressionProcessing); err != nil {
+			return transitionError(err)
+		}
+		expression.FinishedAt = nil
+		if err := tx.restoreTasks(&expression); err != nil {
+			return err
+		}
+		if !expression.Status.Finished() {
+			tx.publish(events.TreeUpdated, expression)
+		}
+		return nil
+	})
+	if err != nil {
+		return expression, err
+	}
+	slog.Info("ExpressionService.RequeueDeadTask: task returned to queue", "task_id", task_id, "expression_id", expression.ID)
+	return expression, nil
+}
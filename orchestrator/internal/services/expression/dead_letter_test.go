@@ -0,0 +1,110 @@
+package expression
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceRetryBackoff(t *testing.T) {
+	service := setUpService()
+	service.timeConfig.RetryBackoff = time.Second
+	service.timeConfig.RetryBackoffMax = 5 * time.Second
+
+	require.Equal(t, time.Second, service.retryBackoff(1))
+	require.Equal(t, 2*time.Second, service.retryBackoff(2))
+	require.Equal(t, 4*time.Second, service.retryBackoff(3))
+	require.Equal(t, 5*time.Second, service.retryBackoff(4))
+	require.Equal(t, 5*time.Second, service.retryBackoff(10))
+}
+
+func TestServiceDeadLetter(t *testing.T) {
+	service := setUpService()
+	service.timeConfig.MaxAttempts = 2
+	service.timeConfig.RetryBackoff = 10 * time.Second
+	user_id := 1
+
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	expression_id, err := service.ProcessExpression("(2 + 2) * (3 + 3)", user_id)
+	require.NoError(t, err)
+	first, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, 1, first.Attempts)
+
+	// Первая попытка не удалась: задача вернется в очередь только после паузы
+	now = now.Add(2 * time.Minute)
+	released, err := service.ReleaseExpiredLeases()
+	require.NoError(t, err)
+	require.Equal(t, 1, released)
+	other, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.NotEqual(t, first.ID, other.ID)
+	_, err = service.GetPendingTask()
+	require.ErrorIs(t, err, ErrPendingTaskNotFount)
+
+	now = now.Add(10 * time.Second)
+	retry, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, first.ID, retry.ID)
+	require.Equal(t, 2, retry.Attempts)
+	require.NoError(t, service.ProcessIncomingTask(other.ID, other.AttemptToken, 6))
+
+	// Попытки кончились: задача в dead-letter, выражение закрыто с ошибкой
+	now = now.Add(2 * time.Minute)
+	released, err = service.ReleaseExpiredLeases()
+	require.NoError(t, err)
+	require.Equal(t, 0, released)
+	expression, err := service.GetExpressionByID(expression_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionError, expression.Status)
+	require.Equal(t, models.ErrorCodeTaskFailed, expression.ErrorCode)
+	require.Equal(t, "task 1 failed after 2 attempts", expression.ErrorMessage)
+
+	dead, err := service.DeadTasks()
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	require.Equal(t, first.ID, dead[0].ID)
+	require.Equal(t, expression_id, dead[0].ExpressionID)
+	require.Equal(t, 2, dead[0].Attempts)
+	require.Equal(t, expression.Status, dead[0].ExpressionStatus)
+
+	// Восстановление не трогает задачи из dead-letter
+	_, err = service.Recover()
+	require.NoError(t, err)
+	dead, err = service.DeadTasks()
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+
+	// Решенная задача удалилась вместе с закрытым выражением
+	_, err = service.RequeueDeadTask(other.ID)
+	require.ErrorIs(t, err, ErrTaskNotFound)
+
+	// Администратор вернул задачу: выражение снова считается и решается
+	expression, err = service.RequeueDeadTask(first.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionProcessing, expression.Status)
+	requeued, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, first.ID, requeued.ID)
+	require.Equal(t, 1, requeued.Attempts)
+	require.NoError(t, service.ProcessIncomingTask(requeued.ID, requeued.AttemptToken, 4))
+
+	root, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.NoError(t, service.ProcessIncomingTask(root.ID, root.AttemptToken, 24))
+	expression, err = service.GetExpressionByID(expression_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+	require.Equal(t, 24.0, expression.Result)
+
+	_, err = service.ProcessExpression("1 + 1", user_id)
+	require.NoError(t, err)
+	pending, err := service.GetPendingTask()
+	require.NoError(t, err)
+	_, err = service.RequeueDeadTask(pending.ID)
+	require.ErrorIs(t, err, ErrTaskNotDead)
+}
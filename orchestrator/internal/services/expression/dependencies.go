@@ -0,0 +1,141 @@
+package expression
+
+// Выражения со ссылками на результаты других выражений того же пользователя: $42 * 1.2 + $43.
+// Вершины над ссылками не становятся свободными, пока вместо ссылок не подставлены числа,
+// поэтому задачи для них создаются только после того, как нужные выражения решены.
+// Если нужное выражение закрылось с ошибкой или отменено, ссылающееся закрывается с ошибкой dependency_failed
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/events"
+)
+
+// Выражения пользователя, на которые ссылается новое выражение
+func (s *ExpressionService) loadReferences(refs []int, user_id int) ([]models.Expression, error) {
+	dependencies := make([]models.Expression, 0, len(refs))
+	for _, id := range refs {
+		dependency, err := s.GetExpressionByID(id, user_id)
+		if errors.Is(err, ErrExpressionNotFound) {
+			return nil, fmt.Errorf("%w: $%d", ErrReferenceNotFound, id)
+		} else if err != nil {
+			slog.Error("ExpressionService.loadReferences: error in storage", "error", err.Error())
+			return nil, ErrStorage
+		}
+		dependencies = append(dependencies, dependency)
+	}
+	return dependencies, nil
+}
+
+// Запоминает ссылки только что сохраненного выражения и подставляет результаты уже решенных выражений.
+// Вызывается внутри транзакции: при ошибке выражение не сохранится
+func (s *ExpressionService) linkDependencies(expression *models.Expression) error {
+	refs := expression.BinaryTree.References()
+	if len(refs) == 0 {
+		return nil
+	}
+	if err := s.checkCycle(expression.ID, refs); err != nil {
+		return err
+	}
+	dependencies, err := s.loadReferences(refs, expression.UserID)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.SaveDependencies(expression.ID, refs); err != nil {
+		slog.Error("ExpressionService.linkDependencies: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	for _, dependency := range dependencies {
+		if err := s.applyDependency(expression, dependency); err != nil {
+			return err
+		}
+		if expression.Status.Finished() {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Ищет цепочку ссылок от refs обратно к выражению id. ID выражения известен только после сохранения,
+// поэтому цикл - это, например, ссылка выражения на само себя
+func (s *ExpressionService) checkCycle(id int, refs []int) error {
+	visited := map[int]bool{}
+	stack := append([]int{}, refs...)
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if current == id {
+			return fmt.Errorf("%w: $%d", ErrDependencyCycle, id)
+		}
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		next, err := s.storage.GetDependencies(current)
+		if err != nil {
+			slog.Error("ExpressionService.checkCycle: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		stack = append(stack, next...)
+	}
+	return nil
+}
+
+// Подставляет результат решенного выражения dependency в expression.
+// Если dependency не решилось, expression закрывается с ошибкой. Пока dependency считается, ничего не меняется
+func (s *ExpressionService) applyDependency(expression *models.Expression, dependency models.Expression) error {
+	switch dependency.Status {
+	case models.ExpressionProcessing:
+		return nil
+	case models.ExpressionSolved:
+		if dependency.Value != nil {
+			return s.closeExpressionWithError(expression, models.ErrorCodeDependencyFailed, fmt.Sprintf("expression %d result is not a number", dependency.ID))
+		}
+		expression.BinaryTree.ResolveReference(dependency.ID, dependency.Result)
+		return nil
+	case models.ExpressionCancelled:
+		return s.closeExpressionWithError(expression, models.ErrorCodeDependencyFailed, fmt.Sprintf("expression %d cancelled", dependency.ID))
+	default:
+		return s.closeExpressionWithError(expression, models.ErrorCodeDependencyFailed, fmt.Sprintf("expression %d failed: %s", dependency.ID, dependency.ErrorMessage))
+	}
+}
+
+// Выражение закончилось: ссылающиеся на него выражения получают результат и идут дальше или закрываются с ошибкой.
+// Те, в свою очередь, могут закончиться и двинуть свои зависимые выражения
+func (s *ExpressionService) notifyDependents(expression models.Expression) error {
+	ids, err := s.storage.GetDependents(expression.ID)
+	if err != nil {
+		slog.Error("ExpressionService.notifyDependents: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	for _, id := range ids {
+		dependent, err := s.storage.GetExpression(id)
+		if err != nil {
+			slog.Error("ExpressionService.notifyDependents: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if dependent.Status.Finished() {
+			continue
+		}
+		if err := s.applyDependency(&dependent, expression); err != nil {
+			return err
+		}
+		if dependent.Status.Finished() {
+			continue
+		}
+		if err := s.advanceExpression(&dependent); err != nil {
+			return err
+		}
+		if _, err := s.storage.SaveExpression(&dependent); err != nil {
+			slog.Error("ExpressionService.notifyDependents: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if !dependent.Status.Finished() {
+			s.publish(events.TreeUpdated, dependent)
+		}
+	}
+	return nil
+}
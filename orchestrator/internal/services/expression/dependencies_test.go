@@ -0,0 +1,171 @@
+package expression
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/events"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceDependencies(t *testing.T) {
+	service := setUpService()
+	user_id, err := service.storage.SaveUser(&models.User{Login: "chain"})
+	require.NoError(t, err)
+	other_id, err := service.storage.SaveUser(&models.User{Login: "other"})
+	require.NoError(t, err)
+
+	solveNext := func(operation string, args []float64, result float64) {
+		t.Helper()
+		task, err := service.GetPendingTask()
+		require.NoError(t, err)
+		require.Equal(t, operation, task.Operation)
+		require.Equal(t, args, []float64{task.Arg1, task.Arg2})
+		require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, result))
+	}
+	get := func(id int) models.Expression {
+		t.Helper()
+		expression, err := service.GetExpressionByID(id, user_id)
+		require.NoError(t, err)
+		return expression
+	}
+
+	first, err := service.ProcessExpression("2 + 2", user_id)
+	require.NoError(t, err)
+	second, err := service.ProcessExpression(fmt.Sprintf("$%d * 3", first), user_id)
+	require.NoError(t, err)
+	third, err := service.ProcessExpression(fmt.Sprintf("$%d + 1 - $%d", second, first), user_id)
+	require.NoError(t, err)
+	require.Equal(t, []int{first}, get(second).DependsOn)
+	require.Equal(t, []int{first, second}, get(third).DependsOn)
+
+	// Пока first не решено, задач у зависимых выражений нет
+	tasks, err := service.storage.GetTasksByExpressionID(second)
+	require.NoError(t, err)
+	require.Empty(t, tasks)
+
+	solveNext("+", []float64{2, 2}, 4)
+	require.Equal(t, models.ExpressionProcessing, get(second).Status)
+	solveNext("*", []float64{4, 3}, 12)
+	solveNext("+", []float64{12, 1}, 13)
+	solveNext("-", []float64{13, 4}, 9)
+	require.Equal(t, models.ExpressionSolved, get(third).Status)
+	require.Equal(t, 9.0, get(third).Result)
+
+	// Ссылка на уже решенное выражение подставляется сразу
+	solved, err := service.ProcessExpression(fmt.Sprintf("$%d + $%d", first, first), user_id)
+	require.NoError(t, err)
+	solveNext("+", []float64{4, 4}, 8)
+	require.Equal(t, 8.0, get(solved).Result)
+
+	// Ошибка идет по цепочке дальше
+	root, err := service.ProcessExpression("1 + 1", user_id)
+	require.NoError(t, err)
+	middle, err := service.ProcessExpression(fmt.Sprintf("$%d + 1", root), user_id)
+	require.NoError(t, err)
+	leaf, err := service.ProcessExpression(fmt.Sprintf("$%d * 2", middle), user_id)
+	require.NoError(t, err)
+	_, err = service.CancelExpression(root, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionError, get(middle).Status)
+	require.Equal(t, models.ErrorCodeDependencyFailed, get(middle).ErrorCode)
+	require.Equal(t, fmt.Sprintf("expression %d cancelled", root), get(middle).ErrorMessage)
+	require.Equal(t, models.ExpressionError, get(leaf).Status)
+	require.Equal(t, fmt.Sprintf("expression %d failed: expression %d cancelled", middle, root), get(leaf).ErrorMessage)
+
+	// Ссылка на выражение, которое уже закрыто с ошибкой или решено не числом
+	failed, err := service.ProcessExpression("1 / 0", user_id)
+	require.NoError(t, err)
+	dependent, err := service.ProcessExpression(fmt.Sprintf("$%d + 1", failed), user_id)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("expression %d failed: division by zero", failed), get(dependent).ErrorMessage)
+	vector, err := service.ProcessExpression("[1, 2]", user_id)
+	require.NoError(t, err)
+	dependent, err = service.ProcessExpression(fmt.Sprintf("$%d + 1", vector), user_id)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("expression %d result is not a number", vector), get(dependent).ErrorMessage)
+
+	// Чужие и несуществующие выражения
+	_, err = service.ProcessExpression(fmt.Sprintf("$%d + 1", first), other_id)
+	require.ErrorIs(t, err, ErrReferenceNotFound)
+	_, err = service.ProcessExpression("$999 + 1", user_id)
+	require.ErrorIs(t, err, ErrReferenceNotFound)
+
+	// Ссылка на само себя. Транзакция откатилась, поэтому следующее выражение получит тот же ID
+	_, err = service.ProcessExpression(fmt.Sprintf("$%d + 1", dependent+1), user_id)
+	require.ErrorIs(t, err, ErrDependencyCycle)
+	next, err := service.ProcessExpression("1 + 1", user_id)
+	require.NoError(t, err)
+	require.Equal(t, dependent+1, next)
+
+	// В пакете неверная ссылка - ошибка только этого выражения
+	batch, results, err := service.ProcessBatch([]BatchItem{
+		{Expression: "$999 + 1"},
+		{Expression: fmt.Sprintf("$%d + 1", third)},
+	}, user_id)
+	require.NoError(t, err)
+	require.NotZero(t, batch.ID)
+	require.Contains(t, results[0].Error, ErrReferenceNotFound.Error())
+	require.NotZero(t, results[1].ID)
+}
+
+func TestServiceDependenciesExpireTogether(t *testing.T) {
+	service := setUpService()
+	service.timeConfig.DefaultTimeout = time.Minute
+	service.timeConfig.MaxTimeout = time.Hour
+	user_id, err := service.storage.SaveUser(&models.User{Login: "expired"})
+	require.NoError(t, err)
+	now := time.Now()
+	service.now = func() time.Time { return now }
+	get := func(id int) models.Expression {
+		t.Helper()
+		expression, err := service.GetExpressionByID(id, user_id)
+		require.NoError(t, err)
+		return expression
+	}
+
+	// Срок вышел у обоих сразу: зависимое закрывается один раз, по вине зависимости
+	root, err := service.ProcessExpressionWithOptions("2 + 2", user_id, ProcessOptions{CallbackURL: "http://example.com/root"})
+	require.NoError(t, err)
+	dependent, err := service.ProcessExpressionWithOptions(fmt.Sprintf("$%d + 1", root), user_id, ProcessOptions{CallbackURL: "http://example.com/dependent"})
+	require.NoError(t, err)
+	sub := service.SubscribeUser(user_id)
+	defer sub.Close()
+
+	now = now.Add(2 * time.Minute)
+	failed, err := service.FailExpiredExpressions()
+	require.NoError(t, err)
+	require.Equal(t, 1, failed)
+	require.Equal(t, models.ErrorCodeTimeout, get(root).ErrorCode)
+	require.Equal(t, models.ErrorCodeDependencyFailed, get(dependent).ErrorCode)
+	require.Equal(t, fmt.Sprintf("expression %d failed: timeout", root), get(dependent).ErrorMessage)
+
+	deliveries, err := service.storage.GetWebhookDeliveries(user_id, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	finished := map[int]int{}
+	for len(sub.C) > 0 {
+		event := <-sub.C
+		if event.Type == events.ExpressionFinished {
+			finished[event.ExpressionID]++
+		}
+	}
+	require.Equal(t, map[int]int{root: 1, dependent: 1}, finished)
+
+	// При восстановлении зависимое, закрытое вместе с зависимостью, не считается заново
+	root, err = service.ProcessExpressionWithOptions("3 + 3", user_id, ProcessOptions{Timeout: 30 * time.Second})
+	require.NoError(t, err)
+	dependent, err = service.ProcessExpressionWithOptions(fmt.Sprintf("$%d + 1", root), user_id, ProcessOptions{Timeout: time.Hour})
+	require.NoError(t, err)
+	now = now.Add(time.Minute)
+	report, err := service.Recover()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []int{root, dependent}, report.FinishedExpressions)
+	require.Equal(t, models.ExpressionError, get(dependent).Status)
+	require.Equal(t, models.ErrorCodeDependencyFailed, get(dependent).ErrorCode)
+	tasks, err := service.storage.GetTasksByExpressionID(dependent)
+	require.NoError(t, err)
+	require.Empty(t, tasks)
+}
@@ -0,0 +1,112 @@
+package expression
+
+// Выдача задач агентам. Сначала выдаем задачи с большим приоритетом,
+// но задача, которая долго ждет, постепенно поднимается, поэтому низкий приоритет тоже дойдет до агентов.
+// Среди пользователей, чьи задачи одинаково приоритетны, агенты делятся честно, см. fairQueue
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
+)
+
+const (
+	PriorityLow    = 0
+	PriorityNormal = 5
+	PriorityHigh   = 9
+)
+
+var priorityNames = map[string]int{
+	"low":    PriorityLow,
+	"normal": PriorityNormal,
+	"high":   PriorityHigh,
+}
+
+// Приоритет по имени (low, normal, high) или числом от 0 до 9
+func ParsePriority(value string) (int, error) {
+	if priority, ok := priorityNames[value]; ok {
+		return priority, nil
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil || priority < PriorityLow || priority > PriorityHigh {
+		return 0, ErrInvalidPriority
+	}
+	return priority, nil
+}
+
+// Закрепляет свободную задачу за агентом agentID.
+// Агент держит задачу, пока не истечет аренда. Потом ее заберет сборщик и отдаст другому.
+// Выбор и закрепление идут в одной транзакции, поэтому двум агентам одна задача не достанется
+func (s *ExpressionService) ClaimPendingTask(agentID string) (models.Task, error) {
+	var task models.Task
+	err := s.inTx(func(tx *ExpressionService) error {
+		candidates, err := tx.storage.GetClaimCandidates(tx.now())
+		if err != nil {
+			slog.Error("ExpressionService.ClaimPendingTask: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if len(candidates) == 0 {
+			return ErrPendingTaskNotFount
+		}
+		task = tx.pickTask(candidates)
+		leaseUntil := tx.now().Add(task.OperationTime + tx.timeConfig.LeaseGrace)
+		err = tx.storage.ClaimTask(&task, agentID, newAttemptToken(), leaseUntil)
+		if errors.Is(err, storage.ErrItemNotFound) {
+			return ErrPendingTaskNotFount
+		} else if err != nil {
+			slog.Error("ExpressionService.ClaimPendingTask: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		return tx.recordEvent(task, "dispatched", nil)
+	})
+	return task, err
+}
+
+// Выбирает задачу среди кандидатов. У каждого пользователя берем лучшую по приоритету с учетом старения,
+// из пользователей с самым высоким таким приоритетом очередного выбирает fairQueue
+func (s *ExpressionService) pickTask(candidates []models.Task) models.Task {
+	heads := map[int]models.Task{}
+	top := 0
+	for _, task := range candidates {
+		head, ok := heads[task.UserID]
+		if !ok || s.better(task, head) {
+			heads[task.UserID] = task
+		}
+	}
+	for _, head := range heads {
+		top = max(top, s.effectivePriority(head))
+	}
+	weights := map[int]int{}
+	for user_id, head := range heads {
+		if s.effectivePriority(head) == top {
+			weights[user_id] = s.userWeight(user_id)
+		}
+	}
+	return heads[s.fair.next(weights)]
+}
+
+// Больший приоритет с учетом старения, при равенстве - кто ждет дольше
+func (s *ExpressionService) better(task, than models.Task) bool {
+	priority, thanPriority := s.effectivePriority(task), s.effectivePriority(than)
+	return priority > thanPriority || priority == thanPriority && task.QueuedAt.Before(than.QueuedAt)
+}
+
+// Приоритет задачи плюс единица за каждые PriorityAging ожидания
+func (s *ExpressionService) effectivePriority(task models.Task) int {
+	if s.timeConfig.PriorityAging <= 0 {
+		return task.Priority
+	}
+	waited := s.now().Sub(task.QueuedAt)
+	if waited < 0 {
+		waited = 0
+	}
+	return task.Priority + int(waited/s.timeConfig.PriorityAging)
+}
+
+// Повышать приоритет выше обычного может только администратор
+func CheckPriorityAllowed(priority int, role string) bool {
+	return priority <= PriorityNormal || role == models.RoleAdmin
+}
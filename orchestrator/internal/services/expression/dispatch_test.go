@@ -0,0 +1,70 @@
+package expression
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePriority(t *testing.T) {
+	for value, expected := range map[string]int{"low": 0, "normal": 5, "high": 9, "0": 0, "7": 7} {
+		priority, err := ParsePriority(value)
+		require.NoError(t, err)
+		require.Equal(t, expected, priority)
+	}
+	for _, value := range []string{"urgent", "10", "-1", ""} {
+		_, err := ParsePriority(value)
+		require.ErrorIs(t, err, ErrInvalidPriority)
+	}
+
+	require.True(t, CheckPriorityAllowed(PriorityNormal, models.RoleUser))
+	require.False(t, CheckPriorityAllowed(PriorityHigh, models.RoleUser))
+	require.True(t, CheckPriorityAllowed(PriorityHigh, models.RoleAdmin))
+}
+
+func TestServicePriorityDispatch(t *testing.T) {
+	service := setUpService()
+	service.timeConfig.PriorityAging = 10 * time.Second
+	user_id := 1
+
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	process := func(expression string, priority int) int {
+		id, err := service.ProcessExpressionWithOptions(expression, user_id, ProcessOptions{Priority: &priority})
+		require.NoError(t, err)
+		return id
+	}
+	claim := func() int {
+		task, err := service.GetPendingTask()
+		require.NoError(t, err)
+		return task.ExpressionID
+	}
+
+	invalid := 10
+	_, err := service.ProcessExpressionWithOptions("1 + 1", user_id, ProcessOptions{Priority: &invalid})
+	require.ErrorIs(t, err, ErrInvalidPriority)
+
+	// Сначала больший приоритет, при равном - кто раньше встал в очередь
+	low := process("1 + 1", PriorityLow)
+	normal := process("2 + 2", PriorityNormal)
+	high := process("3 + 3", PriorityHigh)
+	normalLater := process("4 + 4", PriorityNormal)
+	require.Equal(t, high, claim())
+	require.Equal(t, normal, claim())
+	require.Equal(t, normalLater, claim())
+	require.Equal(t, low, claim())
+
+	// Низкий приоритет за 100 секунд ожидания дорос до 10 и обгоняет новый высокий
+	low = process("5 + 5", PriorityLow)
+	now = now.Add(100 * time.Second)
+	high = process("6 + 6", PriorityHigh)
+	require.Equal(t, low, claim())
+	require.Equal(t, high, claim())
+
+	expression, err := service.GetExpressionByID(high, user_id)
+	require.NoError(t, err)
+	require.Equal(t, PriorityHigh, expression.Priority)
+}
@@ -5,8 +5,25 @@ import "errors"
 var (
 	ErrPendingTaskNotFount = errors.New("no pending task available")
 	ErrExpressionNotFound  = errors.New("expression not found")
-	ErrZeroDivisionTask    = errors.New("task with zero division")
 	ErrTaskNotFound        = errors.New("task not found")
+	ErrLeaseExpired        = errors.New("task lease expired")
+	ErrStaleAttempt        = errors.New("result from stale task attempt")
+	ErrDuplicateResult     = errors.New("task result already accepted")
+	ErrExpressionFinished  = errors.New("expression already finished")
+	ErrExpressionCancelled = errors.New("expression cancelled")
+	ErrExpressionTimeout   = errors.New("expression deadline exceeded")
+	ErrInvalidTimeout      = errors.New("timeout must be positive")
+	ErrTimeoutTooLong      = errors.New("timeout exceeds maximum")
+	ErrTaskNotDead         = errors.New("task is not dead-lettered")
+	ErrInvalidPriority     = errors.New("invalid priority")
+	ErrInvalidWait         = errors.New("wait must not be negative")
+	ErrWaitTooLong         = errors.New("wait exceeds maximum")
+	ErrEmptyBatch          = errors.New("batch is empty")
+	ErrBatchTooLarge       = errors.New("batch exceeds maximum size")
+	ErrDuplicateClientID   = errors.New("duplicate client_id")
+	ErrBatchNotFound       = errors.New("batch not found")
+	ErrReferenceNotFound   = errors.New("referenced expression not found")
+	ErrDependencyCycle     = errors.New("dependency cycle")
 	ErrStorage             = errors.New("unknown error in storage")
 	ErrService             = errors.New("unknown error in service")
 )
@@ -9,113 +9,321 @@ package expression
 //
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"log/slog"
-	"strconv"
 	"time"
 
 	"github.com/RichCake/calc_api_go/orchestrator/internal/config"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/backoff"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/events"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/webhook"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
 )
 
 type ExpressionService struct {
 	storage    *storage.Storage
 	timeConfig config.TimeConfig
+	now        func() time.Time // в тестах подменяем, чтобы не ждать истечения аренды
+	done       chan struct{}
+	// Точки между шагами перехода, в тестах здесь имитируем падение процесса
+	crashAt  func(step string)
+	recovery *recoveryLog
+	fair     *fairQueue
+	broker   *events.Broker
+	cache    *resultCache
+	// События, накопленные в транзакции. Подписчики получают их только после коммита
+	outbox *[]events.Event
 }
 
 func NewExpressionService(s *storage.Storage, tc config.TimeConfig) *ExpressionService {
-	return &ExpressionService{storage: s, timeConfig: tc}
+	return &ExpressionService{
+		storage:    s,
+		timeConfig: tc,
+		now:        time.Now,
+		done:       make(chan struct{}),
+		recovery:   &recoveryLog{},
+		fair:       newFairQueue(),
+		broker:     events.NewBroker(),
+		cache:      newResultCache(tc.CacheSize, tc.CacheTTL),
+	}
 }
 
 func (s *ExpressionService) Close() {
+	close(s.done)
+	s.broker.Close()
 	s.storage.Close()
 }
 
+// Выполняет переход fn целиком в одной транзакции: выражение и его задачи меняются вместе или не меняются вовсе.
+// fn получает копию сервиса, хранилище которой работает внутри транзакции
+func (s *ExpressionService) inTx(fn func(tx *ExpressionService) error) error {
+	if s.outbox != nil {
+		// Уже внутри транзакции
+		return fn(s)
+	}
+	var outbox []events.Event
+	err := s.storage.InTx(func(st *storage.Storage) error {
+		tx := *s
+		tx.storage = st
+		tx.outbox = &outbox
+		return fn(&tx)
+	})
+	if err == nil {
+		for _, event := range outbox {
+			s.broker.Publish(event)
+		}
+	}
+	return err
+}
+
+func (s *ExpressionService) checkpoint(step string) {
+	if s.crashAt != nil {
+		s.crashAt(step)
+	}
+}
+
+// Необязательные параметры выражения
+type ProcessOptions struct {
+	// Формат чисел в выражении, например 1.234,5 для de. Пусто значит локаль из настроек пользователя
+	Locale string
+	// Сколько ждем решения. 0 значит срок по умолчанию из конфига
+	Timeout time.Duration
+	// Приоритет от PriorityLow до PriorityHigh, nil значит PriorityNormal
+	Priority *int
+	// Сюда уйдет вебхук, когда выражение решится или закроется с ошибкой
+	CallbackURL string
+	// Не брать результаты задач из кэша, все считают агенты
+	NoCache bool
+}
+
 // Обработчик входящего выражения.
 // Он запускается один раз для каждого выражения
 func (s *ExpressionService) ProcessExpression(expressionStr string, user_id int) (int, error) {
+	return s.ProcessExpressionWithOptions(expressionStr, user_id, ProcessOptions{})
+}
+
+// То же самое, но числа в выражении записаны в формате локали
+func (s *ExpressionService) ProcessExpressionWithLocale(expressionStr string, user_id int, localeName string) (int, error) {
+	return s.ProcessExpressionWithOptions(expressionStr, user_id, ProcessOptions{Locale: localeName})
+}
+
+func (s *ExpressionService) ProcessExpressionWithOptions(expressionStr string, user_id int, opts ProcessOptions) (int, error) {
+	newExpression, err := s.newExpression(expressionStr, user_id, opts)
+	if err != nil {
+		return 0, err
+	}
+	err = s.inTx(func(tx *ExpressionService) error {
+		return tx.submit(&newExpression)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newExpression.ID, nil
+}
+
+// Проверяет параметры и строит выражение вместе с деревом. В хранилище ничего не пишет
+func (s *ExpressionService) newExpression(expressionStr string, user_id int, opts ProcessOptions) (models.Expression, error) {
+	locale, err := s.ResolveLocale(opts.Locale, user_id)
+	if err != nil {
+		return models.Expression{}, err
+	}
+	deadline, err := s.deadline(opts.Timeout)
+	if err != nil {
+		return models.Expression{}, err
+	}
+	priority := PriorityNormal
+	if opts.Priority != nil {
+		priority = *opts.Priority
+	}
+	if priority < PriorityLow || priority > PriorityHigh {
+		return models.Expression{}, ErrInvalidPriority
+	}
+	if opts.CallbackURL != "" {
+		if err := webhook.ValidateURL(opts.CallbackURL); err != nil {
+			return models.Expression{}, err
+		}
+	}
 	// Первым делом переводим в постфиксную запись
-	postfix, err := calculation.ToPostfix(expressionStr)
+	postfix, err := calculation.ToPostfixLocale(expressionStr, locale)
 	if err != nil {
 		slog.Error("ExpressionService.ProcessExpression: Error in processing to postfix")
-		return 0, err
+		return models.Expression{}, err
 	}
 
 	// Формируем выражение и здесь же строим бинарное дерево
-	newExpression := models.Expression{
-		Status:     "processing",
-		BinaryTree: calculation.BuildTree(postfix),
-		UserID: user_id,
+	tree, err := calculation.BuildTree(postfix)
+	if err != nil {
+		slog.Error("ExpressionService.ProcessExpression: Error in building tree")
+		return models.Expression{}, err
 	}
+	return models.Expression{
+		Status:      models.ExpressionProcessing,
+		BinaryTree:  tree,
+		UserID:      user_id,
+		Deadline:    deadline,
+		Priority:    priority,
+		TotalTasks:  tree.CountTasks(),
+		CreatedAt:   s.now(),
+		CallbackURL: opts.CallbackURL,
+		NoCache:     opts.NoCache,
+	}, nil
+}
 
+// Сохраняет новое выражение и создает задачи для свободных вершин. Вызывается внутри транзакции
+func (s *ExpressionService) submit(expression *models.Expression) error {
 	// Добавляем выражение в хранилище
-	expressionID, err := s.storage.SaveExpression(&newExpression)
+	_, err := s.storage.SaveExpression(expression)
 	if err != nil {
 		slog.Error("ExpressionService.ProcessExpression: error in storage", "error", err.Error())
-		return 0, ErrStorage
+		return ErrStorage
 	}
+	s.publish(events.ExpressionCreated, *expression)
+	s.checkpoint("expression saved")
 
-	// Ищем вершины у которых дети это числа...
-	spareNodes := newExpression.BinaryTree.FindSpareNodes()
-	for _, node := range spareNodes {
-		// ..., и создаем для них задачи
-		task, err := s.createTaskForSpareNode(node, &newExpression)
-		if errors.Is(err, ErrZeroDivisionTask) {
-			s.closeExpressionWithError(&newExpression, "division by zero")
-		} else if err != nil {
-			slog.Error("ExpressionService.ProcessExpression: error in service", "error", err.Error())
-			return expressionID, ErrService
-		}
-		_, err = s.storage.SaveTask(&task)
-		if err != nil {
-			slog.Error("ExpressionService.ProcessExpression: error in storage", "error", err.Error())
-			return expressionID, ErrStorage
-		}
-		node.TaskID = task.ID
+	// Подставляем результаты выражений, на которые ссылается это. Остальные подставятся, когда те решатся
+	if err := s.linkDependencies(expression); err != nil {
+		return err
+	}
+	if expression.Status.Finished() {
+		// Выражение, на которое ссылается это, уже закрыто с ошибкой
+		return nil
+	}
+
+	// Ищем вершины у которых дети это числа и создаем для них задачи
+	err = s.advanceExpression(expression)
+	if err != nil {
+		slog.Error("ExpressionService.ProcessExpression: error in service", "error", err.Error())
+		return err
 	}
-	_, err = s.storage.SaveExpression(&newExpression)
+	s.checkpoint("tasks created")
+	_, err = s.storage.SaveExpression(expression)
 	if err != nil {
 		slog.Error("ExpressionService.ProcessExpression: error in storage", "error", err.Error())
-		return expressionID, ErrStorage
+		return ErrStorage
 	}
-	return expressionID, nil
+	return nil
+}
+
+// Срок решения выражения. Без timeout берем срок по умолчанию, больше максимума не даем
+func (s *ExpressionService) deadline(timeout time.Duration) (*time.Time, error) {
+	if timeout < 0 {
+		return nil, ErrInvalidTimeout
+	}
+	if timeout == 0 {
+		timeout = s.timeConfig.DefaultTimeout
+	}
+	if s.timeConfig.MaxTimeout > 0 && timeout > s.timeConfig.MaxTimeout {
+		return nil, ErrTimeoutTooLong
+	}
+	if timeout == 0 {
+		return nil, nil
+	}
+	deadline := s.now().Add(timeout)
+	return &deadline, nil
+}
+
+func (s *ExpressionService) expired(expression models.Expression) bool {
+	return expression.Deadline != nil && s.now().After(*expression.Deadline)
 }
 
-// Создание задачи для свободного узла. Свободный - это узел, у которого оба ребенка - числа
-func (s *ExpressionService) createTaskForSpareNode(node *calculation.TreeNode, expression *models.Expression) (models.Task, error) {
-	var task models.Task
-	arg1, _ := strconv.ParseFloat(node.Left.Val, 64)
-	arg2, _ := strconv.ParseFloat(node.Right.Val, 64)
+// Двигает выражение дальше: раскрывает матричные операции и создает задачи для свободных вершин.
+// Если значение корня уже известно, то выражение решено
+func (s *ExpressionService) advanceExpression(expression *models.Expression) error {
+	tree := expression.BinaryTree
+	for {
+		tree.Expand()
+		if tree.Root.IsResolved() {
+			return s.solveExpression(expression, tree.Root)
+		}
+		resolved, err := s.createTasks(tree, tree.FindSpareNodes(), expression)
+		if err != nil || !resolved {
+			return err
+		}
+		// Родители вершин, решенных из кэша, могли стать свободными
+	}
+}
 
-	if arg2 == 0 && node.Val == "/" {
-		// если делим на ноль, то закрываем выражение
-		return task, ErrZeroDivisionTask
+// Создает и сохраняет задачи для свободных узлов. Узлы, результат которых есть в кэше, сразу заменяются числом,
+// в этом случае возвращается true. Если аргументы задачи недопустимы (например, деление на ноль), то выражение закрывается с ошибкой
+func (s *ExpressionService) createTasks(tree *calculation.Tree, nodes []*calculation.TreeNode, expression *models.Expression) (bool, error) {
+	resolved := false
+	for _, node := range nodes {
+		if node.TaskID != 0 {
+			// задача уже создана и ждет агента
+			continue
+		}
+		if err := calculation.CheckOperation(node.Val, node.Operands()); err != nil {
+			return false, s.closeExpressionWithError(expression, operationErrorCode(err), err.Error())
+		}
+		if result, ok := s.cachedResult(node, expression); ok {
+			slog.Info("ExpressionService.createTasks: result taken from cache", "expression_id", expression.ID, "operation", node.Val)
+			tree.ReplaceNodeWithValue(node, result)
+			resolved = true
+			continue
+		}
+		task := s.createTaskForSpareNode(node, expression)
+		_, err := s.storage.SaveTask(&task)
+		if err != nil {
+			slog.Error("ExpressionService.createTasks: error in storage", "error", err.Error())
+			return false, ErrStorage
+		}
+		node.TaskID = task.ID
+		if err := s.recordEvent(task, "created", nil); err != nil {
+			return false, err
+		}
+		s.checkpoint("task created")
 	}
+	return resolved, nil
+}
 
-	task = models.Task{
+// Создание задачи для свободного узла. Свободный - это узел, у которого все дети - числа
+func (s *ExpressionService) createTaskForSpareNode(node *calculation.TreeNode, expression *models.Expression) models.Task {
+	task := models.Task{
 		ExpressionID:  expression.ID,
-		Status:        "pending",
-		Arg1:          arg1,
-		Arg2:          arg2,
+		UserID:        expression.UserID,
+		Status:        models.TaskPending,
 		Operation:     node.Val,
 		OperationTime: s.getOperationTime(node.Val),
+		Priority:      expression.Priority,
+		QueuedAt:      s.now(),
+	}
+	args := node.Operands()
+	if node.IsFunction() {
+		task.Args = args
+	} else {
+		task.Arg1, task.Arg2 = args[0], args[1]
 	}
 	slog.Info("ExpressionService.createTaskForSpareNode: Task created", "task", task)
-	return task, nil
+	return task
 }
 
 func (s ExpressionService) getOperationTime(operation string) time.Duration {
 	switch operation {
-	case "+":
+	case "+", "+%":
 		return s.timeConfig.TimeAdd
-	case "-":
+	case "-", "-%":
 		return s.timeConfig.TimeSub
 	case "*":
 		return s.timeConfig.TimeMul
 	case "/":
 		return s.timeConfig.TimeDiv
+	case "pmt", "fv", "npv":
+		return s.timeConfig.TimeFinance
+	case "fact":
+		return s.timeConfig.TimeFactorial
+	case "nCr", "nPr":
+		return s.timeConfig.TimeCombinatorics
+	case "gcd", "lcm", "isprime":
+		return s.timeConfig.TimeNumberTheory
+	case "sum", "mean", "median", "stddev":
+		return s.timeConfig.TimeAggregate
+	case "dot", "det":
+		return s.timeConfig.TimeMatrix
 	default:
 		return 0
 	}
@@ -139,107 +347,400 @@ func (s *ExpressionService) GetExpressionByID(id int, user_id int) (models.Expre
 	} else if err != nil {
 		return expression, err
 	}
+	dependencies, err := s.storage.GetDependencies(id)
+	if err != nil {
+		return expression, err
+	}
+	if len(dependencies) > 0 {
+		expression.DependsOn = dependencies
+	}
 	return expression, nil
 }
 
-// Если задача не будет решена, то установит статус в ожидании.
-// Может создавать гонку, пока не использую
-func (s *ExpressionService) setTimerToTask(task models.Task) {
-	timer := time.NewTimer(task.OperationTime + 3*time.Second)
-	<-timer.C
-	task, _ = s.storage.GetTask(task.ID)
-	if task.Status == "in progress" {
-		slog.Warn("Reset task because it was not solved")
-		task.Status = "pending"
-		s.storage.SaveTask(&task)
+// Отмена выражения. Ожидающие задачи удаляются, а результаты задач, которые уже считают агенты, будут отброшены.
+// Отменить можно только выражение, которое еще считается
+func (s *ExpressionService) CancelExpression(id int, user_id int) (models.Expression, error) {
+	var expression models.Expression
+	err := s.inTx(func(tx *ExpressionService) error {
+		var err error
+		expression, err = tx.GetExpressionByID(id, user_id)
+		if err != nil {
+			return err
+		}
+		if expression.Status.Finished() {
+			return ErrExpressionFinished
+		}
+		if err := expression.SetStatus(models.ExpressionCancelled); err != nil {
+			return transitionError(err)
+		}
+		if err := tx.finish(&expression); err != nil {
+			return err
+		}
+		if _, err := tx.storage.SaveExpression(&expression); err != nil {
+			slog.Error("ExpressionService.CancelExpression: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if err := tx.storage.CancelTasksByExpressionID(expression.ID); err != nil {
+			slog.Error("ExpressionService.CancelExpression: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		return nil
+	})
+	if err != nil {
+		return expression, err
 	}
+	slog.Info("ExpressionService.CancelExpression: expression cancelled", "expression_id", expression.ID)
+	return expression, nil
 }
 
-// Этот метод раздает задачу, которая ждет отправки
-func (s *ExpressionService) GetPendingTask() (models.Task, error) {
-	task, err := s.storage.GetPendingTask()
-	if errors.Is(err, storage.ErrItemNotFound) {
-		return task, ErrPendingTaskNotFount
-	}
-	task.Status = "in progress"
-	_, err = s.storage.SaveTask(&task)
+// ID задач агента agentID, выражения которых отменены. Агент может бросить их, не досчитывая
+func (s *ExpressionService) CancelledTasks(agentID string) ([]int, error) {
+	tasks, err := s.storage.GetCancelledTasks(agentID)
 	if err != nil {
-		return task, ErrStorage
+		slog.Error("ExpressionService.CancelledTasks: error in storage", "error", err.Error())
+		return nil, ErrStorage
 	}
-	// go s.setTimerToTask(task)
-	return task, nil
+	ids := make([]int, 0, len(tasks))
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	return ids, nil
 }
 
-// Обработка входящей задачи. Или по другому: запускается когда агент отправляет результат задачи
-func (s *ExpressionService) ProcessIncomingTask(task_id int, result float64) error {
-	task, err := s.storage.GetTask(task_id)
-	if errors.Is(err, storage.ErrItemNotFound) {
-		return ErrTaskNotFound
-	} else if err != nil {
-		slog.Error("ExpressionService.ProcessIncomingTask: error in storage", "error", err.Error())
-		return err
+// Локаль из запроса, если ее нет - из настроек пользователя, а если и там пусто - по умолчанию
+func (s *ExpressionService) ResolveLocale(name string, user_id int) (calculation.Locale, error) {
+	if name == "" {
+		user, err := s.storage.GetUserByID(user_id)
+		if err != nil && !errors.Is(err, storage.ErrItemNotFound) {
+			slog.Error("ExpressionService.ResolveLocale: error in storage", "error", err.Error())
+			return calculation.Locale{}, ErrStorage
+		}
+		name = user.Locale
 	}
-	// Если воркер долго решал задачу и она ушла новому, но старый все же отправил решение
-	if task.Status == "done" {
-		slog.Warn("ExpressionService.ProcessIncomingTask: receive task that already solved")
-		return nil
+	if name == "" {
+		name = calculation.DefaultLocale
 	}
-	task.Status = "done"
-	_, err = s.storage.SaveTask(&task)
-	if err != nil {
-		slog.Error("ExpressionService.ProcessIncomingTask: error in storage", "error", err.Error())
-		return ErrStorage
+	locale, ok := calculation.LookupLocale(name)
+	if !ok {
+		return locale, calculation.ErrUnknownLocale
+	}
+	return locale, nil
+}
+
+// Заполняет результат в формате локали. У нерешенных выражений форматировать нечего
+func FormatExpression(expression *models.Expression, locale calculation.Locale) {
+	if expression.Status != models.ExpressionSolved {
+		return
+	}
+	if expression.Value != nil {
+		expression.FormattedValue = locale.FormatValue(expression.Value)
+	} else {
+		expression.FormattedResult = locale.FormatNumber(expression.Result)
+	}
+}
+
+// Случайный токен выдачи задачи. Угадать его, чтобы подсунуть чужой результат, нельзя
+func newAttemptToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Фоновый сборщик: раз в interval возвращает в очередь задачи, агенты которых не успели прислать результат,
+// и закрывает выражения с истекшим сроком. Работает до Close
+func (s *ExpressionService) RunLeaseReaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.ReleaseExpiredLeases()
+			s.FailExpiredExpressions()
+		}
 	}
-	expression, err := s.storage.GetExpression(task.ExpressionID)
+}
+
+// Возвращает в очередь задачи с истекшей арендой, каждую следующую попытку после паузы подольше.
+// Задачи, у которых попытки кончились, уходят в dead-letter. Возвращает, сколько задач вернулось в очередь
+func (s *ExpressionService) ReleaseExpiredLeases() (int, error) {
+	released := 0
+	var dead []int
+	err := s.inTx(func(tx *ExpressionService) error {
+		tasks, err := tx.storage.GetExpiredTasks(tx.now())
+		if err != nil {
+			slog.Error("ExpressionService.ReleaseExpiredLeases: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		for _, task := range tasks {
+			isDead, err := tx.retryTask(task)
+			if err != nil {
+				return err
+			}
+			if isDead {
+				dead = append(dead, task.ID)
+			} else {
+				released++
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		slog.Error("ExpressionService.ProcessIncomingTask: error in storage", "error", err.Error())
-		return ErrStorage
+		return 0, err
 	}
-	// Здесь самое интересное. Когда пришел результат задачи, мы заменяем вершину задачи на результат...
-	parent_task_node, node := expression.BinaryTree.FindParentAndNodeByTaskID(task_id)
-	if node == nil {
-		// У меня тут фантомно спотыкается программа.
-		// Ошибка из-за кривого sqlite. Щас должно быть все ок (пожалуйста)
-		s.closeExpressionWithError(&expression, "task_id not found. critical error")
-		return ErrService
+	if released > 0 {
+		slog.Warn("ExpressionService.ReleaseExpiredLeases: tasks returned to queue", "count", released)
+	}
+	if len(dead) > 0 {
+		slog.Error("ExpressionService.ReleaseExpiredLeases: tasks moved to dead-letter", "task_ids", dead)
 	}
-	expression.BinaryTree.ReplaceNodeWithValue(node, result)
-	if parent_task_node == nil {
-		// ... если у вершины нет родителя, то это значит, что это корень дерева и выражение решено
-		s.solveExpression(&expression, result)
+	return released, nil
+}
+
+// Задача, которую агент не вернул: если попытки кончились, она уходит в dead-letter (тогда возвращает true),
+// иначе снова встает в очередь после паузы retryBackoff. Так решают и сборщик, и восстановление
+func (s *ExpressionService) retryTask(task models.Task) (bool, error) {
+	if s.timeConfig.MaxAttempts > 0 && task.Attempts >= s.timeConfig.MaxAttempts {
+		return true, s.deadLetterTask(task)
+	}
+	if err := s.recordEvent(task, "expired", nil); err != nil {
+		return false, err
+	}
+	if err := task.SetStatus(models.TaskPending); err != nil {
+		return false, transitionError(err)
+	}
+	task.LeaseUntil = time.Time{}
+	task.AgentID = ""
+	task.AvailableAt = time.Time{}
+	if delay := s.retryBackoff(task.Attempts); delay > 0 {
+		task.AvailableAt = s.now().Add(delay)
+	}
+	if _, err := s.storage.SaveTask(&task); err != nil {
+		slog.Error("ExpressionService.retryTask: error in storage", "error", err.Error())
+		return false, ErrStorage
+	}
+	return false, nil
+}
+
+// Пауза перед следующей выдачей задачи, которую выдавали attempts раз
+func (s *ExpressionService) retryBackoff(attempts int) time.Duration {
+	return backoff.Doubling(s.timeConfig.RetryBackoff, s.timeConfig.RetryBackoffMax, attempts)
+}
+
+// Закрывает с ошибкой timeout выражения, не решенные в срок. Их задачи удаляются, поэтому результаты больше не принимаются
+func (s *ExpressionService) FailExpiredExpressions() (int, error) {
+	var failed []int
+	err := s.inTx(func(tx *ExpressionService) error {
+		expressions, err := tx.storage.GetExpiredExpressions(tx.now())
+		if err != nil {
+			slog.Error("ExpressionService.FailExpiredExpressions: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		for _, expired := range expressions {
+			// Выражение могло закрыться в этом же проходе вместе с тем, на которое ссылается
+			expression, err := tx.storage.GetExpression(expired.ID)
+			if err != nil {
+				slog.Error("ExpressionService.FailExpiredExpressions: error in storage", "error", err.Error())
+				return ErrStorage
+			}
+			if expression.Status.Finished() {
+				continue
+			}
+			if err := tx.closeExpressionWithError(&expression, models.ErrorCodeTimeout, "timeout"); err != nil {
+				return err
+			}
+			failed = append(failed, expression.ID)
+		}
 		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(failed) > 0 {
+		slog.Warn("ExpressionService.FailExpiredExpressions: expressions timed out", "expression_ids", failed)
 	}
-	// ... и проверяем, можно ли из родителя сделать задачу
-	if parent_task_node.IsSpare() {
-		new_task, err := s.createTaskForSpareNode(parent_task_node, &expression)
-		if errors.Is(err, ErrZeroDivisionTask) {
-			s.closeExpressionWithError(&expression, "division by zero")
+	return len(failed), nil
+}
+
+// Этот метод раздает задачу, которая ждет отправки
+func (s *ExpressionService) GetPendingTask() (models.Task, error) {
+	return s.ClaimPendingTask("")
+}
+
+// Обработка входящей задачи. Или по другому: запускается когда агент отправляет результат задачи
+func (s *ExpressionService) ProcessIncomingTask(task_id int, token string, result float64) error {
+	// Отметка о решении задачи, новое дерево и задачи для следующих вершин сохраняются вместе.
+	// Иначе падение между шагами оставит в дереве ссылки на задачи, которых нет
+	critical := false
+	cancelled := false
+	timedOut := false
+	err := s.inTx(func(tx *ExpressionService) error {
+		task, err := tx.storage.GetTask(task_id)
+		if errors.Is(err, storage.ErrItemNotFound) {
+			return ErrTaskNotFound
+		} else if err != nil {
+			slog.Error("ExpressionService.ProcessIncomingTask: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if err := tx.checkAttempt(task, token); errors.Is(err, ErrExpressionCancelled) {
+			// Выражение отменили, пока агент считал. Результат не нужен, а задача больше не нужна агенту
+			cancelled = true
+			if err := tx.storage.DeleteTask(task_id); err != nil {
+				slog.Error("ExpressionService.ProcessIncomingTask: error in storage", "error", err.Error())
+				return ErrStorage
+			}
+			return nil
 		} else if err != nil {
-			slog.Error("ExpressionService.ProcessExpression: error in service", "error", err.Error())
-			return ErrService
+			return err
+		}
+		// Принимаем ровно один результат
+		completed, err := tx.storage.CompleteTask(task_id, token, tx.now())
+		if err != nil {
+			slog.Error("ExpressionService.ProcessIncomingTask: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if !completed {
+			return ErrDuplicateResult
+		}
+		if err := tx.recordEvent(task, "completed", &result); err != nil {
+			return err
+		}
+		tx.checkpoint("task completed")
+
+		expression, err := tx.storage.GetExpression(task.ExpressionID)
+		if err != nil {
+			slog.Error("ExpressionService.ProcessIncomingTask: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		// Сборщик еще не успел закрыть выражение, но срок уже вышел
+		if tx.expired(expression) {
+			timedOut = true
+			return tx.closeExpressionWithError(&expression, models.ErrorCodeTimeout, "timeout")
+		}
+		// Здесь самое интересное. Когда пришел результат задачи, мы заменяем вершину задачи на результат...
+		_, node := expression.BinaryTree.FindParentAndNodeByTaskID(task_id)
+		if node == nil {
+			// С транзакциями такого быть не должно, но если дерево все же испорчено,
+			// выражение закрываем, а не отдаем задачу по кругу
+			critical = true
+			return tx.closeExpressionWithError(&expression, models.ErrorCodeInternal, "task_id not found. critical error")
 		}
-		_, err = s.storage.SaveTask(&new_task)
+		tx.cacheResult(node, result)
+		expression.BinaryTree.ReplaceNodeWithValue(node, result)
+		tx.publishTaskCompleted(expression, task.ID, result)
+		// ... и двигаем выражение дальше: родитель мог стать свободным, а если посчитан корень, то выражение решено
+		err = tx.advanceExpression(&expression)
 		if err != nil {
-			slog.Error("ExpressionService.ProcessExpression: error in storage", "error", err.Error())
+			slog.Error("ExpressionService.ProcessIncomingTask: error in service", "error", err.Error())
+			return err
+		}
+		tx.checkpoint("tasks created")
+		_, err = tx.storage.SaveExpression(&expression)
+		if err != nil {
+			slog.Error("ExpressionService.ProcessIncomingTask: error in storage", "error", err.Error())
 			return ErrStorage
 		}
-		parent_task_node.TaskID = new_task.ID
+		if !expression.Status.Finished() {
+			tx.publish(events.TreeUpdated, expression)
+		}
+		return nil
+	})
+	if err == nil && critical {
+		return ErrService
 	}
-	_, err = s.storage.SaveExpression(&expression)
-	if err != nil {
+	if err == nil && cancelled {
+		return ErrExpressionCancelled
+	}
+	if err == nil && timedOut {
+		return ErrExpressionTimeout
+	}
+	return err
+}
+
+func (s *ExpressionService) closeExpressionWithError(expression *models.Expression, code string, message string) error {
+	if err := expression.Fail(code, message); err != nil {
+		return transitionError(err)
+	}
+	if err := s.finish(expression); err != nil {
 		return err
 	}
+	if _, err := s.storage.SaveExpression(expression); err != nil {
+		slog.Error("ExpressionService.closeExpressionWithError: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	if err := s.storage.DeleteTaskByExpressionID(expression.ID); err != nil {
+		slog.Error("ExpressionService.closeExpressionWithError: error in storage", "error", err.Error())
+		return ErrStorage
+	}
 	return nil
 }
 
-func (s *ExpressionService) closeExpressionWithError(expression *models.Expression, errorMsg string) {
-	expression.Status = "error " + errorMsg
-	s.storage.SaveExpression(expression)
-	s.storage.DeleteTaskByExpressionID(expression.ID)
+// Можно ли принять результат задачи, присланный с этим токеном
+func (s *ExpressionService) checkAttempt(task models.Task, token string) error {
+	// Задачу выдали заново, а прежний агент все же прислал решение
+	if token != task.AttemptToken {
+		slog.Warn("ExpressionService.ProcessIncomingTask: receive result from stale attempt", "task_id", task.ID)
+		return ErrStaleAttempt
+	}
+	// Тот же результат пришел второй раз, например агент повторил запрос
+	if task.Status == models.TaskDone {
+		slog.Warn("ExpressionService.ProcessIncomingTask: receive task that already solved", "task_id", task.ID)
+		return ErrDuplicateResult
+	}
+	if task.Status == models.TaskCancelled {
+		slog.Info("ExpressionService.ProcessIncomingTask: receive result for cancelled expression", "task_id", task.ID)
+		return ErrExpressionCancelled
+	}
+	// Аренда истекла: задача уже в очереди или скоро туда вернется, этот результат не принимаем.
+	// Иначе два агента могли бы по очереди записать результат одной задачи
+	if task.Status != models.TaskInProgress || s.now().After(task.LeaseUntil) {
+		slog.Warn("ExpressionService.ProcessIncomingTask: receive task with expired lease", "task_id", task.ID)
+		return ErrLeaseExpired
+	}
+	return nil
 }
 
-func (s *ExpressionService) solveExpression(expression *models.Expression, result float64) {
-	expression.Result = result
-	expression.Status = "solve"
-	s.storage.SaveExpression(expression)
+// Записывает в выражение значение корня. Сохраняет выражение вызывающий
+func (s *ExpressionService) solveExpression(expression *models.Expression, root *calculation.TreeNode) error {
+	if err := expression.SetStatus(models.ExpressionSolved); err != nil {
+		return transitionError(err)
+	}
+	if root.IsList() {
+		expression.Value = root.Value()
+	} else {
+		expression.Result = root.Value().(float64)
+	}
+	return s.finish(expression)
+}
+
+// Код ошибки для выражения, которое закрылось на проверке аргументов операции
+func operationErrorCode(err error) string {
+	switch {
+	case errors.Is(err, calculation.ErrZeroDivision):
+		return models.ErrorCodeDivisionByZero
+	case errors.Is(err, calculation.ErrInvalidArgument):
+		return models.ErrorCodeInvalidArgument
+	default:
+		return models.ErrorCodeInvalidOperation
+	}
+}
+
+// Запрещенный переход статуса - это ошибка в логике сервиса, а не во входных данных
+func transitionError(err error) error {
+	slog.Error("ExpressionService: invalid status transition", "error", err.Error())
+	return fmt.Errorf("%w: %w", ErrService, err)
+}
+
+// Запоминает, когда выражение перестало считаться. От этого считается затраченное время.
+// Решенное или закрытое с ошибкой выражение ставит в очередь вебхуки и двигает выражения, которые на него ссылаются
+func (s *ExpressionService) finish(expression *models.Expression) error {
+	finishedAt := s.now()
+	expression.FinishedAt = &finishedAt
+	if err := webhook.Enqueue(s.storage, *expression, finishedAt); err != nil {
+		slog.Error("ExpressionService.finish: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	s.publish(events.ExpressionFinished, *expression)
+	return s.notifyDependents(*expression)
 }
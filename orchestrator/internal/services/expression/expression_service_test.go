@@ -2,15 +2,17 @@ package expression
 
 import (
 	"testing"
+	"time"
 
 	"github.com/RichCake/calc_api_go/orchestrator/internal/config"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
 	"github.com/stretchr/testify/require"
 )
 
 func setUpService() *ExpressionService {
-	tc := config.TimeConfig{}
+	tc := config.TimeConfig{LeaseGrace: time.Minute}
 	storage := storage.NewStorage(true)
 	service := NewExpressionService(storage, tc)
 	return service
@@ -22,6 +24,9 @@ func TestService(t *testing.T) {
 	user_id := 1
 	service.storage.SaveUser(&models.User{ID: user_id, Login: "test"})
 
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
 	tests := []struct {
 		name           string
 		expression_str string
@@ -37,13 +42,37 @@ func TestService(t *testing.T) {
 				Arg1:          2.0,
 				Arg2:          2.0,
 				ExpressionID:  1,
+				UserID:        user_id,
 				Status:        "in progress",
 				Operation:     "+",
 				OperationTime: 0,
+				LeaseUntil:    now.Add(time.Minute),
+				Attempts:      1,
+				Priority:      PriorityNormal,
+				QueuedAt:      now.UTC(),
 			},
 			result:  4,
 			wantErr: false,
 		},
+		{
+			name:           "function expression",
+			expression_str: "pmt(0.01, 12, 1000)",
+			expected_task: models.Task{
+				ID:            2,
+				Args:          []float64{0.01, 12, 1000},
+				ExpressionID:  2,
+				UserID:        user_id,
+				Status:        "in progress",
+				Operation:     "pmt",
+				OperationTime: 0,
+				LeaseUntil:    now.Add(time.Minute),
+				Attempts:      1,
+				Priority:      PriorityNormal,
+				QueuedAt:      now.UTC(),
+			},
+			result:  88.85,
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -52,9 +81,12 @@ func TestService(t *testing.T) {
 			require.NoError(t, err)
 			newTask, err := service.GetPendingTask()
 			require.NoError(t, err)
+			// Токен выдачи случайный
+			require.NotEmpty(t, newTask.AttemptToken)
+			tt.expected_task.AttemptToken = newTask.AttemptToken
 			require.Equal(t, tt.expected_task, newTask)
 
-			err = service.ProcessIncomingTask(newTask.ID, tt.result)
+			err = service.ProcessIncomingTask(newTask.ID, newTask.AttemptToken, tt.result)
 			require.NoError(t, err)
 
 			newExpression, err := service.GetExpressionByID(expression_id, user_id)
@@ -63,3 +95,444 @@ func TestService(t *testing.T) {
 		})
 	}
 }
+
+func TestServiceAggregate(t *testing.T) {
+	service := setUpService()
+
+	user_id := 1
+	service.storage.SaveUser(&models.User{ID: user_id, Login: "test"})
+
+	expression_id, err := service.ProcessExpression("mean([1 + 1, 4, 6])", user_id)
+	require.NoError(t, err)
+
+	// Пока элемент списка не посчитан, агрегат ждет
+	task, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, "+", task.Operation)
+	_, err = service.GetPendingTask()
+	require.ErrorIs(t, err, ErrPendingTaskNotFount)
+	require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 2))
+
+	// Список целиком приходит агенту в args
+	task, err = service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, "mean", task.Operation)
+	require.Equal(t, []float64{2, 4, 6}, task.Args)
+	require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 4))
+
+	expression, err := service.GetExpressionByID(expression_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+	require.Equal(t, 4.0, expression.Result)
+}
+
+func TestServiceMatmul(t *testing.T) {
+	service := setUpService()
+
+	user_id := 1
+	service.storage.SaveUser(&models.User{ID: user_id, Login: "test"})
+
+	expression_id, err := service.ProcessExpression("matmul([[1, 2], [3, 4]], transpose([[5, 7], [6, 8]]))", user_id)
+	require.NoError(t, err)
+
+	// Каждая ячейка результата - отдельная задача dot
+	tasks := []models.Task{}
+	for {
+		task, err := service.GetPendingTask()
+		if err != nil {
+			require.ErrorIs(t, err, ErrPendingTaskNotFount)
+			break
+		}
+		require.Equal(t, "dot", task.Operation)
+		tasks = append(tasks, task)
+	}
+	require.Len(t, tasks, 4)
+
+	for _, task := range tasks {
+		half := len(task.Args) / 2
+		var result float64
+		for i := 0; i < half; i++ {
+			result += task.Args[i] * task.Args[half+i]
+		}
+		require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, result))
+	}
+
+	expression, err := service.GetExpressionByID(expression_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+	require.Equal(t, []any{[]any{19.0, 22.0}, []any{43.0, 50.0}}, expression.Value)
+}
+
+func TestServiceSolvesResolvedExpression(t *testing.T) {
+	service := setUpService()
+
+	user_id := 1
+	service.storage.SaveUser(&models.User{ID: user_id, Login: "test"})
+
+	// Агенту тут считать нечего: transpose выполняет сам оркестратор
+	expression_id, err := service.ProcessExpression("transpose([[1, 2]])", user_id)
+	require.NoError(t, err)
+
+	expression, err := service.GetExpressionByID(expression_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+	require.Equal(t, []any{[]any{1.0}, []any{2.0}}, expression.Value)
+}
+
+func TestServiceClosesExpressionWithInvalidArgs(t *testing.T) {
+	service := setUpService()
+
+	user_id := 1
+	service.storage.SaveUser(&models.User{ID: user_id, Login: "test"})
+
+	tests := []struct {
+		name           string
+		expression_str string
+		code           string
+		message        string
+	}{
+		{
+			name:           "division by zero",
+			expression_str: "2 / (1 - 1)",
+			code:           models.ErrorCodeDivisionByZero,
+			message:        "division by zero",
+		},
+		{
+			name:           "zero periods in pmt",
+			expression_str: "pmt(0.01, 0, 1000)",
+			code:           models.ErrorCodeInvalidArgument,
+			message:        "invalid function argument: pmt: number of periods must be positive",
+		},
+		{
+			name:           "k greater than n in nCr",
+			expression_str: "nCr(2, 5)",
+			code:           models.ErrorCodeInvalidArgument,
+			message:        "invalid function argument: nCr: k must not exceed n",
+		},
+		{
+			name:           "factorial of fraction",
+			expression_str: "(1 - 0.5)!",
+			code:           models.ErrorCodeInvalidArgument,
+			message:        "invalid function argument: fact: arguments must be non-negative integers",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expression_id, err := service.ProcessExpression(tt.expression_str, user_id)
+			require.NoError(t, err)
+
+			// Сначала решаем 1 - 1, после этого появится деление на ноль
+			if task, err := service.GetPendingTask(); err == nil {
+				require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, task.Arg1-task.Arg2))
+			}
+
+			newExpression, err := service.GetExpressionByID(expression_id, user_id)
+			require.NoError(t, err)
+			require.Equal(t, models.ExpressionError, newExpression.Status)
+			require.Equal(t, tt.code, newExpression.ErrorCode)
+			require.Equal(t, tt.message, newExpression.ErrorMessage)
+
+			_, err = service.GetPendingTask()
+			require.ErrorIs(t, err, ErrPendingTaskNotFount)
+		})
+	}
+}
+
+func TestServiceLocale(t *testing.T) {
+	service := setUpService()
+
+	user_id, err := service.storage.SaveUser(&models.User{Login: "test", Locale: "de"})
+	require.NoError(t, err)
+
+	// Локаль из настроек пользователя: запятая - десятичный разделитель
+	expression_id, err := service.ProcessExpression("1.000,5 × 2", user_id)
+	require.NoError(t, err)
+	task, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, "*", task.Operation)
+	require.Equal(t, 1000.5, task.Arg1)
+	require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 2001))
+
+	// Локаль запроса важнее настроек
+	_, err = service.ProcessExpressionWithLocale("1,5 + 1", user_id, "en")
+	require.ErrorIs(t, err, calculation.ErrInvalidSymbols)
+	_, err = service.ProcessExpressionWithLocale("1 + 1", user_id, "xx")
+	require.ErrorIs(t, err, calculation.ErrUnknownLocale)
+
+	expression, err := service.GetExpressionByID(expression_id, user_id)
+	require.NoError(t, err)
+	locale, err := service.ResolveLocale("", user_id)
+	require.NoError(t, err)
+	FormatExpression(&expression, locale)
+	require.Equal(t, "2.001", expression.FormattedResult)
+}
+
+func TestServiceLeaseExpires(t *testing.T) {
+	service := setUpService()
+
+	user_id := 1
+	service.storage.SaveUser(&models.User{ID: user_id, Login: "test"})
+
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	expression_id, err := service.ProcessExpression("2 + 2", user_id)
+	require.NoError(t, err)
+	task, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, now.Add(time.Minute), task.LeaseUntil)
+
+	// Пока аренда не истекла, задача остается за первым агентом
+	released, err := service.ReleaseExpiredLeases()
+	require.NoError(t, err)
+	require.Equal(t, 0, released)
+	_, err = service.GetPendingTask()
+	require.ErrorIs(t, err, ErrPendingTaskNotFount)
+
+	// Агент пропал, сборщик возвращает задачу в очередь
+	now = now.Add(2 * time.Minute)
+	released, err = service.ReleaseExpiredLeases()
+	require.NoError(t, err)
+	require.Equal(t, 1, released)
+
+	// Опоздавший результат первого агента не принимается
+	require.ErrorIs(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 4), ErrLeaseExpired)
+
+	redelivered, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, task.ID, redelivered.ID)
+	require.NoError(t, service.ProcessIncomingTask(redelivered.ID, redelivered.AttemptToken, 4))
+
+	expression, err := service.GetExpressionByID(expression_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+	require.Equal(t, 4.0, expression.Result)
+}
+
+func TestServiceRejectsResultAfterLeaseDeadline(t *testing.T) {
+	service := setUpService()
+
+	user_id := 1
+	service.storage.SaveUser(&models.User{ID: user_id, Login: "test"})
+
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	_, err := service.ProcessExpression("2 * 3", user_id)
+	require.NoError(t, err)
+	task, err := service.GetPendingTask()
+	require.NoError(t, err)
+
+	// Сборщик еще не успел сработать, но срок уже прошел
+	now = now.Add(2 * time.Minute)
+	require.ErrorIs(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 6), ErrLeaseExpired)
+}
+
+func TestServiceAcceptsOneResultPerTask(t *testing.T) {
+	service := setUpService()
+
+	user_id := 1
+	service.storage.SaveUser(&models.User{ID: user_id, Login: "test"})
+
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	expression_id, err := service.ProcessExpression("2 + 2", user_id)
+	require.NoError(t, err)
+	first, err := service.GetPendingTask()
+	require.NoError(t, err)
+
+	// Первый агент пропал, задачу выдали снова с новым токеном
+	now = now.Add(2 * time.Minute)
+	_, err = service.ReleaseExpiredLeases()
+	require.NoError(t, err)
+	second, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, first.ID, second.ID)
+	require.NotEqual(t, first.AttemptToken, second.AttemptToken)
+
+	require.ErrorIs(t, service.ProcessIncomingTask(first.ID, first.AttemptToken, 5), ErrStaleAttempt)
+	require.ErrorIs(t, service.ProcessIncomingTask(second.ID, "", 5), ErrStaleAttempt)
+	require.NoError(t, service.ProcessIncomingTask(second.ID, second.AttemptToken, 4))
+	require.ErrorIs(t, service.ProcessIncomingTask(second.ID, second.AttemptToken, 4), ErrDuplicateResult)
+	require.ErrorIs(t, service.ProcessIncomingTask(second.ID+1, second.AttemptToken, 4), ErrTaskNotFound)
+
+	expression, err := service.GetExpressionByID(expression_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, 4.0, expression.Result)
+}
+
+func TestServiceCancelExpression(t *testing.T) {
+	service := setUpService()
+
+	user_id := 1
+	service.storage.SaveUser(&models.User{ID: user_id, Login: "test"})
+
+	expression_id, err := service.ProcessExpression("(2 + 2) * (3 + 3)", user_id)
+	require.NoError(t, err)
+	leased, err := service.ClaimPendingTask("agent-1")
+	require.NoError(t, err)
+
+	_, err = service.CancelExpression(expression_id, user_id+1)
+	require.ErrorIs(t, err, ErrExpressionNotFound)
+
+	expression, err := service.CancelExpression(expression_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionCancelled, expression.Status)
+
+	// Ожидающая задача удалена, взятую агент может бросить
+	_, err = service.GetPendingTask()
+	require.ErrorIs(t, err, ErrPendingTaskNotFount)
+	ids, err := service.CancelledTasks("agent-1")
+	require.NoError(t, err)
+	require.Equal(t, []int{leased.ID}, ids)
+
+	// Опоздавший результат отбрасывается, задача удаляется
+	require.ErrorIs(t, service.ProcessIncomingTask(leased.ID, leased.AttemptToken, 4), ErrExpressionCancelled)
+	require.Empty(t, service.storage.GetTasks())
+	expression, err = service.GetExpressionByID(expression_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionCancelled, expression.Status)
+
+	_, err = service.CancelExpression(expression_id, user_id)
+	require.ErrorIs(t, err, ErrExpressionFinished)
+}
+
+func TestServiceExpressionTimeout(t *testing.T) {
+	service := setUpService()
+	service.timeConfig.DefaultTimeout = time.Minute
+	service.timeConfig.MaxTimeout = time.Hour
+
+	user_id := 1
+	service.storage.SaveUser(&models.User{ID: user_id, Login: "test"})
+
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	_, err := service.ProcessExpressionWithOptions("2 + 2", user_id, ProcessOptions{Timeout: 2 * time.Hour})
+	require.ErrorIs(t, err, ErrTimeoutTooLong)
+	_, err = service.ProcessExpressionWithOptions("2 + 2", user_id, ProcessOptions{Timeout: -time.Second})
+	require.ErrorIs(t, err, ErrInvalidTimeout)
+
+	// Срок сохраняется вместе с выражением
+	first_id, err := service.ProcessExpressionWithOptions("2 + 2", user_id, ProcessOptions{Timeout: 30 * time.Second})
+	require.NoError(t, err)
+	first, err := service.GetExpressionByID(first_id, user_id)
+	require.NoError(t, err)
+	require.True(t, first.Deadline.Equal(now.Add(30*time.Second)))
+	second_id, err := service.ProcessExpression("3 + 3", user_id)
+	require.NoError(t, err)
+	second, err := service.GetExpressionByID(second_id, user_id)
+	require.NoError(t, err)
+	require.True(t, second.Deadline.Equal(now.Add(time.Minute)))
+
+	task, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, first_id, task.ExpressionID)
+
+	// Результат после срока не принимается, выражение закрывается
+	now = now.Add(31 * time.Second)
+	require.ErrorIs(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 4), ErrExpressionTimeout)
+	first, err = service.GetExpressionByID(first_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionError, first.Status)
+	require.Equal(t, models.ErrorCodeTimeout, first.ErrorCode)
+
+	// Второе выражение закрывает сборщик
+	failed, err := service.FailExpiredExpressions()
+	require.NoError(t, err)
+	require.Equal(t, 0, failed)
+	now = now.Add(30 * time.Second)
+	failed, err = service.FailExpiredExpressions()
+	require.NoError(t, err)
+	require.Equal(t, 1, failed)
+	second, err = service.GetExpressionByID(second_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionError, second.Status)
+	require.Equal(t, models.ErrorCodeTimeout, second.ErrorCode)
+	require.Empty(t, service.storage.GetTasks())
+}
+
+// Имитирует падение процесса в точке step: паника обрывает переход посередине
+func crashAt(service *ExpressionService, step string) {
+	service.crashAt = func(current string) {
+		if current == step {
+			panic("crash at " + step)
+		}
+	}
+}
+
+func runUntilCrash(t *testing.T, fn func()) {
+	defer func() {
+		require.NotNil(t, recover(), "expected crash")
+	}()
+	fn()
+}
+
+func TestServiceCrashWhileProcessingExpression(t *testing.T) {
+	for _, step := range []string{"expression saved", "task created", "tasks created"} {
+		t.Run(step, func(t *testing.T) {
+			service := setUpService()
+			user_id := 1
+
+			crashAt(service, step)
+			runUntilCrash(t, func() {
+				service.ProcessExpression("(1 + 2) * (3 + 4)", user_id)
+			})
+
+			// Ни выражения, ни части его задач не осталось
+			expressions, err := service.GetExpressions(user_id)
+			require.NoError(t, err)
+			require.Empty(t, expressions)
+			require.Empty(t, service.storage.GetTasks())
+
+			service.crashAt = nil
+			_, err = service.ProcessExpression("(1 + 2) * (3 + 4)", user_id)
+			require.NoError(t, err)
+			require.Len(t, service.storage.GetTasks(), 2)
+		})
+	}
+}
+
+func TestServiceCrashWhileProcessingResult(t *testing.T) {
+	for _, step := range []string{"task completed", "task created", "tasks created"} {
+		t.Run(step, func(t *testing.T) {
+			service := setUpService()
+			user_id := 1
+
+			expression_id, err := service.ProcessExpression("(1 + 2) * 3", user_id)
+			require.NoError(t, err)
+			task, err := service.GetPendingTask()
+			require.NoError(t, err)
+			before, err := service.GetExpressionByID(expression_id, user_id)
+			require.NoError(t, err)
+
+			crashAt(service, step)
+			runUntilCrash(t, func() {
+				service.ProcessIncomingTask(task.ID, task.AttemptToken, 3)
+			})
+
+			// Задача все еще у агента, дерево и список задач не изменились
+			after, err := service.GetExpressionByID(expression_id, user_id)
+			require.NoError(t, err)
+			require.Equal(t, before, after)
+			tasks := service.storage.GetTasks()
+			require.Len(t, tasks, 1)
+			require.Equal(t, models.TaskInProgress, tasks[0].Status)
+
+			// Агент повторяет отправку, и выражение доходит до конца
+			service.crashAt = nil
+			require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 3))
+			task, err = service.GetPendingTask()
+			require.NoError(t, err)
+			require.Equal(t, "*", task.Operation)
+			require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 9))
+
+			expression, err := service.GetExpressionByID(expression_id, user_id)
+			require.NoError(t, err)
+			require.Equal(t, models.ExpressionSolved, expression.Status)
+			require.Equal(t, 9.0, expression.Result)
+		})
+	}
+}
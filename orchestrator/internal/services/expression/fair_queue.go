@@ -0,0 +1,88 @@
+package expression
+
+// Честная выдача задач между пользователями по алгоритму deficit round-robin.
+// Пользователи обходятся по кругу, на каждом круге пользователь получает кредит, равный своему весу,
+// и за каждую выданную задачу тратит единицу. Поэтому тот, кто отправил тысячи выражений,
+// не задерживает остальных дольше, чем на один круг
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
+)
+
+// Хранится по указателю, потому что сервис копируется в inTx
+type fairQueue struct {
+	mu      sync.Mutex
+	current int         // пользователь, которому выдавали последним
+	deficit map[int]int // неизрасходованный кредит пользователя на текущем круге
+	weights map[int]int // веса по user_id, логины из конфига переводим один раз
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{
+		deficit: map[int]int{},
+		weights: map[int]int{},
+	}
+}
+
+// Выбирает, чью задачу выдать. weights - веса пользователей, у которых есть задачи
+func (q *fairQueue) next(weights map[int]int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	users := make([]int, 0, len(weights))
+	waiting := map[int]bool{}
+	for user_id := range weights {
+		users = append(users, user_id)
+		waiting[user_id] = true
+	}
+	sort.Ints(users)
+	// Кредит не копится, пока задач нет, иначе пользователь потом займет агентов надолго
+	for user_id := range q.deficit {
+		if !waiting[user_id] {
+			delete(q.deficit, user_id)
+		}
+	}
+	if waiting[q.current] && q.deficit[q.current] > 0 {
+		q.deficit[q.current]--
+		return q.current
+	}
+	// Кредит текущего пользователя исчерпан, переходим к следующему по кругу
+	i := sort.SearchInts(users, q.current+1)
+	if i == len(users) {
+		i = 0
+	}
+	q.current = users[i]
+	q.deficit[q.current] += weights[q.current] - 1
+	return q.current
+}
+
+// Вес пользователя из FAIR_USER_WEIGHTS по логину, иначе вес по умолчанию. Меньше единицы не бывает
+func (s *ExpressionService) userWeight(user_id int) int {
+	s.fair.mu.Lock()
+	weight, ok := s.fair.weights[user_id]
+	s.fair.mu.Unlock()
+	if ok {
+		return weight
+	}
+
+	weight = s.timeConfig.DefaultUserWeight
+	user, err := s.storage.GetUserByID(user_id)
+	if err != nil && !errors.Is(err, storage.ErrItemNotFound) {
+		// Не запоминаем, в следующий раз попробуем снова
+		slog.Error("ExpressionService.userWeight: error in storage", "error", err.Error())
+		return max(weight, 1)
+	}
+	if w, ok := s.timeConfig.UserWeights[user.Login]; ok && err == nil {
+		weight = w
+	}
+	weight = max(weight, 1)
+	s.fair.mu.Lock()
+	s.fair.weights[user_id] = weight
+	s.fair.mu.Unlock()
+	return weight
+}
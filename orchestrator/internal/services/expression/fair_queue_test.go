@@ -0,0 +1,81 @@
+package expression
+
+import (
+	"testing"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFairQueueWeights(t *testing.T) {
+	queue := newFairQueue()
+	served := map[int]int{}
+	for range 40 {
+		served[queue.next(map[int]int{1: 3, 2: 1})]++
+	}
+	require.Equal(t, map[int]int{1: 30, 2: 10}, served)
+
+	// Пользователь без задач выпадает из круга и не копит кредит
+	require.Equal(t, 2, queue.next(map[int]int{2: 1}))
+	require.Equal(t, 2, queue.next(map[int]int{2: 1}))
+	require.Equal(t, 1, queue.next(map[int]int{1: 3, 2: 1}))
+}
+
+// Тяжелый пользователь завалил очередь, а задачи легкого все равно выдаются не позже,
+// чем через столько выдач, сколько пользователей ждут
+func TestServiceFairSchedulingLatency(t *testing.T) {
+	service := setUpService()
+	heavy, light := 1, 2
+
+	for range 300 {
+		_, err := service.ProcessExpression("1 + 1", heavy)
+		require.NoError(t, err)
+	}
+
+	maxWait := 0
+	for round := range 20 {
+		light_id, err := service.ProcessExpression("2 + 2", light)
+		require.NoError(t, err)
+		for wait := 1; ; wait++ {
+			task, err := service.GetPendingTask()
+			require.NoError(t, err)
+			if task.ExpressionID == light_id {
+				maxWait = max(maxWait, wait)
+				break
+			}
+			require.Equal(t, heavy, task.UserID)
+			require.Less(t, wait, 300, "light task starved in round %d", round)
+		}
+		// Между задачами легкого тяжелый тоже получает свое
+		for range 3 {
+			task, err := service.GetPendingTask()
+			require.NoError(t, err)
+			require.Equal(t, heavy, task.UserID)
+		}
+	}
+	require.LessOrEqual(t, maxWait, 2)
+}
+
+func TestServiceFairSchedulingWeights(t *testing.T) {
+	service := setUpService()
+	service.timeConfig.UserWeights = map[string]int{"alice": 3}
+
+	alice := &models.User{Login: "alice"}
+	bob := &models.User{Login: "bob"}
+	for _, user := range []*models.User{alice, bob} {
+		_, err := service.storage.SaveUser(user)
+		require.NoError(t, err)
+		for range 50 {
+			_, err := service.ProcessExpression("1 + 1", user.ID)
+			require.NoError(t, err)
+		}
+	}
+
+	served := map[int]int{}
+	for range 40 {
+		task, err := service.GetPendingTask()
+		require.NoError(t, err)
+		served[task.UserID]++
+	}
+	require.Equal(t, map[int]int{alice.ID: 30, bob.ID: 10}, served)
+}
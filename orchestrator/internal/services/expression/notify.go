@@ -0,0 +1,115 @@
+package expression
+
+// Уведомления об изменениях выражений. Подписчики - потоковые обработчики вроде SSE и запросы с ?wait=
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/events"
+)
+
+// Публикует событие выражения. В транзакции событие откладывается до коммита,
+// чтобы подписчики не увидели изменение, которое потом откатится
+func (s *ExpressionService) publish(eventType string, expression models.Expression) {
+	s.emit(events.Event{
+		Type:         eventType,
+		ExpressionID: expression.ID,
+		UserID:       expression.UserID,
+		Expression:   expression,
+	})
+}
+
+func (s *ExpressionService) publishTaskCompleted(expression models.Expression, task_id int, result float64) {
+	s.emit(events.Event{
+		Type:         events.TaskCompleted,
+		ExpressionID: expression.ID,
+		UserID:       expression.UserID,
+		TaskID:       task_id,
+		Result:       &result,
+		Expression:   expression,
+	})
+}
+
+func (s *ExpressionService) emit(event events.Event) {
+	event.Time = s.now()
+	if s.outbox != nil {
+		*s.outbox = append(*s.outbox, event)
+		return
+	}
+	s.broker.Publish(event)
+}
+
+// Подписка на события выражения пользователя. Вместе с подпиской возвращается текущее состояние выражения:
+// подписываемся раньше, чем читаем его, поэтому изменения между этими шагами не теряются
+func (s *ExpressionService) SubscribeExpression(id int, user_id int) (*events.Subscription, models.Expression, error) {
+	sub := s.broker.Subscribe(func(event events.Event) bool {
+		return event.ExpressionID == id && event.UserID == user_id
+	})
+	expression, err := s.GetExpressionByID(id, user_id)
+	if err != nil {
+		sub.Close()
+		return nil, expression, err
+	}
+	return sub, expression, nil
+}
+
+// Подписка на события всех выражений пользователя
+func (s *ExpressionService) SubscribeUser(user_id int) *events.Subscription {
+	return s.broker.Subscribe(func(event events.Event) bool {
+		return event.UserID == user_id
+	})
+}
+
+// Можно ли ждать результата столько времени. Проверяем до отправки выражения, чтобы не создавать его зря
+func (s *ExpressionService) ValidateWait(wait time.Duration) error {
+	if wait < 0 {
+		return ErrInvalidWait
+	}
+	if s.timeConfig.MaxWait > 0 && wait > s.timeConfig.MaxWait {
+		return ErrWaitTooLong
+	}
+	return nil
+}
+
+// Ждет, пока выражение решится, закроется с ошибкой или будет отменено, но не дольше wait.
+// Ждет уведомления о закрытии, а не опрашивает хранилище. Возвращает выражение в том состоянии,
+// в котором оно было, когда ожидание кончилось. Если ctx отменен раньше, возвращает ctx.Err()
+func (s *ExpressionService) WaitExpression(ctx context.Context, id int, user_id int, wait time.Duration) (models.Expression, error) {
+	if err := s.ValidateWait(wait); err != nil {
+		return models.Expression{}, err
+	}
+	sub, expression, err := s.SubscribeExpression(id, user_id)
+	if err != nil {
+		return expression, err
+	}
+	defer sub.Close()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for !expression.Status.Finished() {
+		select {
+		case <-ctx.Done():
+			return expression, ctx.Err()
+		case <-timer.C:
+			// Медленный подписчик мог пропустить событие, поэтому напоследок читаем выражение заново
+			return s.GetExpressionByID(id, user_id)
+		case <-sub.Lagged:
+			// События терялись, и закрытие могло быть среди них
+			sub.Drain()
+			expression, err = s.GetExpressionByID(id, user_id)
+			if err != nil {
+				return expression, err
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				slog.Info("ExpressionService.WaitExpression: broker closed", "expression_id", id)
+				return expression, nil
+			}
+			expression = event.Expression
+		}
+	}
+	return expression, nil
+}
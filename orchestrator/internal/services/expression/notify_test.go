@@ -0,0 +1,115 @@
+package expression
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/events"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServicePublishesEvents(t *testing.T) {
+	service := setUpService()
+	user_id := 1
+
+	sub := service.SubscribeUser(user_id)
+	defer sub.Close()
+	other := service.SubscribeUser(user_id + 1)
+	defer other.Close()
+
+	id, err := service.ProcessExpression("2 + 2 * 2", user_id)
+	require.NoError(t, err)
+	expressionSub, expression, err := service.SubscribeExpression(id, user_id)
+	require.NoError(t, err)
+	defer expressionSub.Close()
+	require.Equal(t, models.ExpressionProcessing, expression.Status)
+	_, _, err = service.SubscribeExpression(id, user_id+1)
+	require.ErrorIs(t, err, ErrExpressionNotFound)
+
+	// Падение посреди обработки откатывает транзакцию, и событие о нем никто не получает
+	task, err := service.GetPendingTask()
+	require.NoError(t, err)
+	crashAt(service, "tasks created")
+	runUntilCrash(t, func() {
+		service.ProcessIncomingTask(task.ID, task.AttemptToken, 4)
+	})
+	service.crashAt = nil
+
+	require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 4))
+	task, err = service.GetPendingTask()
+	require.NoError(t, err)
+	require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 6))
+
+	received := func(sub *events.Subscription) []string {
+		types := []string{}
+		for len(sub.C) > 0 {
+			event := <-sub.C
+			require.Equal(t, id, event.ExpressionID)
+			types = append(types, event.Type)
+		}
+		return types
+	}
+	require.Equal(t, []string{
+		events.ExpressionCreated,
+		events.TaskCompleted, events.TreeUpdated,
+		events.TaskCompleted, events.ExpressionFinished,
+	}, received(sub))
+	require.Equal(t, []string{
+		events.TaskCompleted, events.TreeUpdated,
+		events.TaskCompleted, events.ExpressionFinished,
+	}, received(expressionSub))
+	require.Empty(t, other.C)
+
+	expression, err = service.GetExpressionByID(id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, 6.0, expression.Result)
+}
+
+func TestServiceWaitExpression(t *testing.T) {
+	service := setUpService()
+	service.timeConfig.MaxWait = time.Minute
+	user_id := 1
+	ctx := context.Background()
+
+	require.ErrorIs(t, service.ValidateWait(-time.Second), ErrInvalidWait)
+	require.ErrorIs(t, service.ValidateWait(2*time.Minute), ErrWaitTooLong)
+	_, err := service.WaitExpression(ctx, 1, user_id, 2*time.Minute)
+	require.ErrorIs(t, err, ErrWaitTooLong)
+
+	id, err := service.ProcessExpression("2 + 2", user_id)
+	require.NoError(t, err)
+	_, err = service.WaitExpression(ctx, id, user_id+1, time.Second)
+	require.ErrorIs(t, err, ErrExpressionNotFound)
+
+	// Срок вышел, выражение еще считается
+	expression, err := service.WaitExpression(ctx, id, user_id, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionProcessing, expression.Status)
+
+	// Запрос отменили раньше срока
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = service.WaitExpression(cancelled, id, user_id, time.Second)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Агент присылает результат, пока мы ждем
+	task, err := service.GetPendingTask()
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		service.ProcessIncomingTask(task.ID, task.AttemptToken, 4)
+	}()
+	started := time.Now()
+	expression, err = service.WaitExpression(ctx, id, user_id, 5*time.Second)
+	require.NoError(t, err)
+	require.Less(t, time.Since(started), time.Second)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+	require.Equal(t, 4.0, expression.Result)
+
+	// Законченное выражение возвращается сразу
+	expression, err = service.WaitExpression(ctx, id, user_id, 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+}
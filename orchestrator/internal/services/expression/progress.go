@@ -0,0 +1,74 @@
+package expression
+
+// Ход решения выражения: сколько задач решено, сколько считается и сколько еще ждать
+
+import (
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
+)
+
+// Прогресс выражения. Решенные вершины в дереве уже заменены числами,
+// поэтому все, что осталось в дереве от операций, - это еще не решенные задачи
+func (s *ExpressionService) Progress(expression models.Expression) (models.Progress, error) {
+	remaining := 0
+	if expression.BinaryTree != nil {
+		remaining = expression.BinaryTree.CountTasks()
+	}
+	progress := models.Progress{
+		// У выражений, отправленных до появления счетчика, общее число задач не сохранено
+		TotalTasks: max(expression.TotalTasks, remaining),
+	}
+	progress.Completed = progress.TotalTasks - remaining
+
+	end := s.now()
+	if expression.FinishedAt != nil {
+		end = *expression.FinishedAt
+	}
+	if !expression.CreatedAt.IsZero() {
+		progress.ElapsedMS = max(end.Sub(expression.CreatedAt), 0).Milliseconds()
+	}
+
+	if progress.TotalTasks > 0 {
+		percent := float64(progress.Completed) * 100 / float64(progress.TotalTasks)
+		progress.Percent = math.Round(percent*10) / 10
+	} else if expression.Status == models.ExpressionSolved {
+		progress.Percent = 100
+	}
+
+	// У законченного выражения оставшиеся задачи считаться уже не будут
+	if expression.Status.Finished() {
+		return progress, nil
+	}
+	tasks, err := s.storage.GetTasksByExpressionID(expression.ID)
+	if err != nil {
+		slog.Error("ExpressionService.Progress: error in storage", "error", err.Error())
+		return progress, ErrStorage
+	}
+	running := map[int]models.Task{}
+	for _, task := range tasks {
+		if task.Status == models.TaskInProgress {
+			running[task.ID] = task
+		}
+	}
+	progress.InProgress = len(running)
+	progress.Pending = max(remaining-progress.InProgress, 0)
+
+	eta := expression.BinaryTree.CriticalPath(func(node *calculation.TreeNode) time.Duration {
+		if task, ok := running[node.TaskID]; ok {
+			return s.remainingTime(task)
+		}
+		return s.getOperationTime(node.Val)
+	})
+	progress.ETAMS = eta.Milliseconds()
+	return progress, nil
+}
+
+// Сколько агенту осталось считать задачу. Аренда выдается на время операции с запасом LeaseGrace
+func (s *ExpressionService) remainingTime(task models.Task) time.Duration {
+	started := task.LeaseUntil.Add(-task.OperationTime - s.timeConfig.LeaseGrace)
+	return min(max(task.OperationTime-s.now().Sub(started), 0), task.OperationTime)
+}
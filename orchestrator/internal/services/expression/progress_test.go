@@ -0,0 +1,64 @@
+package expression
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceProgress(t *testing.T) {
+	service := setUpService()
+	service.timeConfig.TimeAdd = time.Second
+	service.timeConfig.TimeSub = time.Second
+	service.timeConfig.TimeMul = 3 * time.Second
+	user_id := 1
+
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	id, err := service.ProcessExpression("(1 + 2) * (3 + 4) - 5", user_id)
+	require.NoError(t, err)
+	progress := func() models.Progress {
+		expression, err := service.GetExpressionByID(id, user_id)
+		require.NoError(t, err)
+		progress, err := service.Progress(expression)
+		require.NoError(t, err)
+		return progress
+	}
+
+	// Сложения идут параллельно, потом умножение и вычитание: 1 + 3 + 1 секунды
+	require.Equal(t, models.Progress{TotalTasks: 4, Pending: 4, ETAMS: 5000}, progress())
+
+	first, err := service.GetPendingTask()
+	require.NoError(t, err)
+	now = now.Add(400 * time.Millisecond)
+	second, err := service.GetPendingTask()
+	require.NoError(t, err)
+	now = now.Add(500 * time.Millisecond)
+	// Первому сложению осталось 100 мс, второму 500 мс
+	require.Equal(t, models.Progress{TotalTasks: 4, InProgress: 2, Pending: 2, ElapsedMS: 900, ETAMS: 4500}, progress())
+
+	require.NoError(t, service.ProcessIncomingTask(first.ID, first.AttemptToken, 3))
+	require.NoError(t, service.ProcessIncomingTask(second.ID, second.AttemptToken, 7))
+	require.Equal(t, models.Progress{TotalTasks: 4, Completed: 2, Pending: 2, Percent: 50, ElapsedMS: 900, ETAMS: 4000}, progress())
+
+	for range 2 {
+		task, err := service.GetPendingTask()
+		require.NoError(t, err)
+		now = now.Add(time.Second)
+		result := task.Arg1 * task.Arg2
+		if task.Operation == "-" {
+			result = task.Arg1 - task.Arg2
+		}
+		require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, result))
+	}
+	// После решения время больше не идет
+	now = now.Add(time.Minute)
+	expression, err := service.GetExpressionByID(id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+	require.Equal(t, 16.0, expression.Result)
+	require.Equal(t, models.Progress{TotalTasks: 4, Completed: 4, Percent: 100, ElapsedMS: 2900}, progress())
+}
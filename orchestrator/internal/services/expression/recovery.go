@@ -0,0 +1,228 @@
+package expression
+
+// Восстановление после перезапуска оркестратора.
+// Задачи, которые агенты взяли до остановки, и выражения, застрявшие в "processing",
+// сами по себе никто не пересмотрит, поэтому при старте проходим по хранилищу и чиним их
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
+)
+
+// Что было исправлено при восстановлении
+type RecoveryReport struct {
+	StartedAt time.Time `json:"started_at"`
+	// Задачи, которые вернулись в очередь: аренды нет или она истекла, либо результат потерян
+	RequeuedTasks []int `json:"requeued_tasks"`
+	// Задачи с истекшей арендой, у которых кончились попытки. Они ушли в dead-letter
+	DeadTasks []int `json:"dead_tasks"`
+	// Задачи закрытых выражений и задачи, на которые не ссылается дерево
+	DeletedTasks []int `json:"deleted_tasks"`
+	// Задачи, созданные заново для свободных вершин
+	RecreatedTasks []int `json:"recreated_tasks"`
+	// Выражения, которые при восстановлении решились или закрылись с ошибкой
+	FinishedExpressions []int `json:"finished_expressions"`
+}
+
+func (r RecoveryReport) Empty() bool {
+	return len(r.RequeuedTasks) == 0 && len(r.DeadTasks) == 0 && len(r.DeletedTasks) == 0 &&
+		len(r.RecreatedTasks) == 0 && len(r.FinishedExpressions) == 0
+}
+
+// Последний отчет. Хранится по указателю, потому что сервис копируется в inTx
+type recoveryLog struct {
+	mu     sync.Mutex
+	report *RecoveryReport
+}
+
+// Последний отчет о восстановлении, nil если восстановления еще не было
+func (s *ExpressionService) LastRecovery() *RecoveryReport {
+	s.recovery.mu.Lock()
+	defer s.recovery.mu.Unlock()
+	return s.recovery.report
+}
+
+// Проходит по задачам и выражениям в хранилище и чинит все, что осталось от прошлого запуска.
+// Все исправления применяются в одной транзакции
+func (s *ExpressionService) Recover() (RecoveryReport, error) {
+	report := RecoveryReport{
+		StartedAt:           s.now(),
+		RequeuedTasks:       []int{},
+		DeadTasks:           []int{},
+		DeletedTasks:        []int{},
+		RecreatedTasks:      []int{},
+		FinishedExpressions: []int{},
+	}
+	err := s.inTx(func(tx *ExpressionService) error {
+		return tx.recover(&report)
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if report.Empty() {
+		slog.Info("ExpressionService.Recover: nothing to repair")
+	} else {
+		slog.Warn("ExpressionService.Recover: storage repaired",
+			"requeued_tasks", report.RequeuedTasks,
+			"dead_tasks", report.DeadTasks,
+			"deleted_tasks", report.DeletedTasks,
+			"recreated_tasks", report.RecreatedTasks,
+			"finished_expressions", report.FinishedExpressions,
+		)
+	}
+	s.recovery.mu.Lock()
+	s.recovery.report = &report
+	s.recovery.mu.Unlock()
+	return report, nil
+}
+
+func (s *ExpressionService) recover(report *RecoveryReport) error {
+	expressions, err := s.storage.GetExpressionsByStatus(models.ExpressionProcessing)
+	if err != nil {
+		slog.Error("ExpressionService.Recover: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	processing := map[int]*models.Expression{}
+	for i := range expressions {
+		processing[expressions[i].ID] = &expressions[i]
+	}
+
+	tasksBefore := map[int]models.Task{}
+	for _, task := range s.storage.GetTasks() {
+		tasksBefore[task.ID] = task
+		// Задача из dead-letter закрывает выражение и удаляет его задачи, пока мы идем по списку
+		current, err := s.storage.GetTask(task.ID)
+		if errors.Is(err, storage.ErrItemNotFound) {
+			continue
+		} else if err != nil {
+			slog.Error("ExpressionService.Recover: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if err := s.recoverTask(current, processing[current.ExpressionID], report); err != nil {
+			return err
+		}
+	}
+
+	for _, expression := range expressions {
+		// Срез загружен до прохода, а закрытие одного выражения закрывает и зависимые от него.
+		// Поэтому каждое выражение читается заново
+		current, err := s.storage.GetExpression(expression.ID)
+		if err != nil {
+			slog.Error("ExpressionService.Recover: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if current.Status.Finished() {
+			report.FinishedExpressions = append(report.FinishedExpressions, current.ID)
+			continue
+		}
+		if err := s.recoverExpression(current, report); err != nil {
+			return err
+		}
+	}
+
+	for _, task := range s.storage.GetTasks() {
+		if _, ok := tasksBefore[task.ID]; !ok {
+			report.RecreatedTasks = append(report.RecreatedTasks, task.ID)
+		}
+	}
+	return nil
+}
+
+// expression - выражение задачи, если оно еще считается, иначе nil
+func (s *ExpressionService) recoverTask(task models.Task, expression *models.Expression, report *RecoveryReport) error {
+	var node *calculation.TreeNode
+	if expression != nil {
+		_, node = expression.BinaryTree.FindParentAndNodeByTaskID(task.ID)
+	}
+
+	switch {
+	case task.Status == models.TaskDead:
+		// Задачи из dead-letter разбирает администратор
+		return nil
+	case task.Status == models.TaskDone && node != nil && !node.IsResolved():
+		// Результат принят, но до дерева не дошел. Решенную задачу в очередь не вернуть:
+		// удаляем ее, а restoreTasks создаст для вершины новую
+		return s.deleteTask(task, report)
+	case task.Status == models.TaskDone:
+		return nil
+	case node == nil || node.IsResolved():
+		// Выражение закрыто или задача ему больше не нужна
+		return s.deleteTask(task, report)
+	case task.Status == models.TaskInProgress && (task.LeaseUntil.IsZero() || s.now().After(task.LeaseUntil)):
+		// Агент пропал вместе с прошлым запуском. Решаем так же, как сборщик: повтор после паузы или dead-letter
+		return s.requeueTask(task, report)
+	}
+	return nil
+}
+
+func (s *ExpressionService) deleteTask(task models.Task, report *RecoveryReport) error {
+	if err := s.storage.DeleteTask(task.ID); err != nil {
+		slog.Error("ExpressionService.Recover: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	report.DeletedTasks = append(report.DeletedTasks, task.ID)
+	return nil
+}
+
+func (s *ExpressionService) requeueTask(task models.Task, report *RecoveryReport) error {
+	isDead, err := s.retryTask(task)
+	if err != nil {
+		return err
+	}
+	if isDead {
+		report.DeadTasks = append(report.DeadTasks, task.ID)
+	} else {
+		report.RequeuedTasks = append(report.RequeuedTasks, task.ID)
+	}
+	return nil
+}
+
+// Вершины, чьих задач нет в хранилище, получают задачи заново
+func (s *ExpressionService) recoverExpression(expression models.Expression, report *RecoveryReport) error {
+	// Срок вышел, пока оркестратор стоял
+	if s.expired(expression) {
+		if err := s.closeExpressionWithError(&expression, models.ErrorCodeTimeout, "timeout"); err != nil {
+			return err
+		}
+		report.FinishedExpressions = append(report.FinishedExpressions, expression.ID)
+		return nil
+	}
+	if err := s.restoreTasks(&expression); err != nil {
+		return err
+	}
+	if expression.Status.Finished() {
+		report.FinishedExpressions = append(report.FinishedExpressions, expression.ID)
+	}
+	return nil
+}
+
+// Создает задачи заново для свободных вершин, чьих задач нет в хранилище, и сохраняет выражение
+func (s *ExpressionService) restoreTasks(expression *models.Expression) error {
+	for _, node := range expression.BinaryTree.FindSpareNodes() {
+		if node.TaskID == 0 {
+			continue
+		}
+		_, err := s.storage.GetTask(node.TaskID)
+		if errors.Is(err, storage.ErrItemNotFound) {
+			node.TaskID = 0
+		} else if err != nil {
+			slog.Error("ExpressionService.restoreTasks: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+	}
+	if err := s.advanceExpression(expression); err != nil {
+		return err
+	}
+	if _, err := s.storage.SaveExpression(expression); err != nil {
+		slog.Error("ExpressionService.restoreTasks: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	return nil
+}
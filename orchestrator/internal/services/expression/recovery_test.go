@@ -0,0 +1,143 @@
+package expression
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceRecover(t *testing.T) {
+	service := setUpService()
+	user_id := 1
+
+	// Агент взял задачу до перезапуска, а задача второй вершины потерялась
+	broken_id, err := service.ProcessExpression("(1 + 2) * (3 + 4)", user_id)
+	require.NoError(t, err)
+	orphaned, err := service.GetPendingTask()
+	require.NoError(t, err)
+	orphaned.LeaseUntil = time.Time{}
+	_, err = service.storage.SaveTask(&orphaned)
+	require.NoError(t, err)
+	lost, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.NoError(t, service.storage.DeleteTask(lost.ID))
+
+	// Выражение закрыто, а его задача осталась
+	closed_id, err := service.ProcessExpression("5 + 5", user_id)
+	require.NoError(t, err)
+	closed, err := service.storage.GetExpression(closed_id)
+	require.NoError(t, err)
+	closed.Status = models.ExpressionError
+	closed.ErrorMessage = "something went wrong"
+	_, err = service.storage.SaveExpression(&closed)
+	require.NoError(t, err)
+	leftover_id := closed.BinaryTree.Root.TaskID
+
+	// Результат дошел до дерева, а выражение не успело решиться
+	stuck_id, err := service.ProcessExpression("2 + 2", user_id)
+	require.NoError(t, err)
+	stuck, err := service.storage.GetExpression(stuck_id)
+	require.NoError(t, err)
+	stuck.BinaryTree.ReplaceNodeWithValue(stuck.BinaryTree.Root, 4)
+	_, err = service.storage.SaveExpression(&stuck)
+	require.NoError(t, err)
+
+	require.Nil(t, service.LastRecovery())
+	report, err := service.Recover()
+	require.NoError(t, err)
+
+	require.Equal(t, []int{orphaned.ID}, report.RequeuedTasks)
+	require.Equal(t, []int{leftover_id, stuck.BinaryTree.Root.TaskID}, report.DeletedTasks)
+	require.Len(t, report.RecreatedTasks, 1)
+	require.Equal(t, []int{stuck_id}, report.FinishedExpressions)
+	require.Equal(t, &report, service.LastRecovery())
+
+	expression, err := service.GetExpressionByID(stuck_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+	require.Equal(t, 4.0, expression.Result)
+
+	// Выражение с потерянной задачей досчитывается
+	results := map[float64]float64{1: 3, 3: 7}
+	for i := 0; i < 2; i++ {
+		task, err := service.GetPendingTask()
+		require.NoError(t, err)
+		require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, results[task.Arg1]))
+	}
+	task, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, "*", task.Operation)
+	require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 21))
+
+	expression, err = service.GetExpressionByID(broken_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+	require.Equal(t, 21.0, expression.Result)
+
+	// Повторное восстановление ничего не находит
+	report, err = service.Recover()
+	require.NoError(t, err)
+	require.True(t, report.Empty())
+}
+
+func TestServiceRecoverRetryLimits(t *testing.T) {
+	service := setUpService()
+	service.timeConfig.MaxAttempts = 2
+	service.timeConfig.RetryBackoff = 10 * time.Second
+	user_id := 1
+
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	// Задачу уже выдавали столько раз, сколько можно, и аренда истекла, пока оркестратор стоял
+	exhausted_id, err := service.ProcessExpression("(1 + 2) * (3 + 4)", user_id)
+	require.NoError(t, err)
+	exhausted, err := service.GetPendingTask()
+	require.NoError(t, err)
+	sibling, err := service.GetPendingTask()
+	require.NoError(t, err)
+	exhausted.Attempts = 2
+	_, err = service.storage.SaveTask(&exhausted)
+	require.NoError(t, err)
+
+	// У этой задачи попытки еще есть
+	retried_id, err := service.ProcessExpression("5 + 5", user_id)
+	require.NoError(t, err)
+	retried, err := service.GetPendingTask()
+	require.NoError(t, err)
+
+	now = now.Add(2 * time.Minute)
+	report, err := service.Recover()
+	require.NoError(t, err)
+	require.Equal(t, []int{exhausted.ID}, report.DeadTasks)
+	require.Equal(t, []int{retried.ID}, report.RequeuedTasks)
+	require.NotContains(t, report.RequeuedTasks, sibling.ID)
+	require.Equal(t, []int{exhausted_id}, report.FinishedExpressions)
+
+	task, err := service.storage.GetTask(exhausted.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.TaskDead, task.Status)
+	expression, err := service.GetExpressionByID(exhausted_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionError, expression.Status)
+	require.Equal(t, models.ErrorCodeTaskFailed, expression.ErrorCode)
+
+	// Вернувшуюся задачу снова выдают только после паузы, как после сборщика
+	_, err = service.GetPendingTask()
+	require.ErrorIs(t, err, ErrPendingTaskNotFount)
+	now = now.Add(10 * time.Second)
+	task, err = service.GetPendingTask()
+	require.NoError(t, err)
+	require.Equal(t, retried.ID, task.ID)
+	require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 10))
+	expression, err = service.GetExpressionByID(retried_id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+
+	// Повторный запуск восстановления задачу из dead-letter не трогает
+	report, err = service.Recover()
+	require.NoError(t, err)
+	require.True(t, report.Empty())
+}
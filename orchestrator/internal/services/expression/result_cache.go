@@ -0,0 +1,142 @@
+package expression
+
+// Кэш результатов задач. Ключ - операция и ее аргументы, поэтому одна и та же часть выражения,
+// например 2*3 в разных выражениях разных пользователей, считается агентом один раз.
+// Операции детерминированы, так что результат зависит только от ключа
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
+)
+
+// Счетчики кэша для администратора
+type CacheStats struct {
+	Size     int     `json:"size"`
+	Capacity int     `json:"capacity"`
+	TTL      string  `json:"ttl"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRate  float64 `json:"hit_rate"`
+}
+
+type cacheEntry struct {
+	key       string
+	result    float64
+	expiresAt time.Time
+}
+
+// Хранится по указателю, потому что сервис копируется в inTx.
+// Вытесняет записи, которые дольше всех не читали
+type resultCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration // 0 - записи не устаревают
+	capacity int           // 0 - кэш выключен
+	entries  map[string]*list.Element
+	order    *list.List // от недавно использованных к давно использованным
+	hits     int64
+	misses   int64
+}
+
+func newResultCache(capacity int, ttl time.Duration) *resultCache {
+	return &resultCache{
+		ttl:      ttl,
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// Канонический вид задачи: операция и аргументы в том виде, в каком их получит агент.
+// Списки в аргументах к этому времени уже развернуты в общий ряд
+func cacheKey(operation string, operands []float64) string {
+	var b strings.Builder
+	b.WriteString(operation)
+	for _, operand := range operands {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(operand, 'g', -1, 64))
+	}
+	return b.String()
+}
+
+func (c *resultCache) get(key string, now time.Time) (float64, bool) {
+	if c.capacity <= 0 {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if ok && c.ttl > 0 && now.After(element.Value.(*cacheEntry).expiresAt) {
+		c.remove(element)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return 0, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).result, true
+}
+
+func (c *resultCache) put(key string, result float64, now time.Time) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cacheEntry{key: key, result: result, expiresAt: now.Add(c.ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *resultCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+func (c *resultCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := CacheStats{
+		Size:     c.order.Len(),
+		Capacity: c.capacity,
+		TTL:      c.ttl.String(),
+		Hits:     c.hits,
+		Misses:   c.misses,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRate = float64(c.hits) / float64(total)
+	}
+	return stats
+}
+
+// Счетчики кэша результатов
+func (s *ExpressionService) CacheStats() CacheStats {
+	return s.cache.stats()
+}
+
+// Ищет результат свободного узла в кэше. Выражения с no_cache кэш не читают
+func (s *ExpressionService) cachedResult(node *calculation.TreeNode, expression *models.Expression) (float64, bool) {
+	if expression.NoCache {
+		return 0, false
+	}
+	return s.cache.get(cacheKey(node.Val, node.Operands()), s.now())
+}
+
+// Запоминает результат задачи, которую посчитал агент
+func (s *ExpressionService) cacheResult(node *calculation.TreeNode, result float64) {
+	s.cache.put(cacheKey(node.Val, node.Operands()), result, s.now())
+}
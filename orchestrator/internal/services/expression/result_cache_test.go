@@ -0,0 +1,117 @@
+package expression
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/config"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultCache(t *testing.T) {
+	now := time.Now()
+	cache := newResultCache(2, time.Minute)
+
+	require.Equal(t, "+ 2 3", cacheKey("+", []float64{2, 3}))
+	require.Equal(t, "sum 0.1 -1e+21", cacheKey("sum", []float64{0.1, -1e21}))
+
+	_, ok := cache.get("+ 2 3", now)
+	require.False(t, ok)
+	cache.put("+ 2 3", 5, now)
+	cache.put("* 2 3", 6, now)
+	result, ok := cache.get("+ 2 3", now)
+	require.True(t, ok)
+	require.Equal(t, 5.0, result)
+
+	// Вытесняется запись, которую дольше всех не читали
+	cache.put("- 2 3", -1, now)
+	_, ok = cache.get("* 2 3", now)
+	require.False(t, ok)
+	_, ok = cache.get("+ 2 3", now)
+	require.True(t, ok)
+
+	// Устаревшая запись не отдается
+	_, ok = cache.get("- 2 3", now.Add(2*time.Minute))
+	require.False(t, ok)
+
+	stats := cache.stats()
+	require.Equal(t, 1, stats.Size)
+	require.Equal(t, 2, stats.Capacity)
+	require.Equal(t, int64(2), stats.Hits)
+	require.Equal(t, int64(3), stats.Misses)
+	require.Equal(t, 0.4, stats.HitRate)
+
+	// Выключенный кэш ничего не помнит и не считает
+	disabled := newResultCache(0, time.Minute)
+	disabled.put("+ 2 3", 5, now)
+	_, ok = disabled.get("+ 2 3", now)
+	require.False(t, ok)
+	require.Zero(t, disabled.stats().Misses)
+}
+
+func TestServiceUsesResultCache(t *testing.T) {
+	tc := config.TimeConfig{LeaseGrace: time.Minute, CacheSize: 100, CacheTTL: time.Minute}
+	service := NewExpressionService(storage.NewStorage(true), tc)
+	user_id, err := service.storage.SaveUser(&models.User{Login: "cache"})
+	require.NoError(t, err)
+	other_id, err := service.storage.SaveUser(&models.User{Login: "other"})
+	require.NoError(t, err)
+
+	solve := func(results map[string]float64) {
+		for {
+			task, err := service.GetPendingTask()
+			if err == ErrPendingTaskNotFount {
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, results[task.Operation]))
+		}
+	}
+
+	first, err := service.ProcessExpression("2 * 3 + 1", user_id)
+	require.NoError(t, err)
+	solve(map[string]float64{"*": 6, "+": 7})
+	expression, err := service.GetExpressionByID(first, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+
+	// Те же операции с теми же аргументами у другого пользователя решаются без агентов
+	second, err := service.ProcessExpression("2 * 3 + 1", other_id)
+	require.NoError(t, err)
+	expression, err = service.GetExpressionByID(second, other_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+	require.Equal(t, 7.0, expression.Result)
+	progress, err := service.Progress(expression)
+	require.NoError(t, err)
+	require.Equal(t, 100.0, progress.Percent)
+
+	// Известная часть выражения решается сразу, задача создается только для остального
+	third, err := service.ProcessExpression("(2 * 3 + 1) / 2", user_id)
+	require.NoError(t, err)
+	tasks, err := service.storage.GetTasksByExpressionID(third)
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, "/", tasks[0].Operation)
+	require.Equal(t, 7.0, tasks[0].Arg1)
+	solve(map[string]float64{"/": 3.5})
+
+	// С no_cache все считают агенты
+	fourth, err := service.ProcessExpressionWithOptions("2 * 3 + 1", user_id, ProcessOptions{NoCache: true})
+	require.NoError(t, err)
+	expression, err = service.GetExpressionByID(fourth, user_id)
+	require.NoError(t, err)
+	require.True(t, expression.NoCache)
+	require.Equal(t, models.ExpressionProcessing, expression.Status)
+	tasks, err = service.storage.GetTasksByExpressionID(fourth)
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, "*", tasks[0].Operation)
+
+	stats := service.CacheStats()
+	require.Equal(t, int64(4), stats.Hits)
+	require.Equal(t, int64(3), stats.Misses)
+	require.Equal(t, 3, stats.Size)
+}
@@ -0,0 +1,192 @@
+package expression
+
+// История выполнения выражения: какая задача когда создана, какому агенту выдана и с каким результатом решена.
+// События пишутся в той же транзакции, что и переход задачи, поэтому история не расходится с задачами
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+)
+
+// Задача на временной шкале, собранная из ее событий
+type TimelineTask struct {
+	TaskID       int               `json:"task_id"`
+	Operation    string            `json:"operation"`
+	Status       models.TaskStatus `json:"status"` // по последнему событию
+	Args         []float64         `json:"args"`
+	Result       *float64          `json:"result,omitempty"`
+	AgentID      string            `json:"agent_id,omitempty"` // агент, который решил задачу или считает ее сейчас
+	Attempts     int               `json:"attempts"`
+	CreatedAt    time.Time         `json:"created_at"`
+	DispatchedAt *time.Time        `json:"dispatched_at,omitempty"` // последняя выдача
+	CompletedAt  *time.Time        `json:"completed_at,omitempty"`
+}
+
+type Timeline struct {
+	ExpressionID int                     `json:"expression_id"`
+	Status       models.ExpressionStatus `json:"status"`
+	Tasks        []TimelineTask          `json:"tasks"`
+	Events       []models.TaskEvent      `json:"events"`
+	start, end   time.Time               // границы шкалы для Render
+}
+
+// Операнды задачи одним рядом, как их получает агент
+func taskOperands(task models.Task) []float64 {
+	if task.Args != nil {
+		return task.Args
+	}
+	return []float64{task.Arg1, task.Arg2}
+}
+
+// Записывает событие задачи. result передается только для completed
+func (s *ExpressionService) recordEvent(task models.Task, event string, result *float64) error {
+	taskEvent := models.TaskEvent{
+		ExpressionID: task.ExpressionID,
+		TaskID:       task.ID,
+		Event:        event,
+		AgentID:      task.AgentID,
+		Operation:    task.Operation,
+		Args:         taskOperands(task),
+		Result:       result,
+		Attempt:      task.Attempts,
+		Time:         s.now(),
+	}
+	if err := s.storage.SaveTaskEvent(&taskEvent); err != nil {
+		slog.Error("ExpressionService.recordEvent: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	return nil
+}
+
+// История выражения пользователя
+func (s *ExpressionService) Timeline(id int, user_id int) (Timeline, error) {
+	expression, err := s.GetExpressionByID(id, user_id)
+	if err != nil {
+		return Timeline{}, err
+	}
+	events, err := s.storage.GetTaskEvents(expression.ID)
+	if err != nil {
+		slog.Error("ExpressionService.Timeline: error in storage", "error", err.Error())
+		return Timeline{}, ErrStorage
+	}
+	timeline := Timeline{
+		ExpressionID: expression.ID,
+		Status:       expression.Status,
+		Tasks:        []TimelineTask{},
+		Events:       events,
+		start:        expression.CreatedAt,
+		end:          s.now(),
+	}
+	if expression.FinishedAt != nil {
+		timeline.end = *expression.FinishedAt
+	}
+	if timeline.Events == nil {
+		timeline.Events = []models.TaskEvent{}
+	}
+
+	index := map[int]int{}
+	for _, event := range events {
+		if timeline.start.IsZero() || event.Time.Before(timeline.start) {
+			timeline.start = event.Time
+		}
+		if event.Time.After(timeline.end) {
+			timeline.end = event.Time
+		}
+		i, ok := index[event.TaskID]
+		if !ok {
+			i = len(timeline.Tasks)
+			index[event.TaskID] = i
+			timeline.Tasks = append(timeline.Tasks, TimelineTask{
+				TaskID:    event.TaskID,
+				Operation: event.Operation,
+				Status:    models.TaskPending,
+				Args:      event.Args,
+				CreatedAt: event.Time,
+			})
+		}
+		task := &timeline.Tasks[i]
+		at := event.Time
+		switch event.Event {
+		case "dispatched":
+			task.Status = models.TaskInProgress
+			task.DispatchedAt = &at
+			task.AgentID = event.AgentID
+			task.Attempts = event.Attempt
+		case "completed":
+			task.Status = models.TaskDone
+			task.CompletedAt = &at
+			task.Result = event.Result
+		case "expired":
+			// Агент не успел, задача вернулась в очередь
+			task.Status = models.TaskPending
+			task.DispatchedAt = nil
+			task.AgentID = ""
+		case "dead":
+			// Последняя попытка тоже не удалась, дальше задача не считается
+			task.Status = models.TaskDead
+			task.CompletedAt = &at
+		}
+	}
+	return timeline, nil
+}
+
+// Ширина полосы в текстовом виде
+const ganttWidth = 40
+
+// Диаграмма Ганта в тексте: строка на задачу, точки - ожидание в очереди, решетки - счет у агента
+//
+//	expression 7: solve, 2.1s
+//	task 12   +      agent-1      |.....#####                              | 1, 2 = 3
+func (t Timeline) Render() string {
+	var b strings.Builder
+	span := t.end.Sub(t.start)
+	fmt.Fprintf(&b, "expression %d: %s, %s\n", t.ExpressionID, t.Status, span.Round(time.Millisecond))
+
+	column := func(at time.Time) int {
+		if span <= 0 {
+			return 0
+		}
+		return min(int(int64(at.Sub(t.start))*ganttWidth/int64(span)), ganttWidth)
+	}
+	for _, task := range t.Tasks {
+		bar := []byte(strings.Repeat(" ", ganttWidth))
+		queuedFrom := column(task.CreatedAt)
+		queuedTo := column(t.end)
+		if task.DispatchedAt != nil {
+			queuedTo = column(*task.DispatchedAt)
+			runTo := column(t.end)
+			if task.CompletedAt != nil {
+				runTo = column(*task.CompletedAt)
+			}
+			// Даже очень короткая задача видна на шкале
+			for i := min(queuedTo, ganttWidth-1); i <= runTo && i < ganttWidth; i++ {
+				bar[i] = '#'
+			}
+		}
+		for i := queuedFrom; i < queuedTo; i++ {
+			bar[i] = '.'
+		}
+
+		args := make([]string, len(task.Args))
+		for i, arg := range task.Args {
+			args[i] = strconv.FormatFloat(arg, 'f', -1, 64)
+		}
+		detail := strings.Join(args, ", ")
+		if task.Result != nil {
+			detail += " = " + strconv.FormatFloat(*task.Result, 'f', -1, 64)
+		} else {
+			detail += " (" + string(task.Status) + ")"
+		}
+		agent := task.AgentID
+		if agent == "" {
+			agent = "-"
+		}
+		fmt.Fprintf(&b, "task %-4d %-6s %-12s |%s| %s\n", task.TaskID, task.Operation, agent, bar, detail)
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package expression
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceTimeline(t *testing.T) {
+	service := setUpService()
+	service.timeConfig.TimeAdd = time.Second
+	service.timeConfig.TimeMul = time.Second
+	user_id := 1
+
+	start := time.Now().UTC()
+	now := start
+	service.now = func() time.Time { return now }
+
+	id, err := service.ProcessExpression("(1 + 2) * 3", user_id)
+	require.NoError(t, err)
+
+	// Первый агент не успевает, задача уходит второму
+	now = now.Add(time.Second)
+	lost, err := service.ClaimPendingTask("agent-1")
+	require.NoError(t, err)
+	now = now.Add(2*time.Minute + 2*time.Second)
+	_, err = service.ReleaseExpiredLeases()
+	require.NoError(t, err)
+	addition, err := service.ClaimPendingTask("agent-2")
+	require.NoError(t, err)
+	require.Equal(t, lost.ID, addition.ID)
+	now = now.Add(time.Second)
+	require.NoError(t, service.ProcessIncomingTask(addition.ID, addition.AttemptToken, 3))
+
+	multiplication, err := service.ClaimPendingTask("agent-1")
+	require.NoError(t, err)
+	now = now.Add(time.Second)
+	require.NoError(t, service.ProcessIncomingTask(multiplication.ID, multiplication.AttemptToken, 9))
+
+	timeline, err := service.Timeline(id, user_id)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, timeline.Status)
+
+	events := []string{}
+	for _, event := range timeline.Events {
+		events = append(events, event.Event+" "+event.AgentID)
+	}
+	require.Equal(t, []string{
+		"created ", "dispatched agent-1", "expired agent-1", "dispatched agent-2", "completed agent-2",
+		"created ", "dispatched agent-1", "completed agent-1",
+	}, events)
+	require.Equal(t, []float64{1, 2}, timeline.Events[0].Args)
+	require.Equal(t, 3.0, *timeline.Events[4].Result)
+
+	require.Len(t, timeline.Tasks, 2)
+	first := timeline.Tasks[0]
+	require.Equal(t, "+", first.Operation)
+	require.Equal(t, models.TaskDone, first.Status)
+	require.Equal(t, "agent-2", first.AgentID)
+	require.Equal(t, 2, first.Attempts)
+	require.Equal(t, 3.0, *first.Result)
+	require.True(t, first.CreatedAt.Equal(start))
+	require.True(t, first.DispatchedAt.Equal(start.Add(2*time.Minute+3*time.Second)))
+	require.True(t, first.CompletedAt.Equal(start.Add(2*time.Minute+4*time.Second)))
+	second := timeline.Tasks[1]
+	require.Equal(t, []float64{3, 3}, second.Args)
+	require.Equal(t, "agent-1", second.AgentID)
+	require.Equal(t, 9.0, *second.Result)
+
+	text := timeline.Render()
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, "expression 1: solve, 2m5s", lines[0])
+	require.Contains(t, lines[1], "agent-2")
+	require.Contains(t, lines[1], "| 1, 2 = 3")
+	require.Contains(t, lines[2], "| 3, 3 = 9")
+	// Сложение почти все время ждало в очереди, умножение считалось в самом конце
+	require.True(t, strings.HasPrefix(strings.Split(lines[1], "|")[1], "......"))
+	require.True(t, strings.HasSuffix(strings.Split(lines[2], "|")[1], "#"))
+
+	_, err = service.Timeline(id, user_id+1)
+	require.ErrorIs(t, err, ErrExpressionNotFound)
+}
@@ -0,0 +1,54 @@
+package expression
+
+import (
+	"testing"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/webhook"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceEnqueuesWebhooks(t *testing.T) {
+	service := setUpService()
+	user_id, err := service.storage.SaveUser(&models.User{Login: "hooks"})
+	require.NoError(t, err)
+
+	_, err = service.ProcessExpressionWithOptions("2 + 2", user_id, ProcessOptions{CallbackURL: "ftp://example.com"})
+	require.ErrorIs(t, err, webhook.ErrInvalidURL)
+
+	solved, err := service.ProcessExpressionWithOptions("2 + 2", user_id, ProcessOptions{CallbackURL: "http://example.com/solved"})
+	require.NoError(t, err)
+	expression, err := service.GetExpressionByID(solved, user_id)
+	require.NoError(t, err)
+	require.Equal(t, "http://example.com/solved", expression.CallbackURL)
+
+	// Пока выражение считается, доставок нет
+	deliveries, err := service.storage.GetWebhookDeliveries(user_id, 0, 10)
+	require.NoError(t, err)
+	require.Empty(t, deliveries)
+
+	// Деление на ноль закрывает выражение сразу при отправке
+	failed, err := service.ProcessExpressionWithOptions("1 / 0", user_id, ProcessOptions{CallbackURL: "http://example.com/failed"})
+	require.NoError(t, err)
+	cancelled, err := service.ProcessExpressionWithOptions("3 + 3", user_id, ProcessOptions{CallbackURL: "http://example.com/cancelled"})
+	require.NoError(t, err)
+
+	task, err := service.GetPendingTask()
+	require.NoError(t, err)
+	require.NoError(t, service.ProcessIncomingTask(task.ID, task.AttemptToken, 4))
+	_, err = service.CancelExpression(cancelled, user_id)
+	require.NoError(t, err)
+
+	deliveries, err = service.storage.GetWebhookDeliveries(user_id, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	byExpression := map[int]models.WebhookDelivery{}
+	for _, delivery := range deliveries {
+		byExpression[delivery.ExpressionID] = delivery
+	}
+	require.Equal(t, webhook.EventSolved, byExpression[solved].Event)
+	require.Equal(t, "http://example.com/solved", byExpression[solved].URL)
+	require.Equal(t, models.WebhookPending, byExpression[solved].Status)
+	require.Equal(t, webhook.EventFailed, byExpression[failed].Event)
+	require.NotContains(t, byExpression, cancelled)
+}
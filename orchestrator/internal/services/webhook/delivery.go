@@ -0,0 +1,141 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/backoff"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
+)
+
+// Сколько доставок отправляем за один проход
+const deliveryBatch = 32
+
+// Отправляет доставки, которым пора уйти, раз в interval, пока не вызван Close
+func (s *Service) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.DeliverDue()
+		}
+	}
+}
+
+// Отправляет доставки, которым пора уйти, параллельно и ждет ответов.
+// Неудачные попытки повторяются после паузы, которая растет с каждой попыткой.
+// Возвращает, сколько доставок получатели приняли
+func (s *Service) DeliverDue() (int, error) {
+	due, err := s.storage.GetDueWebhookDeliveries(s.now(), deliveryBatch)
+	if err != nil {
+		slog.Error("webhook.DeliverDue: error in storage", "error", err.Error())
+		return 0, ErrStorage
+	}
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		delivered int
+	)
+	for _, delivery := range due {
+		wg.Add(1)
+		go func(delivery models.WebhookDelivery) {
+			defer wg.Done()
+			ok, err := s.deliver(delivery)
+			if err != nil {
+				slog.Error("webhook.DeliverDue: delivery not saved", "delivery_id", delivery.ID, "error", err.Error())
+				return
+			}
+			if ok {
+				mu.Lock()
+				delivered++
+				mu.Unlock()
+			}
+		}(delivery)
+	}
+	wg.Wait()
+	return delivered, nil
+}
+
+// Одна попытка доставки. Попытка и новое состояние доставки сохраняются вместе
+func (s *Service) deliver(delivery models.WebhookDelivery) (bool, error) {
+	secret, err := s.Secret(delivery.UserID)
+	if err != nil {
+		return false, err
+	}
+	started := s.now()
+	statusCode, sendErr := s.send(delivery, secret)
+	finished := s.now()
+
+	delivery.Attempts++
+	attempt := models.WebhookAttempt{
+		DeliveryID: delivery.ID,
+		Attempt:    delivery.Attempts,
+		StatusCode: statusCode,
+		DurationMS: finished.Sub(started).Milliseconds(),
+		Time:       started,
+	}
+	ok := sendErr == nil
+	switch {
+	case ok:
+		delivery.Status = models.WebhookDelivered
+		delivery.NextAttemptAt = nil
+		delivery.DeliveredAt = &finished
+	case s.config.MaxAttempts > 0 && delivery.Attempts >= s.config.MaxAttempts:
+		attempt.Error = sendErr.Error()
+		delivery.Status = models.WebhookFailed
+		delivery.NextAttemptAt = nil
+		slog.Warn("webhook.deliver: delivery failed", "delivery_id", delivery.ID, "url", delivery.URL, "attempts", delivery.Attempts)
+	default:
+		attempt.Error = sendErr.Error()
+		next := finished.Add(s.retryBackoff(delivery.Attempts))
+		delivery.NextAttemptAt = &next
+	}
+
+	err = s.storage.InTx(func(tx *storage.Storage) error {
+		if err := tx.SaveWebhookAttempt(&attempt); err != nil {
+			return err
+		}
+		return tx.SaveWebhookDelivery(&delivery)
+	})
+	return ok, err
+}
+
+// Отправляет запрос. Ответ не 2xx - тоже ошибка, код ответа возвращается вместе с ней
+func (s *Service) send(delivery models.WebhookDelivery, secret string) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "calc-api-webhooks")
+	request.Header.Set(HeaderEvent, delivery.Event)
+	request.Header.Set(HeaderDelivery, strconv.Itoa(delivery.ID))
+	request.Header.Set(HeaderSignature, Sign(secret, delivery.Payload))
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	// Дочитываем немного тела, чтобы соединение можно было переиспользовать
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// Пауза перед следующей попыткой, удваивается с каждой попыткой до RetryBackoffMax
+func (s *Service) retryBackoff(attempts int) time.Duration {
+	return backoff.Doubling(s.config.RetryBackoff, s.config.RetryBackoffMax, attempts)
+}
@@ -0,0 +1,116 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrForbiddenAddress = errors.New("webhook address is not allowed")
+
+// Сети, которых нет среди IsPrivate и IsLoopback, но снаружи они тоже недоступны
+var reservedNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// Решает, куда можно слать вебхуки. Адрес проверяется при подключении, уже после разрешения имени,
+// поэтому имя, которое указывает на внутренний адрес, не поможет обойти проверку
+type addressGuard struct {
+	// Хосты из WEBHOOK_ALLOWED_HOSTS, им можно любой адрес
+	hosts map[string]bool
+	// Адреса и подсети из WEBHOOK_ALLOWED_HOSTS
+	networks []*net.IPNet
+}
+
+func newAddressGuard(allowed []string) *addressGuard {
+	guard := &addressGuard{hosts: map[string]bool{}}
+	for _, entry := range allowed {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			guard.networks = append(guard.networks, network)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			guard.networks = append(guard.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			guard.hosts[strings.ToLower(entry)] = true
+		}
+	}
+	return guard
+}
+
+// Внутренние адреса: loopback, частные сети, link-local (в том числе 169.254.169.254) и подобные
+func (g *addressGuard) allowedIP(ip net.IP) bool {
+	for _, network := range g.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Вызывается для каждого подключения с уже разрешенным адресом
+func (g *addressGuard) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !g.allowedIP(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
+
+// Клиент для доставки. Переходы по редиректам выключены: ответ 3xx считается неудачной попыткой.
+// Прокси тоже не используется, иначе проверялся бы адрес прокси, а не получателя
+func newClient(timeout time.Duration, allowed []string) *http.Client {
+	guard := newAddressGuard(allowed)
+	dialer := &net.Dialer{Timeout: timeout}
+	guarded := &net.Dialer{Timeout: timeout, Control: guard.control}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(address)
+			if err == nil && guard.hosts[strings.ToLower(host)] {
+				return dialer.DialContext(ctx, network, address)
+			}
+			return guarded.DialContext(ctx, network, address)
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,250 @@
+package webhook
+
+// Вебхуки: когда выражение решено или закрыто с ошибкой, на callback_url выражения
+// и на вебхуки пользователя уходит POST с результатом, подписанный ключом пользователя
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/config"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
+)
+
+const (
+	EventSolved = "expression.solved"
+	EventFailed = "expression.failed"
+)
+
+// Заголовки запроса вебхука
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderSignature = "X-Webhook-Signature" // sha256=<hex HMAC-SHA256 тела>
+)
+
+// Больше вебхуков по умолчанию пользователь завести не может
+const maxWebhooks = 10
+
+var (
+	ErrInvalidURL      = errors.New("invalid callback url")
+	ErrWebhookNotFound = errors.New("webhook not found")
+	ErrTooManyWebhooks = errors.New("too many webhooks")
+	ErrUserNotFound    = errors.New("user not found")
+	ErrStorage         = errors.New("unknown error in storage")
+)
+
+// Тело запроса вебхука
+type Payload struct {
+	Event      string            `json:"event"`
+	Expression models.Expression `json:"expression"`
+	Time       time.Time         `json:"time"`
+}
+
+type Service struct {
+	storage *storage.Storage
+	config  config.WebhookConfig
+	client  *http.Client
+	now     func() time.Time
+	done    chan struct{}
+}
+
+func NewService(s *storage.Storage, conf config.WebhookConfig) *Service {
+	return &Service{
+		storage: s,
+		config:  conf,
+		client:  newClient(conf.Timeout, conf.AllowedHosts),
+		now:     time.Now,
+		done:    make(chan struct{}),
+	}
+}
+
+// Останавливает Run
+func (s *Service) Close() {
+	close(s.done)
+}
+
+// Адрес вебхука должен быть абсолютным http или https адресом.
+// Куда указывает хост, проверяется уже при отправке
+func ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
+// Подпись тела для заголовка X-Webhook-Signature
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Ставит в очередь доставки о закрытии выражения: на его callback_url и на вебхуки пользователя.
+// Вызывается в транзакции, которая закрывает выражение, поэтому доставки не теряются при падении.
+// У отмененных выражений вебхуков нет
+func Enqueue(st *storage.Storage, expression models.Expression, now time.Time) error {
+	var event string
+	switch expression.Status {
+	case models.ExpressionSolved:
+		event = EventSolved
+	case models.ExpressionError:
+		event = EventFailed
+	default:
+		return nil
+	}
+	webhooks, err := st.GetWebhooks(expression.UserID)
+	if err != nil {
+		return err
+	}
+	urls := []string{}
+	if expression.CallbackURL != "" {
+		urls = append(urls, expression.CallbackURL)
+	}
+	for _, webhook := range webhooks {
+		urls = append(urls, webhook.URL)
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+
+	expression.Progress = nil
+	payload, err := json.Marshal(Payload{Event: event, Expression: expression, Time: now.UTC()})
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, u := range urls {
+		// Один адрес и в callback_url, и в вебхуках получает результат один раз
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		delivery := models.WebhookDelivery{
+			UserID:        expression.UserID,
+			ExpressionID:  expression.ID,
+			Event:         event,
+			URL:           u,
+			Payload:       payload,
+			Status:        models.WebhookPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		}
+		if err := st.SaveWebhookDelivery(&delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) CreateWebhook(user_id int, rawURL string) (models.Webhook, error) {
+	webhook := models.Webhook{UserID: user_id, URL: rawURL, CreatedAt: s.now()}
+	if err := ValidateURL(rawURL); err != nil {
+		return webhook, err
+	}
+	err := s.storage.InTx(func(tx *storage.Storage) error {
+		webhooks, err := tx.GetWebhooks(user_id)
+		if err != nil {
+			slog.Error("webhook.CreateWebhook: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if len(webhooks) >= maxWebhooks {
+			return ErrTooManyWebhooks
+		}
+		if err := tx.SaveWebhook(&webhook); err != nil {
+			slog.Error("webhook.CreateWebhook: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		return nil
+	})
+	return webhook, err
+}
+
+func (s *Service) GetWebhooks(user_id int) ([]models.Webhook, error) {
+	webhooks, err := s.storage.GetWebhooks(user_id)
+	if err != nil {
+		slog.Error("webhook.GetWebhooks: error in storage", "error", err.Error())
+		return nil, ErrStorage
+	}
+	return webhooks, nil
+}
+
+func (s *Service) DeleteWebhook(id int, user_id int) error {
+	err := s.storage.DeleteWebhook(id, user_id)
+	if errors.Is(err, storage.ErrItemNotFound) {
+		return ErrWebhookNotFound
+	} else if err != nil {
+		slog.Error("webhook.DeleteWebhook: error in storage", "error", err.Error())
+		return ErrStorage
+	}
+	return nil
+}
+
+// Ключ подписи пользователя. Создается при первом обращении
+func (s *Service) Secret(user_id int) (string, error) {
+	var secret string
+	err := s.storage.InTx(func(tx *storage.Storage) error {
+		var err error
+		secret, err = tx.GetWebhookSecret(user_id)
+		if errors.Is(err, storage.ErrItemNotFound) {
+			return ErrUserNotFound
+		} else if err != nil {
+			slog.Error("webhook.Secret: error in storage", "error", err.Error())
+			return ErrStorage
+		}
+		if secret != "" {
+			return nil
+		}
+		secret, err = setNewSecret(tx, user_id)
+		return err
+	})
+	return secret, err
+}
+
+// Заменяет ключ подписи. Доставки, которые еще не ушли, подписываются уже новым ключом
+func (s *Service) RotateSecret(user_id int) (string, error) {
+	return setNewSecret(s.storage, user_id)
+}
+
+func setNewSecret(st *storage.Storage, user_id int) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(key)
+	err := st.SetWebhookSecret(user_id, secret)
+	if errors.Is(err, storage.ErrItemNotFound) {
+		return "", ErrUserNotFound
+	} else if err != nil {
+		slog.Error("webhook.setNewSecret: error in storage", "error", err.Error())
+		return "", ErrStorage
+	}
+	return secret, nil
+}
+
+// История доставок пользователя вместе с попытками, новые первыми. expression_id 0 значит по всем выражениям
+func (s *Service) GetDeliveries(user_id int, expression_id int, limit int) ([]models.WebhookDelivery, error) {
+	deliveries, err := s.storage.GetWebhookDeliveries(user_id, expression_id, limit)
+	if err != nil {
+		slog.Error("webhook.GetDeliveries: error in storage", "error", err.Error())
+		return nil, ErrStorage
+	}
+	for i := range deliveries {
+		deliveries[i].History, err = s.storage.GetWebhookAttempts(deliveries[i].ID)
+		if err != nil {
+			slog.Error("webhook.GetDeliveries: error in storage", "error", err.Error())
+			return nil, ErrStorage
+		}
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,232 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/config"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// Получатели в тестах слушают на 127.0.0.1, поэтому его надо разрешить явно
+func setUpService(t *testing.T, allowed ...string) (*Service, int) {
+	st := storage.NewStorage(true)
+	t.Cleanup(func() { st.Close() })
+	user_id, err := st.SaveUser(&models.User{Login: "hooks"})
+	require.NoError(t, err)
+	conf := config.WebhookConfig{MaxAttempts: 3, RetryBackoff: time.Second, RetryBackoffMax: time.Minute, Timeout: time.Second, AllowedHosts: allowed}
+	return NewService(st, conf), user_id
+}
+
+func TestSign(t *testing.T) {
+	// Пример из RFC 4231, тест 2
+	require.Equal(t, "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		Sign("Jefe", []byte("what do ya want for nothing?")))
+}
+
+func TestValidateURL(t *testing.T) {
+	require.NoError(t, ValidateURL("https://example.com/hook?x=1"))
+	require.NoError(t, ValidateURL("http://localhost:9000"))
+	for _, u := range []string{"", "example.com/hook", "ftp://example.com", "http://", "://"} {
+		require.ErrorIs(t, ValidateURL(u), ErrInvalidURL, u)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	service, user_id := setUpService(t, "127.0.0.1")
+	now := time.Now().UTC()
+	service.now = func() time.Time { return now }
+
+	secret, err := service.Secret(user_id)
+	require.NoError(t, err)
+	require.NotEmpty(t, secret)
+	again, err := service.Secret(user_id)
+	require.NoError(t, err)
+	require.Equal(t, secret, again)
+
+	// Получатель проверяет подпись так же, как это сделал бы настоящий
+	received := make(chan Payload, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(HeaderSignature) != Sign(secret, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var payload Payload
+		require.NoError(t, json.Unmarshal(body, &payload))
+		require.Equal(t, payload.Event, r.Header.Get(HeaderEvent))
+		require.NotEmpty(t, r.Header.Get(HeaderDelivery))
+		received <- payload
+	}))
+	defer receiver.Close()
+
+	// Первый запрос отвечает ошибкой, второй принимает
+	var flakyCalls atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flakyCalls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer flaky.Close()
+
+	_, err = service.CreateWebhook(user_id, "not a url")
+	require.ErrorIs(t, err, ErrInvalidURL)
+	_, err = service.CreateWebhook(user_id, flaky.URL)
+	require.NoError(t, err)
+	_, err = service.CreateWebhook(user_id, receiver.URL)
+	require.NoError(t, err)
+
+	expression := models.Expression{ID: 7, UserID: user_id, Status: models.ExpressionSolved, Result: 4, CallbackURL: receiver.URL}
+	require.NoError(t, Enqueue(service.storage, expression, now))
+	// Отмененные выражения вебхуков не шлют
+	cancelled := models.Expression{ID: 8, UserID: user_id, Status: models.ExpressionCancelled}
+	require.NoError(t, Enqueue(service.storage, cancelled, now))
+
+	delivered, err := service.DeliverDue()
+	require.NoError(t, err)
+	// callback_url совпал с вебхуком, туда ушел один запрос
+	require.Equal(t, 1, delivered)
+	payload := <-received
+	require.Equal(t, EventSolved, payload.Event)
+	require.Equal(t, 7, payload.Expression.ID)
+	require.Equal(t, 4.0, payload.Expression.Result)
+	require.Empty(t, received)
+
+	// Повтор только после паузы
+	delivered, err = service.DeliverDue()
+	require.NoError(t, err)
+	require.Zero(t, delivered)
+	now = now.Add(time.Second)
+	delivered, err = service.DeliverDue()
+	require.NoError(t, err)
+	require.Equal(t, 1, delivered)
+
+	deliveries, err := service.GetDeliveries(user_id, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	for _, delivery := range deliveries {
+		require.Equal(t, models.WebhookDelivered, delivery.Status)
+		require.Equal(t, 7, delivery.ExpressionID)
+	}
+	retried := deliveries[0]
+	if retried.URL != flaky.URL {
+		retried = deliveries[1]
+	}
+	require.Equal(t, 2, retried.Attempts)
+	require.Len(t, retried.History, 2)
+	require.Equal(t, http.StatusServiceUnavailable, retried.History[0].StatusCode)
+	require.Equal(t, "unexpected status 503", retried.History[0].Error)
+	require.Equal(t, http.StatusOK, retried.History[1].StatusCode)
+	require.Empty(t, retried.History[1].Error)
+
+	deliveries, err = service.GetDeliveries(user_id, 8, 10)
+	require.NoError(t, err)
+	require.Empty(t, deliveries)
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	service, user_id := setUpService(t, "127.0.0.1")
+	now := time.Now().UTC()
+	service.now = func() time.Time { return now }
+
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	expression := models.Expression{ID: 1, UserID: user_id, Status: models.ExpressionError, ErrorCode: models.ErrorCodeDivisionByZero, CallbackURL: receiver.URL}
+	require.NoError(t, Enqueue(service.storage, expression, now))
+
+	require.Equal(t, time.Second, service.retryBackoff(1))
+	require.Equal(t, 2*time.Second, service.retryBackoff(2))
+	for range 5 {
+		_, err := service.DeliverDue()
+		require.NoError(t, err)
+		now = now.Add(time.Minute)
+	}
+	require.Equal(t, int32(3), calls.Load())
+
+	deliveries, err := service.GetDeliveries(user_id, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, EventFailed, deliveries[0].Event)
+	require.Equal(t, models.WebhookFailed, deliveries[0].Status)
+	require.Nil(t, deliveries[0].NextAttemptAt)
+	require.Len(t, deliveries[0].History, 3)
+
+	var payload Payload
+	require.NoError(t, json.Unmarshal(deliveries[0].Payload, &payload))
+	require.Equal(t, models.ErrorCodeDivisionByZero, payload.Expression.ErrorCode)
+}
+
+func TestAddressGuard(t *testing.T) {
+	guard := newAddressGuard(nil)
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "0.0.0.0", "100.64.0.1", "::1", "fc00::1", "fe80::1", "::ffff:127.0.0.1"} {
+		require.False(t, guard.allowedIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"8.8.8.8", "93.184.216.34", "2606:4700::1111"} {
+		require.True(t, guard.allowedIP(net.ParseIP(ip)), ip)
+	}
+
+	guard = newAddressGuard([]string{"10.0.0.0/8", " 127.0.0.1 ", "Hooks.Internal", ""})
+	require.True(t, guard.allowedIP(net.ParseIP("10.1.2.3")))
+	require.True(t, guard.allowedIP(net.ParseIP("127.0.0.1")))
+	require.False(t, guard.allowedIP(net.ParseIP("127.0.0.2")))
+	require.False(t, guard.allowedIP(net.ParseIP("192.168.1.1")))
+	require.True(t, guard.hosts["hooks.internal"])
+}
+
+func TestDeliverForbiddenAddress(t *testing.T) {
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer receiver.Close()
+	// Редирект с разрешенного адреса на внутренний
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, receiver.URL, http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+
+	// Без разрешения внутренний адрес недоступен, даже если он записан именем
+	service, user_id := setUpService(t)
+	localhost := strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)
+	for i, u := range []string{receiver.URL, localhost} {
+		expression := models.Expression{ID: i + 1, UserID: user_id, Status: models.ExpressionSolved, CallbackURL: u}
+		require.NoError(t, Enqueue(service.storage, expression, service.now()))
+	}
+	delivered, err := service.DeliverDue()
+	require.NoError(t, err)
+	require.Zero(t, delivered)
+	require.Zero(t, calls.Load())
+	deliveries, err := service.GetDeliveries(user_id, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	for _, delivery := range deliveries {
+		require.Len(t, delivery.History, 1)
+		require.Contains(t, delivery.History[0].Error, ErrForbiddenAddress.Error())
+	}
+
+	// По редиректам доставка не ходит: 3xx - неудачная попытка
+	service, user_id = setUpService(t, "127.0.0.1")
+	expression := models.Expression{ID: 1, UserID: user_id, Status: models.ExpressionSolved, CallbackURL: redirect.URL}
+	require.NoError(t, Enqueue(service.storage, expression, service.now()))
+	delivered, err = service.DeliverDue()
+	require.NoError(t, err)
+	require.Zero(t, delivered)
+	require.Zero(t, calls.Load())
+	deliveries, err = service.GetDeliveries(user_id, 1, 10)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTemporaryRedirect, deliveries[0].History[0].StatusCode)
+}
@@ -15,10 +15,10 @@ func (s *Storage) SaveUser(user *models.User) (int, error) {
 
 	if user.ID == 0 {
 		q := `
-		INSERT INTO users (login, password)
-		VALUES ($1, $2)
+		INSERT INTO users (login, password, locale, role)
+		VALUES ($1, $2, $3, $4)
 		`
-		res, err := s.db.ExecContext(ctx, q, user.Login, user.PasswordHash)
+		res, err := s.q.ExecContext(ctx, q, user.Login, user.PasswordHash, user.Locale, user.Role)
 		var sqliteErr sqlite3.Error
 		if errors.As(err, &sqliteErr) {
 			if errors.Is(sqliteErr.Code, sqlite3.ErrConstraint) {
@@ -37,29 +37,43 @@ func (s *Storage) SaveUser(user *models.User) (int, error) {
 
 	q := `
 	UPDATE users
-	SET login = $1, password = $2
-	WHERE user_id = $3
+	SET login = $1, password = $2, locale = $3, role = $4
+	WHERE user_id = $5
 	`
-	_, err := s.db.ExecContext(ctx, q, user.Login, user.PasswordHash, user.ID)
+	_, err := s.q.ExecContext(ctx, q, user.Login, user.PasswordHash, user.Locale, user.Role, user.ID)
 	if err != nil {
 		return 0, err
 	}
 	return user.ID, nil
 }
 
-func (s *Storage) GetUser(login string) (models.User, error) {
+const userColumns = "user_id, login, password, locale, role"
+
+func scanUser(row scanner) (models.User, error) {
 	var user models.User
+	err := row.Scan(&user.ID, &user.Login, &user.PasswordHash, &user.Locale, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrItemNotFound
+	}
+	return user, err
+}
+
+func (s *Storage) GetUser(login string) (models.User, error) {
 	var q = `
-	SELECT user_id, login, password 
+	SELECT ` + userColumns + `
 	FROM users
 	WHERE login = $1
 	`
 	ctx := context.TODO()
-	err := s.db.QueryRowContext(ctx, q, login).Scan(&user.ID, &user.Login, &user.PasswordHash)
-	if errors.Is(err, sql.ErrNoRows) {
-		return user, ErrItemNotFound
-	} else if err != nil {
-		return user, err
-	}
-	return user, nil
+	return scanUser(s.q.QueryRowContext(ctx, q, login))
+}
+
+func (s *Storage) GetUserByID(id int) (models.User, error) {
+	var q = `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE user_id = $1
+	`
+	ctx := context.TODO()
+	return scanUser(s.q.QueryRowContext(ctx, q, id))
 }
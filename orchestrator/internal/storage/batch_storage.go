@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+)
+
+func (s *Storage) SaveBatch(batch *models.Batch) error {
+	q := `
+	INSERT INTO batches (user_id, total, created_at)
+	VALUES ($1, $2, $3)
+	`
+	ctx := context.TODO()
+	res, err := s.q.ExecContext(ctx, q, batch.UserID, batch.Total, batch.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	batch.ID = int(lastID)
+	return nil
+}
+
+// Пакет без выражений, их отдает GetBatchExpressions
+func (s *Storage) GetBatch(batch_id int) (models.Batch, error) {
+	var batch models.Batch
+	q := `
+	SELECT batch_id, user_id, total, created_at
+	FROM batches
+	WHERE batch_id = $1
+	`
+	ctx := context.TODO()
+	err := s.q.QueryRowContext(ctx, q, batch_id).Scan(&batch.ID, &batch.UserID, &batch.Total, &batch.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return batch, ErrItemNotFound
+	}
+	return batch, err
+}
+
+// Выражения пакета без деревьев, как в списке выражений пользователя
+func (s *Storage) GetBatchExpressions(batch_id int) ([]models.Expression, error) {
+	expressions := []models.Expression{}
+	q := `
+	SELECT expression_id, status, result, result_value, error_code, error_message, client_id
+	FROM expressions
+	WHERE batch_id = $1
+	ORDER BY expression_id
+	`
+	ctx := context.TODO()
+	rows, err := s.q.QueryContext(ctx, q, batch_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := models.Expression{BatchID: batch_id}
+		var value, errorCode, errorMessage, clientID sql.NullString
+		if err := rows.Scan(&e.ID, &e.Status, &e.Result, &value, &errorCode, &errorMessage, &clientID); err != nil {
+			return nil, err
+		}
+		e.ErrorCode = errorCode.String
+		e.ErrorMessage = errorMessage.String
+		e.ClientID = clientID.String
+		e.Value, err = decodeValue(value.String)
+		if err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, e)
+	}
+	return expressions, rows.Err()
+}
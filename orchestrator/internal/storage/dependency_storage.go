@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+)
+
+// Запоминает, что выражение expression_id ссылается на выражения depends_on
+func (s *Storage) SaveDependencies(expression_id int, depends_on []int) error {
+	q := `
+	INSERT OR IGNORE INTO expression_dependencies (expression_id, depends_on)
+	VALUES ($1, $2)
+	`
+	ctx := context.TODO()
+	for _, id := range depends_on {
+		if _, err := s.q.ExecContext(ctx, q, expression_id, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Выражения, на которые ссылается выражение expression_id
+func (s *Storage) GetDependencies(expression_id int) ([]int, error) {
+	q := `
+	SELECT depends_on
+	FROM expression_dependencies
+	WHERE expression_id = $1
+	ORDER BY depends_on
+	`
+	return s.queryIDs(q, expression_id)
+}
+
+// Выражения, которые ссылаются на выражение expression_id
+func (s *Storage) GetDependents(expression_id int) ([]int, error) {
+	q := `
+	SELECT expression_id
+	FROM expression_dependencies
+	WHERE depends_on = $1
+	ORDER BY expression_id
+	`
+	return s.queryIDs(q, expression_id)
+}
+
+func (s *Storage) queryIDs(q string, args ...any) ([]int, error) {
+	ids := []int{}
+	ctx := context.TODO()
+	rows, err := s.q.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
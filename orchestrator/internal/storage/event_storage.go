@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+)
+
+func (s *Storage) SaveTaskEvent(event *models.TaskEvent) error {
+	args, err := encodeArgs(event.Args)
+	if err != nil {
+		return err
+	}
+	var result sql.NullFloat64
+	if event.Result != nil {
+		result = sql.NullFloat64{Float64: *event.Result, Valid: true}
+	}
+	q := `
+	INSERT INTO task_events (expression_id, task_id, event, agent_id, operation, args, result, attempt, event_time)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	ctx := context.TODO()
+	res, err := s.q.ExecContext(ctx, q, event.ExpressionID, event.TaskID, event.Event, event.AgentID, event.Operation, args, result, event.Attempt, event.Time.UTC())
+	if err != nil {
+		return err
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	event.ID = int(lastID)
+	return nil
+}
+
+// История задач выражения в порядке событий
+func (s *Storage) GetTaskEvents(expression_id int) ([]models.TaskEvent, error) {
+	var events []models.TaskEvent
+	q := `
+	SELECT event_id, expression_id, task_id, event, agent_id, operation, args, result, attempt, event_time
+	FROM task_events
+	WHERE expression_id = $1
+	ORDER BY event_id
+	`
+	ctx := context.TODO()
+	rows, err := s.q.QueryContext(ctx, q, expression_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event models.TaskEvent
+		var agentID, operation, args sql.NullString
+		var result sql.NullFloat64
+		err := rows.Scan(&event.ID, &event.ExpressionID, &event.TaskID, &event.Event, &agentID, &operation, &args, &result, &event.Attempt, &event.Time)
+		if err != nil {
+			return nil, err
+		}
+		event.AgentID = agentID.String
+		event.Operation = operation.String
+		if result.Valid {
+			event.Result = &result.Float64
+		}
+		event.Args, err = decodeArgs(args.String)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -5,6 +5,7 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -12,6 +13,106 @@ import (
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
 )
 
+const taskColumns = "task_id, status, arg1, arg2, operation, operation_time, expression_id, args, lease_until, agent_id, attempt_token, attempts, available_at, priority, queued_at, user_id"
+
+const expressionColumns = "expression_id, status, result, binary_tree_bytes, user_id, result_value, deadline, priority, total_tasks, created_at, finished_at, error_code, error_message, callback_url, no_cache, batch_id, client_id"
+
+// Общий интерфейс для *sql.Row и *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTask(row scanner) (models.Task, error) {
+	var task models.Task
+	var nanoseconds int64
+	var args sql.NullString
+	var leaseUntil, availableAt, queuedAt sql.NullTime
+	var agentID, attemptToken sql.NullString
+	err := row.Scan(&task.ID, &task.Status, &task.Arg1, &task.Arg2, &task.Operation, &nanoseconds, &task.ExpressionID, &args, &leaseUntil, &agentID, &attemptToken, &task.Attempts, &availableAt, &task.Priority, &queuedAt, &task.UserID)
+	if err != nil {
+		return task, err
+	}
+	task.OperationTime = time.Duration(nanoseconds)
+	task.LeaseUntil = leaseUntil.Time
+	task.AvailableAt = availableAt.Time
+	task.QueuedAt = queuedAt.Time
+	task.AgentID = agentID.String
+	task.AttemptToken = attemptToken.String
+	task.Args, err = decodeArgs(args.String)
+	return task, err
+}
+
+func scanExpression(row scanner) (models.Expression, error) {
+	var expression models.Expression
+	var treeBytes []byte
+	var value sql.NullString
+	var deadline, createdAt, finishedAt sql.NullTime
+	var errorCode, errorMessage, callbackURL, clientID sql.NullString
+	var batchID sql.NullInt64
+	err := row.Scan(&expression.ID, &expression.Status, &expression.Result, &treeBytes, &expression.UserID, &value, &deadline, &expression.Priority, &expression.TotalTasks, &createdAt, &finishedAt, &errorCode, &errorMessage, &callbackURL, &expression.NoCache, &batchID, &clientID)
+	if err != nil {
+		return expression, err
+	}
+	expression.ErrorCode = errorCode.String
+	expression.ErrorMessage = errorMessage.String
+	expression.CallbackURL = callbackURL.String
+	expression.BatchID = int(batchID.Int64)
+	expression.ClientID = clientID.String
+	if deadline.Valid {
+		expression.Deadline = &deadline.Time
+	}
+	expression.CreatedAt = createdAt.Time
+	if finishedAt.Valid {
+		expression.FinishedAt = &finishedAt.Time
+	}
+	expression.Value, err = decodeValue(value.String)
+	if err != nil {
+		return expression, err
+	}
+	tree, err := calculation.DeserializeTree(treeBytes)
+	if err != nil {
+		return expression, err
+	}
+	expression.BinaryTree = &tree
+	return expression, nil
+}
+
+// Аргументы функций храним как JSON массив, у бинарных операций колонка пустая
+func encodeArgs(args []float64) (string, error) {
+	if args == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(args)
+	return string(b), err
+}
+
+func decodeArgs(data string) ([]float64, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var args []float64
+	err := json.Unmarshal([]byte(data), &args)
+	return args, err
+}
+
+// Результат-вектор или матрица хранится как JSON, у чисел колонка пустая
+func encodeValue(value any) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+func decodeValue(data string) (any, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var value any
+	err := json.Unmarshal([]byte(data), &value)
+	return value, err
+}
+
 func (s *Storage) SaveExpression(expression *models.Expression) (int, error) {
 	ctx := context.TODO()
 	var treeBytes []byte
@@ -24,13 +125,28 @@ func (s *Storage) SaveExpression(expression *models.Expression) (int, error) {
 	} else {
 		treeBytes = make([]byte, 0)
 	}
+	value, err := encodeValue(expression.Value)
+	if err != nil {
+		return 0, err
+	}
+	var deadline, finishedAt sql.NullTime
+	if expression.Deadline != nil {
+		deadline = sql.NullTime{Time: expression.Deadline.UTC(), Valid: true}
+	}
+	if expression.FinishedAt != nil {
+		finishedAt = sql.NullTime{Time: expression.FinishedAt.UTC(), Valid: true}
+	}
+	createdAt := sql.NullTime{Time: expression.CreatedAt.UTC(), Valid: !expression.CreatedAt.IsZero()}
+	// Выражения не из пакета храним с пустыми batch_id и client_id
+	batchID := sql.NullInt64{Int64: int64(expression.BatchID), Valid: expression.BatchID != 0}
+	clientID := sql.NullString{String: expression.ClientID, Valid: expression.ClientID != ""}
 
 	if expression.ID == 0 {
 		q := `
-		INSERT INTO expressions (status, result, binary_tree_bytes, user_id, created_at)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO expressions (status, result, binary_tree_bytes, user_id, created_at, result_value, deadline, priority, total_tasks, finished_at, error_code, error_message, callback_url, no_cache, batch_id, client_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
 		`
-		res, err := s.db.ExecContext(ctx, q, expression.Status, expression.Result, treeBytes, expression.UserID, time.Now())
+		res, err := s.q.ExecContext(ctx, q, expression.Status, expression.Result, treeBytes, expression.UserID, createdAt, value, deadline, expression.Priority, expression.TotalTasks, finishedAt, expression.ErrorCode, expression.ErrorMessage, expression.CallbackURL, expression.NoCache, batchID, clientID)
 		if err != nil {
 			return 0, err
 		}
@@ -44,10 +160,10 @@ func (s *Storage) SaveExpression(expression *models.Expression) (int, error) {
 
 	q := `
 	UPDATE expressions
-	SET status = $1, result = $2, binary_tree_bytes = $3, user_id = $4, updated_at = $5
-	WHERE expression_id = $6
+	SET status = $1, result = $2, binary_tree_bytes = $3, user_id = $4, updated_at = $5, result_value = $6, deadline = $7, priority = $8, total_tasks = $9, finished_at = $10, error_code = $11, error_message = $12, callback_url = $13, no_cache = $14, batch_id = $15, client_id = $16
+	WHERE expression_id = $17
 	`
-	_, err = s.db.ExecContext(ctx, q, expression.Status, expression.Result, treeBytes, expression.UserID, time.Now(), expression.ID)
+	_, err = s.q.ExecContext(ctx, q, expression.Status, expression.Result, treeBytes, expression.UserID, time.Now(), value, deadline, expression.Priority, expression.TotalTasks, finishedAt, expression.ErrorCode, expression.ErrorMessage, expression.CallbackURL, expression.NoCache, batchID, clientID, expression.ID)
 	if err != nil {
 		return 0, err
 	}
@@ -57,13 +173,22 @@ func (s *Storage) SaveExpression(expression *models.Expression) (int, error) {
 func (s *Storage) SaveTask(task *models.Task) (int, error) {
 	ctx := context.TODO()
 	nanos := task.OperationTime.Nanoseconds()
+	args, err := encodeArgs(task.Args)
+	if err != nil {
+		return 0, err
+	}
+	// У задачи, которую никто не взял, аренды нет.
+	// Время храним в UTC, иначе строки в sqlite нельзя сравнивать
+	leaseUntil := sql.NullTime{Time: task.LeaseUntil.UTC(), Valid: !task.LeaseUntil.IsZero()}
+	availableAt := sql.NullTime{Time: task.AvailableAt.UTC(), Valid: !task.AvailableAt.IsZero()}
+	queuedAt := sql.NullTime{Time: task.QueuedAt.UTC(), Valid: !task.QueuedAt.IsZero()}
 
 	if task.ID == 0 {
 		q := `
-		INSERT INTO tasks (status, arg1, arg2, operation, operation_time, expression_id)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO tasks (status, arg1, arg2, operation, operation_time, expression_id, args, lease_until, agent_id, attempt_token, attempts, available_at, priority, queued_at, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 		`
-		res, err := s.db.ExecContext(ctx, q, task.Status, task.Arg1, task.Arg2, task.Operation, nanos, task.ExpressionID)
+		res, err := s.q.ExecContext(ctx, q, task.Status, task.Arg1, task.Arg2, task.Operation, nanos, task.ExpressionID, args, leaseUntil, task.AgentID, task.AttemptToken, task.Attempts, availableAt, task.Priority, queuedAt, task.UserID)
 		if err != nil {
 			return 0, err
 		}
@@ -77,10 +202,10 @@ func (s *Storage) SaveTask(task *models.Task) (int, error) {
 
 	q := `
 	UPDATE tasks
-	SET status = $1, arg1 = $2, arg2 = $3, operation = $4, operation_time = $5, expression_id = $6
-	WHERE task_id = $7
+	SET status = $1, arg1 = $2, arg2 = $3, operation = $4, operation_time = $5, expression_id = $6, args = $7, lease_until = $8, agent_id = $9, attempt_token = $10, attempts = $11, available_at = $12, priority = $13, queued_at = $14, user_id = $15
+	WHERE task_id = $16
 	`
-	_, err := s.db.ExecContext(ctx, q, task.Status, task.Arg1, task.Arg2, task.Operation, nanos, task.ExpressionID, task.ID)
+	_, err = s.q.ExecContext(ctx, q, task.Status, task.Arg1, task.Arg2, task.Operation, nanos, task.ExpressionID, args, leaseUntil, task.AgentID, task.AttemptToken, task.Attempts, availableAt, task.Priority, queuedAt, task.UserID, task.ID)
 	if err != nil {
 		return 0, err
 	}
@@ -89,9 +214,9 @@ func (s *Storage) SaveTask(task *models.Task) (int, error) {
 
 func (s *Storage) GetExpressions(user_id int) ([]models.Expression, error) {
 	var expressions []models.Expression
-	var q = "SELECT expression_id, status, result FROM expressions WHERE user_id = $1"
+	var q = "SELECT expression_id, status, result, result_value, error_code, error_message FROM expressions WHERE user_id = $1"
 	ctx := context.TODO()
-	rows, err := s.db.QueryContext(ctx, q, user_id)
+	rows, err := s.q.QueryContext(ctx, q, user_id)
 	if err != nil {
 		return nil, err
 	}
@@ -99,7 +224,14 @@ func (s *Storage) GetExpressions(user_id int) ([]models.Expression, error) {
 
 	for rows.Next() {
 		e := models.Expression{}
-		err := rows.Scan(&e.ID, &e.Status, &e.Result)
+		var value, errorCode, errorMessage sql.NullString
+		err := rows.Scan(&e.ID, &e.Status, &e.Result, &value, &errorCode, &errorMessage)
+		if err != nil {
+			return nil, err
+		}
+		e.ErrorCode = errorCode.String
+		e.ErrorMessage = errorMessage.String
+		e.Value, err = decodeValue(value.String)
 		if err != nil {
 			return nil, err
 		}
@@ -111,19 +243,16 @@ func (s *Storage) GetExpressions(user_id int) ([]models.Expression, error) {
 
 func (s *Storage) GetTasks() []models.Task {
 	var tasks []models.Task
-	var q = "SELECT task_id, status, arg1, arg2, operation, operation_time, expression_id FROM tasks"
+	var q = "SELECT " + taskColumns + " FROM tasks"
 	ctx := context.TODO()
-	rows, err := s.db.QueryContext(ctx, q)
+	rows, err := s.q.QueryContext(ctx, q)
 	if err != nil {
 		return nil
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		t := models.Task{}
-		var nanoseconds int64
-		err := rows.Scan(&t.ID, &t.Status, &t.Arg1, &t.Arg2, &t.Operation, &nanoseconds, &t.ExpressionID)
-		t.OperationTime = time.Duration(nanoseconds)
+		t, err := scanTask(rows)
 		if err != nil {
 			return nil
 		}
@@ -134,17 +263,14 @@ func (s *Storage) GetTasks() []models.Task {
 }
 
 func (s *Storage) GetPendingTask() (models.Task, error) {
-	var task models.Task
 	var q = `
-	SELECT task_id, status, arg1, arg2, operation, operation_time, expression_id 
+	SELECT ` + taskColumns + `
 	FROM tasks
 	WHERE status = $1
 	LIMIT 1
 	`
 	ctx := context.TODO()
-	var nanoseconds int64
-	err := s.db.QueryRowContext(ctx, q, "pending").Scan(&task.ID, &task.Status, &task.Arg1, &task.Arg2, &task.Operation, &nanoseconds, &task.ExpressionID)
-	task.OperationTime = time.Duration(nanoseconds)
+	task, err := scanTask(s.q.QueryRowContext(ctx, q, models.TaskPending))
 	if errors.Is(err, sql.ErrNoRows) {
 		return task, ErrItemNotFound
 	} else if err != nil {
@@ -153,30 +279,177 @@ func (s *Storage) GetPendingTask() (models.Task, error) {
 	return task, nil
 }
 
-// Удаление всех задач, связанных с выражением
+// Кандидаты на выдачу: для каждого пользователя и приоритета самая давняя задача, которую можно выдать к моменту now.
+// Остальные задачи того же пользователя и приоритета ждут меньше, поэтому раньше кандидата их выдавать незачем
+func (s *Storage) GetClaimCandidates(now time.Time) ([]models.Task, error) {
+	var q = `
+	SELECT ` + taskColumns + `
+	FROM (
+		SELECT *, ROW_NUMBER() OVER (PARTITION BY user_id, priority ORDER BY queued_at, task_id) AS position
+		FROM tasks
+		WHERE status = $1 AND (available_at IS NULL OR available_at <= $2)
+	)
+	WHERE position = 1
+	ORDER BY task_id
+	`
+	return s.queryTasks(q, models.TaskPending, now.UTC())
+}
+
+// Закрепляет задачу за агентом, если ее еще никто не взял. Срок аренды считает вызывающий по времени операции.
+// Каждая выдача получает новый token, результат принимается только с ним
+func (s *Storage) ClaimTask(task *models.Task, agentID string, token string, leaseUntil time.Time) error {
+	var q = `
+	UPDATE tasks
+	SET status = $1, agent_id = $2, attempt_token = $3, lease_until = $4, attempts = attempts + 1
+	WHERE task_id = $5 AND status = $6
+	`
+	ctx := context.TODO()
+	res, err := s.q.ExecContext(ctx, q, models.TaskInProgress, agentID, token, leaseUntil.UTC(), task.ID, models.TaskPending)
+	if err != nil {
+		return err
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if claimed == 0 {
+		return ErrItemNotFound
+	}
+	task.Status = models.TaskInProgress
+	task.AgentID = agentID
+	task.AttemptToken = token
+	task.LeaseUntil = leaseUntil
+	task.Attempts++
+	return nil
+}
+
+func (s *Storage) CompleteTask(task_id int, token string, now time.Time) (bool, error) {
+	var q = `
+	UPDATE tasks
+	SET status = $1, lease_until = NULL
+	WHERE task_id = $2 AND attempt_token = $3 AND status = $4 AND lease_until >= $5
+	`
+	ctx := context.TODO()
+	res, err := s.q.ExecContext(ctx, q, models.TaskDone, task_id, token, models.TaskInProgress, now.UTC())
+	if err != nil {
+		return false, err
+	}
+	completed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return completed == 1, nil
+}
+
+// Взятые задачи, аренда которых истекла к моменту now.
+// Что с ними делать, решает вызывающий. Чтобы не вернуть задачу, результат которой как раз сохраняется,
+// выбор и изменение должны идти в одной транзакции
+func (s *Storage) GetExpiredTasks(now time.Time) ([]models.Task, error) {
+	var q = `
+	SELECT ` + taskColumns + `
+	FROM tasks
+	WHERE status = $1 AND lease_until < $2
+	ORDER BY task_id
+	`
+	return s.queryTasks(q, models.TaskInProgress, now.UTC())
+}
+
+// Задачи в статусе status
+func (s *Storage) GetTasksByStatus(status models.TaskStatus) ([]models.Task, error) {
+	var q = `
+	SELECT ` + taskColumns + `
+	FROM tasks
+	WHERE status = $1
+	ORDER BY task_id
+	`
+	return s.queryTasks(q, status)
+}
+
+func (s *Storage) queryTasks(q string, args ...any) ([]models.Task, error) {
+	var tasks []models.Task
+	ctx := context.TODO()
+	rows, err := s.q.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// Удаление всех задач, связанных с выражением.
+// Задачи из dead-letter остаются, их разбирает администратор
 func (s *Storage) DeleteTaskByExpressionID(expression_id int) error {
-	var q = "DELETE FROM tasks WHERE expression_id = $1"
+	var q = "DELETE FROM tasks WHERE expression_id = $1 AND status IS NOT $2"
 	ctx := context.TODO()
-	_, err := s.db.ExecContext(ctx, q, expression_id)
+	_, err := s.q.ExecContext(ctx, q, expression_id, models.TaskDead)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Отмена задач выражения: ожидающие удаляются, а взятые агентами помечаются cancelled.
+// По пометке агент узнает, что считать дальше не нужно, а пришедший результат отбрасывается
+func (s *Storage) CancelTasksByExpressionID(expression_id int) error {
+	ctx := context.TODO()
+	_, err := s.q.ExecContext(ctx, "DELETE FROM tasks WHERE expression_id = $1 AND status = $2", expression_id, models.TaskPending)
+	if err != nil {
+		return err
+	}
+	var q = `
+	UPDATE tasks
+	SET status = $1, lease_until = NULL
+	WHERE expression_id = $2 AND status = $3
+	`
+	_, err = s.q.ExecContext(ctx, q, models.TaskCancelled, expression_id, models.TaskInProgress)
+	return err
+}
+
+// Отмененные задачи, которые еще числятся за агентом
+func (s *Storage) GetCancelledTasks(agentID string) ([]models.Task, error) {
+	var q = `
+	SELECT ` + taskColumns + `
+	FROM tasks
+	WHERE status = $1 AND agent_id = $2
+	ORDER BY task_id
+	`
+	return s.queryTasks(q, models.TaskCancelled, agentID)
+}
+
+// Задачи выражения, которые еще не закрыты вместе с ним
+func (s *Storage) GetTasksByExpressionID(expression_id int) ([]models.Task, error) {
+	var q = `
+	SELECT ` + taskColumns + `
+	FROM tasks
+	WHERE expression_id = $1
+	ORDER BY task_id
+	`
+	return s.queryTasks(q, expression_id)
+}
+
+func (s *Storage) DeleteTask(task_id int) error {
+	var q = "DELETE FROM tasks WHERE task_id = $1"
+	ctx := context.TODO()
+	_, err := s.q.ExecContext(ctx, q, task_id)
+	return err
+}
+
 func (s *Storage) GetTask(task_id int) (models.Task, error) {
-	var task models.Task
 	var q = `
-	SELECT task_id, status, arg1, arg2, operation, operation_time, expression_id 
+	SELECT ` + taskColumns + `
 	FROM tasks
 	WHERE task_id = $1
 	`
 	ctx := context.TODO()
-	var nanoseconds int64
-	err := s.db.QueryRowContext(ctx, q, task_id).Scan(
-		&task.ID, &task.Status, &task.Arg1, &task.Arg2, &task.Operation, &nanoseconds, &task.ExpressionID,
-	)
-	task.OperationTime = time.Duration(nanoseconds)
+	task, err := scanTask(s.q.QueryRowContext(ctx, q, task_id))
 	if errors.Is(err, sql.ErrNoRows) {
 		return task, ErrItemNotFound
 	} else if err != nil {
@@ -186,24 +459,68 @@ func (s *Storage) GetTask(task_id int) (models.Task, error) {
 }
 
 func (s *Storage) GetExpression(expression_id int) (models.Expression, error) {
-	var expression models.Expression
 	var q = `
-	SELECT expression_id, status, result, binary_tree_bytes, user_id
+	SELECT ` + expressionColumns + `
 	FROM expressions
 	WHERE expression_id = $1
 	`
 	ctx := context.TODO()
-	var treeBytes []byte
-	err := s.db.QueryRowContext(ctx, q, expression_id).Scan(&expression.ID, &expression.Status, &expression.Result, &treeBytes, &expression.UserID)
+	expression, err := scanExpression(s.q.QueryRowContext(ctx, q, expression_id))
 	if errors.Is(err, sql.ErrNoRows) {
 		return expression, ErrItemNotFound
 	} else if err != nil {
 		return expression, err
 	}
-	tree, err := calculation.DeserializeTree(treeBytes)
+	return expression, nil
+}
+
+// Выражения в статусе status вместе с деревьями. Нужно для восстановления после перезапуска
+func (s *Storage) GetExpressionsByStatus(status models.ExpressionStatus) ([]models.Expression, error) {
+	var expressions []models.Expression
+	var q = `
+	SELECT ` + expressionColumns + `
+	FROM expressions
+	WHERE status = $1
+	`
+	ctx := context.TODO()
+	rows, err := s.q.QueryContext(ctx, q, status)
 	if err != nil {
-		return expression, err
+		return nil, err
 	}
-	expression.BinaryTree = &tree
-	return expression, nil
+	defer rows.Close()
+
+	for rows.Next() {
+		expression, err := scanExpression(rows)
+		if err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, expression)
+	}
+	return expressions, rows.Err()
+}
+
+// Нерешенные выражения, срок которых истек к моменту now
+func (s *Storage) GetExpiredExpressions(now time.Time) ([]models.Expression, error) {
+	var expressions []models.Expression
+	var q = `
+	SELECT ` + expressionColumns + `
+	FROM expressions
+	WHERE status = $1 AND deadline < $2
+	ORDER BY expression_id
+	`
+	ctx := context.TODO()
+	rows, err := s.q.QueryContext(ctx, q, models.ExpressionProcessing, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		expression, err := scanExpression(rows)
+		if err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, expression)
+	}
+	return expressions, rows.Err()
 }
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"os"
 	"path/filepath"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -15,7 +16,10 @@ func createTables(ctx context.Context, db *sql.DB) error {
 	CREATE TABLE IF NOT EXISTS users(
 		user_id INTEGER PRIMARY KEY AUTOINCREMENT,
 		login TEXT UNIQUE, 
-		password TEXT
+		password TEXT,
+		locale TEXT NOT NULL DEFAULT '', --формат чисел, пусто значит по умолчанию
+		role TEXT NOT NULL DEFAULT 'user',
+		webhook_secret TEXT NOT NULL DEFAULT '' --ключ подписи вебхуков, создается при первой надобности
 	);`
 
 		expressionsTable = `
@@ -27,6 +31,17 @@ func createTables(ctx context.Context, db *sql.DB) error {
 		user_id INTEGER,
 		created_at TIMESTAMP,
 		updated_at TIMESTAMP,
+		result_value TEXT, --результат-вектор или матрица в JSON
+		deadline TIMESTAMP, --срок решения, пусто значит без срока
+		priority INTEGER NOT NULL DEFAULT 5,
+		total_tasks INTEGER NOT NULL DEFAULT 0, --сколько задач в выражении
+		finished_at TIMESTAMP, --когда выражение перестало считаться
+		error_code TEXT, --причина ошибки у выражений в статусе error
+		error_message TEXT,
+		callback_url TEXT, --адрес вебхука этого выражения
+		no_cache INTEGER NOT NULL DEFAULT 0, --не брать результаты задач из кэша
+		batch_id INTEGER, --пакет, в котором выражение отправлено
+		client_id TEXT, --ID выражения в пакете, который дал клиент
 
 		FOREIGN KEY (user_id) REFERENCES users (user_id)
 	);`
@@ -39,8 +54,92 @@ func createTables(ctx context.Context, db *sql.DB) error {
 		operation TEXT,
 		operation_time INTEGER, --наносекунды
 		expression_id INTEGER,
+		args TEXT, --аргументы функции в JSON
+		lease_until TIMESTAMP, --до какого времени задача закреплена за агентом
+		agent_id TEXT, --агент, который взял задачу
+		attempt_token TEXT, --токен последней выдачи, с ним агент присылает результат
+		attempts INTEGER NOT NULL DEFAULT 0, --сколько раз задачу выдавали
+		available_at TIMESTAMP, --раньше этого времени задачу не выдаем, пауза между попытками
+		priority INTEGER NOT NULL DEFAULT 5, --приоритет выражения
+		queued_at TIMESTAMP, --когда задача встала в очередь
+		user_id INTEGER NOT NULL DEFAULT 0, --владелец выражения
 
 		FOREIGN KEY (expression_id) REFERENCES expressions (expression_id)
+	);`
+		// История задач. Сами задачи удаляются вместе с выражением, а история остается
+		taskEventsTable = `
+	CREATE TABLE IF NOT EXISTS task_events(
+		event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		expression_id INTEGER NOT NULL,
+		task_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		agent_id TEXT,
+		operation TEXT,
+		args TEXT, --операнды задачи в JSON
+		result REAL,
+		attempt INTEGER NOT NULL DEFAULT 0,
+		event_time TIMESTAMP,
+
+		FOREIGN KEY (expression_id) REFERENCES expressions (expression_id)
+	);
+	CREATE INDEX IF NOT EXISTS task_events_expression_id ON task_events (expression_id);`
+		// Ссылки выражений на результаты других выражений ($42)
+		dependenciesTable = `
+	CREATE TABLE IF NOT EXISTS expression_dependencies(
+		expression_id INTEGER NOT NULL, --выражение, которое ждет
+		depends_on INTEGER NOT NULL, --выражение, результат которого нужен
+
+		PRIMARY KEY (expression_id, depends_on),
+		FOREIGN KEY (expression_id) REFERENCES expressions (expression_id),
+		FOREIGN KEY (depends_on) REFERENCES expressions (expression_id)
+	);
+	CREATE INDEX IF NOT EXISTS expression_dependencies_depends_on ON expression_dependencies (depends_on);`
+		batchesTable = `
+	CREATE TABLE IF NOT EXISTS batches(
+		batch_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		total INTEGER NOT NULL DEFAULT 0, --сколько выражений отправлено
+		created_at TIMESTAMP,
+
+		FOREIGN KEY (user_id) REFERENCES users (user_id)
+	);`
+		webhooksTable = `
+	CREATE TABLE IF NOT EXISTS webhooks(
+		webhook_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		created_at TIMESTAMP,
+
+		FOREIGN KEY (user_id) REFERENCES users (user_id)
+	);`
+		// Доставки вебхуков и каждая попытка доставки. Остаются после удаления вебхука
+		webhookDeliveriesTable = `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries(
+		delivery_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		expression_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		url TEXT NOT NULL,
+		payload TEXT NOT NULL, --тело запроса в JSON
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP, --раньше этого времени не отправляем
+		created_at TIMESTAMP,
+		delivered_at TIMESTAMP,
+
+		FOREIGN KEY (expression_id) REFERENCES expressions (expression_id)
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);
+	CREATE TABLE IF NOT EXISTS webhook_attempts(
+		attempt_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		delivery_id INTEGER NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER, --пусто, если ответа не было
+		error TEXT,
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		attempt_time TIMESTAMP,
+
+		FOREIGN KEY (delivery_id) REFERENCES webhook_deliveries (delivery_id)
 	);`
 	)
 
@@ -56,29 +155,118 @@ func createTables(ctx context.Context, db *sql.DB) error {
 		return err
 	}
 
+	if _, err := db.ExecContext(ctx, taskEventsTable); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, dependenciesTable); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, batchesTable); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, webhooksTable); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, webhookDeliveriesTable); err != nil {
+		return err
+	}
+
+	return migrate(ctx, db)
+}
+
+// Колонки, которые появились после первой версии базы, и перенос данных в них.
+// CREATE TABLE IF NOT EXISTS не трогает существующие таблицы, поэтому добавляем их отдельно.
+// Миграции выполняются при каждом запуске, поэтому повторный запуск ничего не должен менять
+var migrations = []string{
+	`ALTER TABLE tasks ADD COLUMN args TEXT`,
+	`ALTER TABLE expressions ADD COLUMN result_value TEXT`,
+	`ALTER TABLE users ADD COLUMN locale TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tasks ADD COLUMN lease_until TIMESTAMP`,
+	`ALTER TABLE tasks ADD COLUMN agent_id TEXT`,
+	`ALTER TABLE tasks ADD COLUMN attempt_token TEXT`,
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user'`,
+	`ALTER TABLE expressions ADD COLUMN deadline TIMESTAMP`,
+	`ALTER TABLE tasks ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE tasks ADD COLUMN available_at TIMESTAMP`,
+	`ALTER TABLE expressions ADD COLUMN priority INTEGER NOT NULL DEFAULT 5`,
+	`ALTER TABLE tasks ADD COLUMN priority INTEGER NOT NULL DEFAULT 5`,
+	`ALTER TABLE tasks ADD COLUMN queued_at TIMESTAMP`,
+	`ALTER TABLE tasks ADD COLUMN user_id INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE expressions ADD COLUMN total_tasks INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE expressions ADD COLUMN finished_at TIMESTAMP`,
+	`ALTER TABLE expressions ADD COLUMN error_code TEXT`,
+	`ALTER TABLE expressions ADD COLUMN error_message TEXT`,
+	// Раньше причина ошибки хранилась в самом статусе: "error division by zero"
+	`UPDATE expressions
+	SET error_code = CASE
+			WHEN status = 'error timeout' THEN 'timeout'
+			WHEN status = 'error division by zero' THEN 'division_by_zero'
+			WHEN status LIKE 'error invalid function argument%' THEN 'invalid_argument'
+			WHEN status LIKE 'error task % failed after % attempts' THEN 'task_failed'
+			WHEN status LIKE 'error task_id not found%' THEN 'internal'
+			ELSE 'invalid_operation'
+		END,
+		error_message = substr(status, length('error ') + 1),
+		status = 'error'
+	WHERE status LIKE 'error %'`,
+	`ALTER TABLE expressions ADD COLUMN callback_url TEXT`,
+	`ALTER TABLE users ADD COLUMN webhook_secret TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE expressions ADD COLUMN no_cache INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE expressions ADD COLUMN batch_id INTEGER`,
+	`ALTER TABLE expressions ADD COLUMN client_id TEXT`,
+	// Индекс после колонки: в старой базе ее до миграции нет
+	`CREATE INDEX IF NOT EXISTS expressions_batch_id ON expressions (batch_id)`,
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	for _, q := range migrations {
+		_, err := db.ExecContext(ctx, q)
+		// Свежая база уже создана с этими колонками
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
 	return nil
 }
 
 type Storage struct {
 	db *sql.DB
+	q  querier // сама база или открытая транзакция, см. InTx
 }
 
 func NewStorage(for_tests bool) *Storage {
-	ctx := context.TODO()
-	
+	if for_tests {
+		return Open(":memory:")
+	}
 	dbDir := filepath.Join("orchestrator", "storage")
 	if _, err := os.Stat(dbDir); os.IsNotExist(err) {
 		os.Mkdir(dbDir, 0777)
 	}
-	dbPath := filepath.Join(dbDir, "store.db")
+	return Open(filepath.Join(dbDir, "store.db"))
+}
 
-	if for_tests {
-		dbPath = ":memory:"
+// Открывает базу в файле dbPath, ":memory:" - в памяти
+func Open(dbPath string) *Storage {
+	ctx := context.TODO()
+
+	// Читатели не мешают писателю (WAL), транзакция сразу берет блокировку на запись,
+	// а кто не успел, ждет ее, а не получает "database is locked"
+	dsn := "file:" + dbPath + "?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+	if dbPath == ":memory:" {
+		dsn = dbPath
 	}
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		panic(err)
 	}
+	if dbPath == ":memory:" {
+		// У каждого соединения с :memory: своя база, поэтому соединение одно
+		db.SetMaxOpenConns(1)
+	}
 
 	err = db.PingContext(ctx)
 	if err != nil {
@@ -90,6 +278,7 @@ func NewStorage(for_tests bool) *Storage {
 	}
 	return &Storage{
 		db: db,
+		q:  db,
 	}
 }
 
@@ -1,10 +1,17 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -58,6 +65,31 @@ func TestSaveAndGetUser(t *testing.T) {
 	}
 }
 
+func TestUpdateUserLocale(t *testing.T) {
+	st := NewStorage(true)
+	defer st.Close()
+
+	user := &models.User{Login: "bob", PasswordHash: "pass"}
+	_, err := st.SaveUser(user)
+	require.NoError(t, err)
+
+	userFromDB, err := st.GetUserByID(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, "", userFromDB.Locale)
+
+	userFromDB.Locale = "de"
+	_, err = st.SaveUser(&userFromDB)
+	require.NoError(t, err)
+
+	userFromDB, err = st.GetUserByID(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, "de", userFromDB.Locale)
+	require.Equal(t, "pass", userFromDB.PasswordHash)
+
+	_, err = st.GetUserByID(user.ID + 1)
+	require.ErrorIs(t, err, ErrItemNotFound)
+}
+
 func TestSaveAndGetExpression(t *testing.T) {
 	storage := NewStorage(true)
 	defer storage.Close()
@@ -129,6 +161,15 @@ func TestSaveAndGetTask(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "create task with function arguments",
+			task: &models.Task{
+				Status:    "pending",
+				Operation: "pmt",
+				Args:      []float64{0.01, 12, 1000},
+			},
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -231,11 +272,303 @@ func TestGetPendingTask(t *testing.T) {
 			}
 			task, err := storage.GetPendingTask()
 			require.NoError(t, err)
-			require.Equal(t, "pending", task.Status)
+			require.Equal(t, models.TaskPending, task.Status)
 		})
 	}
 }
 
+func TestGetClaimCandidates(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	now := time.Now()
+	older := &models.Task{Status: "pending", Priority: 5, QueuedAt: now.Add(-time.Minute)}
+	newer := &models.Task{Status: "pending", Priority: 5, QueuedAt: now}
+	high := &models.Task{Status: "pending", Priority: 9, QueuedAt: now}
+	done := &models.Task{Status: "done", Priority: 1, QueuedAt: now}
+	// Задачу после неудачной попытки не выдаем, пока не пройдет пауза
+	retry := &models.Task{Status: "pending", Priority: 0, QueuedAt: now, AvailableAt: now.Add(time.Minute)}
+	// У другого пользователя своя очередь
+	otherUser := &models.Task{Status: "pending", Priority: 5, QueuedAt: now, UserID: 2}
+	for _, task := range []*models.Task{older, newer, high, done, retry, otherUser} {
+		_, err := storage.SaveTask(task)
+		require.NoError(t, err)
+	}
+
+	candidates, err := storage.GetClaimCandidates(now)
+	require.NoError(t, err)
+	require.Len(t, candidates, 3)
+	require.Equal(t, older.ID, candidates[0].ID)
+	require.Equal(t, high.ID, candidates[1].ID)
+	require.Equal(t, otherUser.ID, candidates[2].ID)
+	require.Equal(t, 2, candidates[2].UserID)
+	require.True(t, candidates[0].QueuedAt.Equal(older.QueuedAt))
+
+	candidates, err = storage.GetClaimCandidates(now.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, candidates, 4)
+	require.Equal(t, retry.ID, candidates[2].ID)
+}
+
+func TestClaimTask(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	task := &models.Task{Status: "pending", OperationTime: time.Second}
+	_, err := storage.SaveTask(task)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, storage.ClaimTask(task, "agent-1", "token-1", now.Add(time.Second)))
+	require.Equal(t, 1, task.Attempts)
+
+	fromDB, err := storage.GetTask(task.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.TaskInProgress, fromDB.Status)
+	require.Equal(t, "agent-1", fromDB.AgentID)
+	require.Equal(t, "token-1", fromDB.AttemptToken)
+	require.True(t, fromDB.LeaseUntil.Equal(now.Add(time.Second)))
+	require.Equal(t, 1, fromDB.Attempts)
+
+	// Задачу уже взяли, второй раз ее не выдаем
+	other := fromDB
+	require.ErrorIs(t, storage.ClaimTask(&other, "agent-2", "token-2", now), ErrItemNotFound)
+}
+
+// Агенты читают очередь и берут задачи без транзакции, через разные соединения. Задачу, которую
+// между чтением и захватом уже взял другой, UPDATE не находит по статусу, и второй раз она не выдается
+func TestClaimTaskConcurrent(t *testing.T) {
+	storage := Open(filepath.Join(t.TempDir(), "store.db"))
+	defer storage.Close()
+
+	const tasksCount = 50
+	for i := 0; i < tasksCount; i++ {
+		_, err := storage.SaveTask(&models.Task{Status: models.TaskPending})
+		require.NoError(t, err)
+	}
+
+	var mu sync.Mutex
+	claimed := map[int]string{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(agentID string) {
+			defer wg.Done()
+			for {
+				task, err := storage.GetPendingTask()
+				if errors.Is(err, ErrItemNotFound) {
+					return
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				err = storage.ClaimTask(&task, agentID, agentID, time.Now().Add(time.Minute))
+				if errors.Is(err, ErrItemNotFound) {
+					continue
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				mu.Lock()
+				if previous, ok := claimed[task.ID]; ok {
+					t.Errorf("task %d claimed twice: by %s and %s", task.ID, previous, agentID)
+				}
+				claimed[task.ID] = agentID
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("agent-%d", i))
+	}
+	wg.Wait()
+
+	require.Len(t, claimed, tasksCount)
+	for _, task := range storage.GetTasks() {
+		require.Equal(t, 1, task.Attempts)
+		require.Equal(t, claimed[task.ID], task.AgentID)
+	}
+}
+
+func TestCompleteTask(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	now := time.Now()
+	task := &models.Task{Status: "in progress", AttemptToken: "token", LeaseUntil: now.Add(time.Minute)}
+	_, err := storage.SaveTask(task)
+	require.NoError(t, err)
+
+	completed, err := storage.CompleteTask(task.ID, "other", now)
+	require.NoError(t, err)
+	require.False(t, completed)
+
+	completed, err = storage.CompleteTask(task.ID, "token", now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.False(t, completed)
+
+	completed, err = storage.CompleteTask(task.ID, "token", now)
+	require.NoError(t, err)
+	require.True(t, completed)
+
+	// Второй раз тот же результат не принимается
+	completed, err = storage.CompleteTask(task.ID, "token", now)
+	require.NoError(t, err)
+	require.False(t, completed)
+
+	fromDB, err := storage.GetTask(task.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.TaskDone, fromDB.Status)
+}
+
+func TestGetExpiredTasks(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	now := time.Now()
+	expired := &models.Task{Status: "in progress", LeaseUntil: now.Add(-time.Second), Attempts: 2}
+	leased := &models.Task{Status: "in progress", LeaseUntil: now.Add(time.Minute)}
+	done := &models.Task{Status: "done", LeaseUntil: now.Add(-time.Second)}
+	for _, task := range []*models.Task{expired, leased, done} {
+		_, err := storage.SaveTask(task)
+		require.NoError(t, err)
+	}
+
+	tasks, err := storage.GetExpiredTasks(now)
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, expired.ID, tasks[0].ID)
+	require.Equal(t, 2, tasks[0].Attempts)
+}
+
+func TestDeleteTaskByExpressionIDKeepsDeadTasks(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	dead := &models.Task{Status: "dead", ExpressionID: 1}
+	pending := &models.Task{Status: "pending", ExpressionID: 1}
+	for _, task := range []*models.Task{dead, pending} {
+		_, err := storage.SaveTask(task)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, storage.DeleteTaskByExpressionID(1))
+	tasks, err := storage.GetTasksByStatus("dead")
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, dead.ID, tasks[0].ID)
+	require.Len(t, storage.GetTasks(), 1)
+}
+
+func TestCancelTasksByExpressionID(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	pending := &models.Task{Status: "pending", ExpressionID: 1}
+	leased := &models.Task{Status: "in progress", ExpressionID: 1, AgentID: "agent-1", LeaseUntil: time.Now().Add(time.Minute)}
+	done := &models.Task{Status: "done", ExpressionID: 1}
+	other := &models.Task{Status: "pending", ExpressionID: 2}
+	for _, task := range []*models.Task{pending, leased, done, other} {
+		_, err := storage.SaveTask(task)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, storage.CancelTasksByExpressionID(1))
+
+	_, err := storage.GetTask(pending.ID)
+	require.ErrorIs(t, err, ErrItemNotFound)
+
+	task, err := storage.GetTask(leased.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.TaskCancelled, task.Status)
+	require.True(t, task.LeaseUntil.IsZero())
+
+	task, err = storage.GetTask(done.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.TaskDone, task.Status)
+
+	task, err = storage.GetTask(other.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.TaskPending, task.Status)
+
+	// Сборщик аренд отмененные задачи не видит
+	expired, err := storage.GetExpiredTasks(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, expired)
+
+	cancelled, err := storage.GetCancelledTasks("agent-1")
+	require.NoError(t, err)
+	require.Len(t, cancelled, 1)
+	require.Equal(t, leased.ID, cancelled[0].ID)
+
+	cancelled, err = storage.GetCancelledTasks("agent-2")
+	require.NoError(t, err)
+	require.Empty(t, cancelled)
+}
+
+func TestGetExpiredExpressions(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	now := time.Now()
+	past := now.Add(-time.Second)
+	future := now.Add(time.Minute)
+	expired := &models.Expression{Status: "processing", BinaryTree: &calculation.Tree{}, Deadline: &past}
+	pending := &models.Expression{Status: "processing", BinaryTree: &calculation.Tree{}, Deadline: &future}
+	solved := &models.Expression{Status: "solve", BinaryTree: &calculation.Tree{}, Deadline: &past}
+	unlimited := &models.Expression{Status: "processing", BinaryTree: &calculation.Tree{}}
+	for _, expression := range []*models.Expression{expired, pending, solved, unlimited} {
+		_, err := storage.SaveExpression(expression)
+		require.NoError(t, err)
+	}
+
+	expressions, err := storage.GetExpiredExpressions(now)
+	require.NoError(t, err)
+	require.Len(t, expressions, 1)
+	require.Equal(t, expired.ID, expressions[0].ID)
+	require.True(t, expressions[0].Deadline.Equal(past))
+}
+
+func TestInTx(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	err := storage.InTx(func(tx *Storage) error {
+		_, err := tx.SaveTask(&models.Task{Status: "pending"})
+		return err
+	})
+	require.NoError(t, err)
+	require.Len(t, storage.GetTasks(), 1)
+
+	// Ошибка откатывает все изменения транзакции
+	errRollback := errors.New("rollback")
+	err = storage.InTx(func(tx *Storage) error {
+		_, err := tx.SaveTask(&models.Task{Status: "pending"})
+		require.NoError(t, err)
+		require.Len(t, tx.GetTasks(), 2)
+		return errRollback
+	})
+	require.ErrorIs(t, err, errRollback)
+	require.Len(t, storage.GetTasks(), 1)
+
+	// Паника тоже
+	func() {
+		defer func() { require.NotNil(t, recover()) }()
+		storage.InTx(func(tx *Storage) error {
+			tx.SaveTask(&models.Task{Status: "pending"})
+			panic("crash")
+		})
+	}()
+	require.Len(t, storage.GetTasks(), 1)
+
+	// Вложенный вызов идет в той же транзакции
+	err = storage.InTx(func(tx *Storage) error {
+		return tx.InTx(func(nested *Storage) error {
+			_, err := nested.SaveTask(&models.Task{Status: "pending"})
+			return err
+		})
+	})
+	require.NoError(t, err)
+	require.Len(t, storage.GetTasks(), 2)
+}
+
 func TestDeleteTaskByExpressionID(t *testing.T) {
 	storage := NewStorage(true)
 	defer storage.Close()
@@ -267,3 +600,210 @@ func TestDeleteTaskByExpressionID(t *testing.T) {
 		})
 	}
 }
+
+func TestTaskEvents(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	now := time.Now().UTC()
+	result := 3.0
+	events := []*models.TaskEvent{
+		{ExpressionID: 1, TaskID: 1, Event: "created", Operation: "+", Args: []float64{1, 2}, Time: now},
+		{ExpressionID: 2, TaskID: 2, Event: "created", Operation: "sum", Args: []float64{1, 2, 3}, Time: now},
+		{ExpressionID: 1, TaskID: 1, Event: "completed", AgentID: "agent", Operation: "+", Args: []float64{1, 2}, Result: &result, Attempt: 1, Time: now.Add(time.Second)},
+	}
+	for _, event := range events {
+		require.NoError(t, storage.SaveTaskEvent(event))
+	}
+
+	saved, err := storage.GetTaskEvents(1)
+	require.NoError(t, err)
+	require.Len(t, saved, 2)
+	require.Equal(t, "created", saved[0].Event)
+	require.Nil(t, saved[0].Result)
+	require.Equal(t, events[2].ID, saved[1].ID)
+	require.Equal(t, "agent", saved[1].AgentID)
+	require.Equal(t, []float64{1, 2}, saved[1].Args)
+	require.Equal(t, 3.0, *saved[1].Result)
+	require.True(t, saved[1].Time.Equal(now.Add(time.Second)))
+}
+
+func TestMigrateErrorStatuses(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	// Так выражения с ошибкой хранились до появления error_code и error_message
+	legacy := map[string][2]string{
+		"error division by zero":                                    {"division_by_zero", "division by zero"},
+		"error invalid function argument: nCr: k must not exceed n": {"invalid_argument", "invalid function argument: nCr: k must not exceed n"},
+		"error timeout":                           {"timeout", "timeout"},
+		"error task 7 failed after 5 attempts":    {"task_failed", "task 7 failed after 5 attempts"},
+		"error task_id not found. critical error": {"internal", "task_id not found. critical error"},
+	}
+	ids := map[string]int{}
+	for status := range legacy {
+		res, err := storage.db.Exec(`INSERT INTO expressions (status, result, binary_tree_bytes, user_id) VALUES ($1, 0, '', 1)`, status)
+		require.NoError(t, err)
+		id, err := res.LastInsertId()
+		require.NoError(t, err)
+		ids[status] = int(id)
+	}
+	solved := &models.Expression{Status: models.ExpressionSolved, BinaryTree: &calculation.Tree{}}
+	_, err := storage.SaveExpression(solved)
+	require.NoError(t, err)
+
+	// Повторный запуск миграций ничего не меняет
+	for range 2 {
+		require.NoError(t, migrate(context.TODO(), storage.db))
+	}
+
+	for status, want := range legacy {
+		expression, err := storage.GetExpression(ids[status])
+		require.NoError(t, err)
+		require.Equal(t, models.ExpressionError, expression.Status)
+		require.Equal(t, want[0], expression.ErrorCode, status)
+		require.Equal(t, want[1], expression.ErrorMessage, status)
+	}
+	expression, err := storage.GetExpression(solved.ID)
+	require.NoError(t, err)
+	require.Equal(t, models.ExpressionSolved, expression.Status)
+	require.Empty(t, expression.ErrorCode)
+}
+
+func TestWebhooks(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	user_id, err := storage.SaveUser(&models.User{Login: "hooks"})
+	require.NoError(t, err)
+	now := time.Now().UTC()
+
+	webhook := &models.Webhook{UserID: user_id, URL: "http://example.com/hook", CreatedAt: now}
+	require.NoError(t, storage.SaveWebhook(webhook))
+	webhooks, err := storage.GetWebhooks(user_id)
+	require.NoError(t, err)
+	require.Len(t, webhooks, 1)
+	require.Equal(t, "http://example.com/hook", webhooks[0].URL)
+	require.ErrorIs(t, storage.DeleteWebhook(webhook.ID, user_id+1), ErrItemNotFound)
+	require.NoError(t, storage.DeleteWebhook(webhook.ID, user_id))
+	webhooks, err = storage.GetWebhooks(user_id)
+	require.NoError(t, err)
+	require.Empty(t, webhooks)
+
+	secret, err := storage.GetWebhookSecret(user_id)
+	require.NoError(t, err)
+	require.Empty(t, secret)
+	require.NoError(t, storage.SetWebhookSecret(user_id, "key"))
+	secret, err = storage.GetWebhookSecret(user_id)
+	require.NoError(t, err)
+	require.Equal(t, "key", secret)
+	require.ErrorIs(t, storage.SetWebhookSecret(user_id+1, "key"), ErrItemNotFound)
+
+	later := now.Add(time.Minute)
+	deliveries := []*models.WebhookDelivery{
+		{UserID: user_id, ExpressionID: 1, Event: "expression.solved", URL: "http://a", Payload: []byte(`{"a":1}`), Status: models.WebhookPending, NextAttemptAt: &now, CreatedAt: now},
+		{UserID: user_id, ExpressionID: 2, Event: "expression.failed", URL: "http://b", Payload: []byte(`{}`), Status: models.WebhookPending, NextAttemptAt: &later, CreatedAt: now},
+		{UserID: user_id + 1, ExpressionID: 3, Event: "expression.solved", URL: "http://c", Payload: []byte(`{}`), Status: models.WebhookDelivered, CreatedAt: now, DeliveredAt: &now},
+	}
+	for _, delivery := range deliveries {
+		require.NoError(t, storage.SaveWebhookDelivery(delivery))
+	}
+
+	due, err := storage.GetDueWebhookDeliveries(now.Add(time.Second), 10)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	require.Equal(t, deliveries[0].ID, due[0].ID)
+	require.JSONEq(t, `{"a":1}`, string(due[0].Payload))
+
+	// Доставлено со второй попытки
+	due[0].Attempts = 2
+	due[0].Status = models.WebhookDelivered
+	due[0].NextAttemptAt = nil
+	due[0].DeliveredAt = &later
+	require.NoError(t, storage.SaveWebhookDelivery(&due[0]))
+	require.NoError(t, storage.SaveWebhookAttempt(&models.WebhookAttempt{DeliveryID: due[0].ID, Attempt: 1, Error: "connection refused", Time: now}))
+	require.NoError(t, storage.SaveWebhookAttempt(&models.WebhookAttempt{DeliveryID: due[0].ID, Attempt: 2, StatusCode: 200, DurationMS: 12, Time: later}))
+
+	history, err := storage.GetWebhookDeliveries(user_id, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, deliveries[1].ID, history[0].ID)
+	require.Equal(t, models.WebhookDelivered, history[1].Status)
+	require.Equal(t, 2, history[1].Attempts)
+	require.Nil(t, history[1].NextAttemptAt)
+	require.True(t, history[1].DeliveredAt.Equal(later))
+
+	history, err = storage.GetWebhookDeliveries(user_id, 2, 10)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, "expression.failed", history[0].Event)
+
+	attempts, err := storage.GetWebhookAttempts(deliveries[0].ID)
+	require.NoError(t, err)
+	require.Len(t, attempts, 2)
+	require.Equal(t, "connection refused", attempts[0].Error)
+	require.Zero(t, attempts[0].StatusCode)
+	require.Equal(t, 200, attempts[1].StatusCode)
+	require.Equal(t, int64(12), attempts[1].DurationMS)
+}
+
+func TestBatches(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	user_id, err := storage.SaveUser(&models.User{Login: "batch"})
+	require.NoError(t, err)
+	batch := &models.Batch{UserID: user_id, Total: 2, CreatedAt: time.Now()}
+	require.NoError(t, storage.SaveBatch(batch))
+	require.NotZero(t, batch.ID)
+
+	saved, err := storage.GetBatch(batch.ID)
+	require.NoError(t, err)
+	require.Equal(t, user_id, saved.UserID)
+	require.Equal(t, 2, saved.Total)
+	_, err = storage.GetBatch(batch.ID + 1)
+	require.ErrorIs(t, err, ErrItemNotFound)
+
+	first := &models.Expression{UserID: user_id, Status: models.ExpressionSolved, Result: 4, BatchID: batch.ID, ClientID: "A1"}
+	second := &models.Expression{UserID: user_id, Status: models.ExpressionProcessing, BatchID: batch.ID}
+	alone := &models.Expression{UserID: user_id, Status: models.ExpressionProcessing}
+	for _, e := range []*models.Expression{first, second, alone} {
+		_, err := storage.SaveExpression(e)
+		require.NoError(t, err)
+	}
+
+	expressions, err := storage.GetBatchExpressions(batch.ID)
+	require.NoError(t, err)
+	require.Len(t, expressions, 2)
+	require.Equal(t, "A1", expressions[0].ClientID)
+	require.Equal(t, 4.0, expressions[0].Result)
+	require.Empty(t, expressions[1].ClientID)
+
+	loaded, err := storage.GetExpression(first.ID)
+	require.NoError(t, err)
+	require.Equal(t, batch.ID, loaded.BatchID)
+	require.Equal(t, "A1", loaded.ClientID)
+	loaded, err = storage.GetExpression(alone.ID)
+	require.NoError(t, err)
+	require.Zero(t, loaded.BatchID)
+}
+
+func TestDependencies(t *testing.T) {
+	storage := NewStorage(true)
+	defer storage.Close()
+
+	require.NoError(t, storage.SaveDependencies(3, []int{1, 2}))
+	require.NoError(t, storage.SaveDependencies(4, []int{1}))
+	// Повтор ничего не меняет
+	require.NoError(t, storage.SaveDependencies(4, []int{1}))
+
+	dependencies, err := storage.GetDependencies(3)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, dependencies)
+	dependents, err := storage.GetDependents(1)
+	require.NoError(t, err)
+	require.Equal(t, []int{3, 4}, dependents)
+	dependents, err = storage.GetDependents(3)
+	require.NoError(t, err)
+	require.Empty(t, dependents)
+}
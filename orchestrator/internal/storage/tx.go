@@ -0,0 +1,38 @@
+package storage
+
+// Единица работы: несколько изменений, которые применяются все вместе или не применяются вовсе
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Общее у *sql.DB и *sql.Tx. Методы хранилища работают через него и не знают, идет ли транзакция
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Выполняет fn в транзакции. fn получает хранилище, все методы которого работают внутри нее.
+// Если fn вернула ошибку или запаниковала, изменения откатываются.
+// Вложенный вызов просто продолжает внешнюю транзакцию.
+//
+// Внутри fn нельзя обращаться к внешнему хранилищу, только к tx: внешнее работает мимо транзакции
+// и ждет, пока она закончится. У базы в памяти соединение одно, так что там это ожидание вечное
+func (s *Storage) InTx(fn func(tx *Storage) error) error {
+	if _, ok := s.q.(*sql.Tx); ok {
+		return fn(s)
+	}
+	sqlTx, err := s.db.BeginTx(context.TODO(), nil)
+	if err != nil {
+		return err
+	}
+	// После Commit откат ничего не делает
+	defer sqlTx.Rollback()
+
+	if err := fn(&Storage{db: s.db, q: sqlTx}); err != nil {
+		return err
+	}
+	return sqlTx.Commit()
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+)
+
+func (s *Storage) SaveWebhook(webhook *models.Webhook) error {
+	q := `
+	INSERT INTO webhooks (user_id, url, created_at)
+	VALUES ($1, $2, $3)
+	`
+	ctx := context.TODO()
+	res, err := s.q.ExecContext(ctx, q, webhook.UserID, webhook.URL, webhook.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	webhook.ID = int(lastID)
+	return nil
+}
+
+func (s *Storage) GetWebhooks(user_id int) ([]models.Webhook, error) {
+	webhooks := []models.Webhook{}
+	q := `
+	SELECT webhook_id, user_id, url, created_at
+	FROM webhooks
+	WHERE user_id = $1
+	ORDER BY webhook_id
+	`
+	ctx := context.TODO()
+	rows, err := s.q.QueryContext(ctx, q, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var webhook models.Webhook
+		if err := rows.Scan(&webhook.ID, &webhook.UserID, &webhook.URL, &webhook.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// Удаляет вебхук пользователя. ErrItemNotFound, если у пользователя такого нет
+func (s *Storage) DeleteWebhook(id int, user_id int) error {
+	q := `DELETE FROM webhooks WHERE webhook_id = $1 AND user_id = $2`
+	ctx := context.TODO()
+	res, err := s.q.ExecContext(ctx, q, id, user_id)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrItemNotFound
+	}
+	return nil
+}
+
+// Ключ подписи вебхуков пользователя. Пусто, если ключа еще нет
+func (s *Storage) GetWebhookSecret(user_id int) (string, error) {
+	var secret string
+	q := `SELECT webhook_secret FROM users WHERE user_id = $1`
+	ctx := context.TODO()
+	err := s.q.QueryRowContext(ctx, q, user_id).Scan(&secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrItemNotFound
+	}
+	return secret, err
+}
+
+func (s *Storage) SetWebhookSecret(user_id int, secret string) error {
+	q := `UPDATE users SET webhook_secret = $1 WHERE user_id = $2`
+	ctx := context.TODO()
+	res, err := s.q.ExecContext(ctx, q, secret, user_id)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrItemNotFound
+	}
+	return nil
+}
+
+const webhookDeliveryColumns = "delivery_id, user_id, expression_id, event, url, payload, status, attempts, next_attempt_at, created_at, delivered_at"
+
+func scanWebhookDelivery(row scanner) (models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	var payload string
+	var nextAttemptAt, deliveredAt sql.NullTime
+	err := row.Scan(&delivery.ID, &delivery.UserID, &delivery.ExpressionID, &delivery.Event, &delivery.URL, &payload, &delivery.Status, &delivery.Attempts, &nextAttemptAt, &delivery.CreatedAt, &deliveredAt)
+	if err != nil {
+		return delivery, err
+	}
+	delivery.Payload = []byte(payload)
+	if nextAttemptAt.Valid {
+		delivery.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if deliveredAt.Valid {
+		delivery.DeliveredAt = &deliveredAt.Time
+	}
+	return delivery, nil
+}
+
+func (s *Storage) SaveWebhookDelivery(delivery *models.WebhookDelivery) error {
+	ctx := context.TODO()
+	var nextAttemptAt, deliveredAt sql.NullTime
+	if delivery.NextAttemptAt != nil {
+		nextAttemptAt = sql.NullTime{Time: delivery.NextAttemptAt.UTC(), Valid: true}
+	}
+	if delivery.DeliveredAt != nil {
+		deliveredAt = sql.NullTime{Time: delivery.DeliveredAt.UTC(), Valid: true}
+	}
+
+	if delivery.ID == 0 {
+		q := `
+		INSERT INTO webhook_deliveries (user_id, expression_id, event, url, payload, status, attempts, next_attempt_at, created_at, delivered_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		`
+		res, err := s.q.ExecContext(ctx, q, delivery.UserID, delivery.ExpressionID, delivery.Event, delivery.URL, string(delivery.Payload), delivery.Status, delivery.Attempts, nextAttemptAt, delivery.CreatedAt.UTC(), deliveredAt)
+		if err != nil {
+			return err
+		}
+		lastID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		delivery.ID = int(lastID)
+		return nil
+	}
+
+	q := `
+	UPDATE webhook_deliveries
+	SET status = $1, attempts = $2, next_attempt_at = $3, delivered_at = $4
+	WHERE delivery_id = $5
+	`
+	_, err := s.q.ExecContext(ctx, q, delivery.Status, delivery.Attempts, nextAttemptAt, deliveredAt, delivery.ID)
+	return err
+}
+
+// Доставки, которым пора уйти: ждут попытки и время попытки наступило
+func (s *Storage) GetDueWebhookDeliveries(now time.Time, limit int) ([]models.WebhookDelivery, error) {
+	q := `
+	SELECT ` + webhookDeliveryColumns + `
+	FROM webhook_deliveries
+	WHERE status = $1 AND next_attempt_at <= $2
+	ORDER BY next_attempt_at, delivery_id
+	LIMIT $3
+	`
+	return s.queryWebhookDeliveries(q, models.WebhookPending, now.UTC(), limit)
+}
+
+// История доставок пользователя, новые первыми. expression_id 0 значит по всем выражениям
+func (s *Storage) GetWebhookDeliveries(user_id int, expression_id int, limit int) ([]models.WebhookDelivery, error) {
+	q := `
+	SELECT ` + webhookDeliveryColumns + `
+	FROM webhook_deliveries
+	WHERE user_id = $1 AND ($2 = 0 OR expression_id = $2)
+	ORDER BY delivery_id DESC
+	LIMIT $3
+	`
+	return s.queryWebhookDeliveries(q, user_id, expression_id, limit)
+}
+
+func (s *Storage) queryWebhookDeliveries(q string, args ...any) ([]models.WebhookDelivery, error) {
+	deliveries := []models.WebhookDelivery{}
+	ctx := context.TODO()
+	rows, err := s.q.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *Storage) SaveWebhookAttempt(attempt *models.WebhookAttempt) error {
+	var statusCode sql.NullInt64
+	if attempt.StatusCode != 0 {
+		statusCode = sql.NullInt64{Int64: int64(attempt.StatusCode), Valid: true}
+	}
+	q := `
+	INSERT INTO webhook_attempts (delivery_id, attempt, status_code, error, duration_ms, attempt_time)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	ctx := context.TODO()
+	res, err := s.q.ExecContext(ctx, q, attempt.DeliveryID, attempt.Attempt, statusCode, attempt.Error, attempt.DurationMS, attempt.Time.UTC())
+	if err != nil {
+		return err
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	attempt.ID = int(lastID)
+	return nil
+}
+
+// Попытки доставки по порядку
+func (s *Storage) GetWebhookAttempts(delivery_id int) ([]models.WebhookAttempt, error) {
+	attempts := []models.WebhookAttempt{}
+	q := `
+	SELECT attempt_id, delivery_id, attempt, status_code, error, duration_ms, attempt_time
+	FROM webhook_attempts
+	WHERE delivery_id = $1
+	ORDER BY attempt_id
+	`
+	ctx := context.TODO()
+	rows, err := s.q.QueryContext(ctx, q, delivery_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attempt models.WebhookAttempt
+		var statusCode sql.NullInt64
+		var errorText sql.NullString
+		err := rows.Scan(&attempt.ID, &attempt.DeliveryID, &attempt.Attempt, &statusCode, &errorText, &attempt.DurationMS, &attempt.Time)
+		if err != nil {
+			return nil, err
+		}
+		attempt.StatusCode = int(statusCode.Int64)
+		attempt.Error = errorText.String
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
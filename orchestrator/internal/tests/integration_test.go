@@ -11,6 +11,7 @@ import (
 
 	"github.com/RichCake/calc_api_go/orchestrator/internal/application"
 	"github.com/RichCake/calc_api_go/protos/gen/go/orchestrator"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
@@ -96,8 +97,9 @@ func TestExpressionCalculation(t *testing.T) {
 
 	// Отправка задачи
 	_, err = client.ReceiveTask(ctx, &proto.ReceiveTaskRequest{
-		Id:     taskResp.Id,
-		Result: result,
+		Id:           taskResp.Id,
+		Result:       result,
+		AttemptToken: taskResp.AttemptToken,
 	})
 	require.NoError(t, err)
 
@@ -119,4 +121,24 @@ func TestExpressionCalculation(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "solve", statusResult.Status)
 	assert.Equal(t, result, statusResult.Result)
+
+	// WebSocket: чужая страница сессию не откроет, а клиент без Origin получит результат
+	wsURL := "ws://localhost:8080/api/v1/ws?token=" + loginResult.AccessToken
+	_, wsResp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://evil.example"}})
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusForbidden, wsResp.StatusCode)
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	require.NoError(t, ws.WriteJSON(map[string]any{"type": "subscribe", "id": calcResult.ID}))
+	var wsResult struct {
+		Type       string `json:"type"`
+		Expression struct {
+			Result float64 `json:"result"`
+		} `json:"expression"`
+	}
+	require.NoError(t, ws.ReadJSON(&wsResult))
+	assert.Equal(t, "result", wsResult.Type)
+	assert.Equal(t, result, wsResult.Expression.Result)
 }
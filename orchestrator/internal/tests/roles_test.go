@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/storage"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/transport/middlewares"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminRoleRevoked(t *testing.T) {
+	store := storage.NewStorage(true)
+	secret_key := []byte("secret")
+
+	// Админка за теми же middleware, что и в приложении
+	router := func(authService *auth.AuthService) http.Handler {
+		r := mux.NewRouter()
+		admin := r.PathPrefix("/api/v1/admin").Subrouter()
+		admin.Use(middlewares.NewAuthMiddleware(secret_key, authService))
+		admin.Use(middlewares.NewRoleMiddleware(models.RoleAdmin))
+		admin.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {})
+		return r
+	}
+	get := func(handler http.Handler, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/cache", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	withAdmin := auth.NewAuthService(store, secret_key, []string{"boss"})
+	_, err := withAdmin.Register("boss", "pass")
+	require.NoError(t, err)
+	token, err := withAdmin.Login("boss", "pass")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, get(router(withAdmin), token))
+
+	// Логин убрали из ADMIN_LOGINS и перезапустили оркестратор: старый токен еще действует, но прав уже нет
+	withoutAdmin := auth.NewAuthService(store, secret_key, nil)
+	assert.Equal(t, http.StatusForbidden, get(router(withoutAdmin), token))
+
+	// При следующем входе роль снимается и в базе
+	token, err = withoutAdmin.Login("boss", "pass")
+	require.NoError(t, err)
+	user, err := store.GetUser("boss")
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleUser, user.Role)
+	assert.Equal(t, http.StatusForbidden, get(router(withoutAdmin), token))
+}
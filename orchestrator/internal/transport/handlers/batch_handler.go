@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
+	"github.com/gorilla/mux"
+)
+
+// Пакетная отправка: POST /api/v1/calculate/batch.
+// Выражения проверяются по отдельности, все прошедшие проверку сохраняются одной транзакцией
+type BatchHandler struct {
+	expressionService *expression.ExpressionService
+}
+
+func NewBatchHandler(expressionService *expression.ExpressionService) *BatchHandler {
+	return &BatchHandler{
+		expressionService: expressionService,
+	}
+}
+
+func (h *BatchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request struct {
+		// Поля выражения, как в POST /api/v1/calculate, и необязательный client_id
+		Expressions []struct {
+			ClientID    string          `json:"client_id"`
+			Expression  string          `json:"expression"`
+			Locale      string          `json:"locale"`
+			Timeout     string          `json:"timeout"`
+			Priority    json.RawMessage `json:"priority"`
+			CallbackURL string          `json:"callback_url"`
+			NoCache     bool            `json:"no_cache"`
+		} `json:"expressions"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	role, _ := r.Context().Value(auth.ContextKeyRole).(string)
+	items := make([]expression.BatchItem, len(request.Expressions))
+	for i, e := range request.Expressions {
+		opts, _, err := processOptions(e.Locale, e.Timeout, e.Priority, role)
+		opts.CallbackURL = e.CallbackURL
+		opts.NoCache = e.NoCache
+		items[i] = expression.BatchItem{ClientID: e.ClientID, Expression: e.Expression, Options: opts, Err: err}
+	}
+
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+	batch, results, err := h.expressionService.ProcessBatch(items, user_id)
+	if errors.Is(err, expression.ErrEmptyBatch) || errors.Is(err, expression.ErrBatchTooLarge) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	response := struct {
+		ID          int                      `json:"id,omitempty"`
+		Expressions []expression.BatchResult `json:"expressions"`
+	}{batch.ID, results}
+	if batch.ID == 0 {
+		// Ни одно выражение не прошло проверку
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Сводка по пакету: GET /api/v1/batches/{id}
+type GetBatchHandler struct {
+	expressionService *expression.ExpressionService
+}
+
+func NewGetBatchHandler(expressionService *expression.ExpressionService) *GetBatchHandler {
+	return &GetBatchHandler{
+		expressionService: expressionService,
+	}
+}
+
+func (h *GetBatchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	batch_id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "id must be a number"})
+		return
+	}
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+	locale, ok := resolveLocale(w, r, h.expressionService, user_id)
+	if !ok {
+		return
+	}
+	batch, err := h.expressionService.GetBatch(batch_id, user_id)
+	if errors.Is(err, expression.ErrBatchNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	for i := range batch.Expressions {
+		expression.FormatExpression(&batch.Expressions[i], locale)
+	}
+	json.NewEncoder(w).Encode(batch)
+}
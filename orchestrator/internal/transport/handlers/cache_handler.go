@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
+)
+
+// Счетчики кэша результатов задач. Только для администраторов
+type CacheHandler struct {
+	expressionService *expression.ExpressionService
+}
+
+func NewCacheHandler(expressionService *expression.ExpressionService) *CacheHandler {
+	return &CacheHandler{
+		expressionService: expressionService,
+	}
+}
+
+func (h *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.expressionService.CacheStats())
+}
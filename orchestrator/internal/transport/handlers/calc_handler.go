@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
@@ -28,6 +30,14 @@ func (h *CalcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	var request struct {
 		Expression string `json:"expression"`
+		Locale     string `json:"locale"`  // формат чисел в выражении, по умолчанию из настроек пользователя
+		Timeout    string `json:"timeout"` // срок решения, например "30s"
+		// low, normal, high или число от 0 до 9. Выше normal - только для администраторов
+		Priority json.RawMessage `json:"priority"`
+		// Сюда уйдет вебхук с результатом
+		CallbackURL string `json:"callback_url"`
+		// Все задачи считают агенты, даже если результат уже есть в кэше
+		NoCache bool `json:"no_cache"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -35,9 +45,24 @@ func (h *CalcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
 		return
 	}
+	role, _ := r.Context().Value(auth.ContextKeyRole).(string)
+	opts, code, err := processOptions(request.Locale, request.Timeout, request.Priority, role)
+	if err != nil {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	opts.CallbackURL = request.CallbackURL
+	opts.NoCache = request.NoCache
+	wait, code, err := parseWait(r, h.expressionService)
+	if err != nil {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
 	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
 	// Логика спрятана сюда
-	id, err := h.expressionService.ProcessExpression(request.Expression, user_id)
+	id, err := h.expressionService.ProcessExpressionWithOptions(request.Expression, user_id, opts)
 
 	if err != nil {
 		if errors.Is(err, expression.ErrStorage) || errors.Is(err, expression.ErrService) {
@@ -49,5 +74,80 @@ func (h *CalcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if wait > 0 {
+		h.writeResult(w, r, id, user_id, wait, request.Locale)
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]int{"id": id})
 }
+
+// Синхронный режим ?wait=: ждет результат и отдает выражение целиком.
+// Если выражение не успело закончиться, отвечает 202, и дальше результат можно получить по id
+func (h *CalcHandler) writeResult(w http.ResponseWriter, r *http.Request, id int, user_id int, wait time.Duration, localeName string) {
+	e, err := h.expressionService.WaitExpression(r.Context(), id, user_id, wait)
+	if r.Context().Err() != nil {
+		// Клиент не дождался ответа, выражение при этом считается дальше
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if progress, err := h.expressionService.Progress(e); err == nil {
+		e.Progress = &progress
+	}
+	// Локаль уже проверена при отправке выражения
+	if locale, err := h.expressionService.ResolveLocale(localeName, user_id); err == nil {
+		expression.FormatExpression(&e, locale)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !e.Status.Finished() {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(e)
+}
+
+var (
+	errInvalidTimeout    = errors.New("invalid timeout")
+	errPriorityForbidden = errors.New("priority above normal requires admin role")
+)
+
+// Параметры выражения из запроса. С ошибкой возвращается HTTP код ответа
+func processOptions(locale string, timeout string, priority json.RawMessage, role string) (expression.ProcessOptions, int, error) {
+	opts := expression.ProcessOptions{Locale: locale}
+	if timeout != "" {
+		parsed, err := time.ParseDuration(timeout)
+		if err != nil {
+			return opts, http.StatusBadRequest, errInvalidTimeout
+		}
+		// Явный "0s" не должен превращаться в срок по умолчанию
+		if parsed <= 0 {
+			return opts, http.StatusUnprocessableEntity, expression.ErrInvalidTimeout
+		}
+		opts.Timeout = parsed
+	}
+	if len(priority) > 0 {
+		parsed, err := parsePriority(priority)
+		if err != nil {
+			return opts, http.StatusUnprocessableEntity, err
+		}
+		if !expression.CheckPriorityAllowed(parsed, role) {
+			return opts, http.StatusForbidden, errPriorityForbidden
+		}
+		opts.Priority = &parsed
+	}
+	return opts, http.StatusOK, nil
+}
+
+// Приоритет приходит строкой ("high", "7") или числом (7)
+func parsePriority(raw json.RawMessage) (int, error) {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		return expression.ParsePriority(name)
+	}
+	var priority int
+	if err := json.Unmarshal(raw, &priority); err != nil {
+		return 0, expression.ErrInvalidPriority
+	}
+	return expression.ParsePriority(strconv.Itoa(priority))
+}
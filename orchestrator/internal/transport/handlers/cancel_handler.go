@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
+	"github.com/gorilla/mux"
+)
+
+// Отмена выражения: DELETE /api/v1/expressions/{id} или POST /api/v1/expressions/{id}/cancel
+type CancelHandler struct {
+	expressionService *expression.ExpressionService
+}
+
+func NewCancelHandler(expressionService *expression.ExpressionService) *CancelHandler {
+	return &CancelHandler{
+		expressionService: expressionService,
+	}
+}
+
+func (h *CancelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	expression_id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "id must be a number"})
+		return
+	}
+
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+	e, err := h.expressionService.CancelExpression(expression_id, user_id)
+	if errors.Is(err, expression.ErrExpressionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "expression not found"})
+		return
+	} else if errors.Is(err, expression.ErrExpressionFinished) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(e)
+}
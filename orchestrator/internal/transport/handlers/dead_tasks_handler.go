@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
+	"github.com/gorilla/mux"
+)
+
+// Задачи из dead-letter. Только для администраторов
+type DeadTasksHandler struct {
+	expressionService *expression.ExpressionService
+}
+
+func NewDeadTasksHandler(expressionService *expression.ExpressionService) *DeadTasksHandler {
+	return &DeadTasksHandler{
+		expressionService: expressionService,
+	}
+}
+
+func (h *DeadTasksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tasks, err := h.expressionService.DeadTasks()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(tasks)
+}
+
+// Возвращает задачу из dead-letter в очередь, выражение снова считается
+type RequeueHandler struct {
+	expressionService *expression.ExpressionService
+}
+
+func NewRequeueHandler(expressionService *expression.ExpressionService) *RequeueHandler {
+	return &RequeueHandler{
+		expressionService: expressionService,
+	}
+}
+
+func (h *RequeueHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	task_id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "id must be a number"})
+		return
+	}
+
+	e, err := h.expressionService.RequeueDeadTask(task_id)
+	if errors.Is(err, expression.ErrTaskNotFound) || errors.Is(err, expression.ErrExpressionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	} else if errors.Is(err, expression.ErrTaskNotDead) || errors.Is(err, expression.ErrExpressionFinished) || errors.Is(err, expression.ErrExpressionTimeout) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/events"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
+	"github.com/gorilla/mux"
+)
+
+// Пустой комментарий раз в это время, чтобы прокси не закрывали молчащее соединение
+const sseHeartbeat = 15 * time.Second
+
+// Поток событий выражения в формате Server-Sent Events: GET /api/v1/expressions/{id}/events.
+// Первым приходит snapshot с текущим состоянием, поток закрывается после expression_finished.
+// Если клиент не успевал читать и события терялись, приходит новый snapshot
+type ExpressionEventsHandler struct {
+	expressionService *expression.ExpressionService
+}
+
+func NewExpressionEventsHandler(expressionService *expression.ExpressionService) *ExpressionEventsHandler {
+	return &ExpressionEventsHandler{
+		expressionService: expressionService,
+	}
+}
+
+func (h *ExpressionEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	expression_id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "id must be a number"})
+		return
+	}
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+	locale, ok := resolveLocale(w, r, h.expressionService, user_id)
+	if !ok {
+		return
+	}
+
+	sub, e, err := h.expressionService.SubscribeExpression(expression_id, user_id)
+	if errors.Is(err, expression.ErrExpressionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "expression not found"})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	defer sub.Close()
+
+	stream, ok := newEventStream(w)
+	if !ok {
+		return
+	}
+	sendSnapshot := func(e models.Expression) bool {
+		snapshot := events.Event{Type: "snapshot", ExpressionID: e.ID, Expression: e, Time: time.Now()}
+		stream.send(h.expressionService, snapshot, locale)
+		return !e.Status.Finished()
+	}
+	if !sendSnapshot(e) {
+		return
+	}
+	stream.run(r, sub, func(event events.Event) bool {
+		stream.send(h.expressionService, event, locale)
+		return event.Type != events.ExpressionFinished
+	}, func() bool {
+		// Среди потерянных могло быть и expression_finished, поэтому читаем выражение заново
+		e, err := h.expressionService.GetExpressionByID(expression_id, user_id)
+		if err != nil {
+			return false
+		}
+		return sendSnapshot(e)
+	})
+}
+
+// Поток событий всех выражений пользователя: GET /api/v1/events.
+// Если клиент не успевал читать и события терялись, приходит events_dropped
+type EventsHandler struct {
+	expressionService *expression.ExpressionService
+}
+
+func NewEventsHandler(expressionService *expression.ExpressionService) *EventsHandler {
+	return &EventsHandler{
+		expressionService: expressionService,
+	}
+}
+
+func (h *EventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+	locale, ok := resolveLocale(w, r, h.expressionService, user_id)
+	if !ok {
+		return
+	}
+	sub := h.expressionService.SubscribeUser(user_id)
+	defer sub.Close()
+
+	stream, ok := newEventStream(w)
+	if !ok {
+		return
+	}
+	stream.run(r, sub, func(event events.Event) bool {
+		stream.send(h.expressionService, event, locale)
+		return true
+	}, func() bool {
+		// Выражений много, перечитать их клиент может сам через GET /api/v1/expressions
+		fmt.Fprint(stream.w, "event: events_dropped\ndata: {}\n\n")
+		stream.flusher.Flush()
+		return true
+	})
+}
+
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newEventStream(w http.ResponseWriter) (*eventStream, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "streaming unsupported"})
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &eventStream{w: w, flusher: flusher}, true
+}
+
+// Передает события подписки в handle, пока клиент не отключится, подписка не закроется или handle не вернет false.
+// Если события терялись, очередь подписки выбрасывается и вызывается lagged, который тоже может закончить поток
+func (s *eventStream) run(r *http.Request, sub *events.Subscription, handle func(events.Event) bool, lagged func() bool) {
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(s.w, ": ping\n\n")
+			s.flusher.Flush()
+		case <-sub.Lagged:
+			sub.Drain()
+			if !lagged() {
+				return
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if !handle(event) {
+				return
+			}
+		}
+	}
+}
+
+// Отправляет событие вместе с прогрессом выражения и результатом в формате локали
+func (s *eventStream) send(expressionService *expression.ExpressionService, event events.Event, locale calculation.Locale) {
+	if progress, err := expressionService.Progress(event.Expression); err == nil {
+		event.Expression.Progress = &progress
+	}
+	expression.FormatExpression(&event.Expression, locale)
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if event.ID != 0 {
+		fmt.Fprintf(s.w, "id: %d\n", event.ID)
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event.Type, data)
+	s.flusher.Flush()
+}
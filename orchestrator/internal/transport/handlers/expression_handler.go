@@ -5,8 +5,11 @@ import (
 	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
 	"github.com/gorilla/mux"
 )
@@ -38,10 +41,25 @@ func (h *ExpressionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	wait, code, err := parseWait(r, h.expressionService)
+	if err != nil {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
 	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
 	// Логика спрятана сюда
-	e, err := h.expressionService.GetExpressionByID(expression_id, user_id)
-	if errors.Is(err, expression.ErrExpressionNotFound) {
+	var e models.Expression
+	if wait > 0 {
+		e, err = h.expressionService.WaitExpression(r.Context(), expression_id, user_id, wait)
+	} else {
+		e, err = h.expressionService.GetExpressionByID(expression_id, user_id)
+	}
+	if r.Context().Err() != nil {
+		// Клиент не дождался ответа
+		return
+	} else if errors.Is(err, expression.ErrExpressionNotFound) {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{"error": "expression not found"})
 		return
@@ -50,6 +68,55 @@ func (h *ExpressionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
+	progress, err := h.expressionService.Progress(e)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	e.Progress = &progress
+	locale, ok := resolveLocale(w, r, h.expressionService, user_id)
+	if !ok {
+		return
+	}
+	expression.FormatExpression(&e, locale)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(e)
 }
+
+// Локаль для вывода берется из ?locale=, потом из настроек пользователя
+func resolveLocale(w http.ResponseWriter, r *http.Request, expressionService *expression.ExpressionService, user_id int) (calculation.Locale, bool) {
+	locale, err := expressionService.ResolveLocale(r.URL.Query().Get("locale"), user_id)
+	if errors.Is(err, calculation.ErrUnknownLocale) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return locale, false
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return locale, false
+	}
+	return locale, true
+}
+
+var errInvalidWait = errors.New("invalid wait")
+
+// Сколько ждать, пока выражение закончится, из ?wait=, например 30s. 0 - не ждать.
+// С ошибкой возвращается HTTP код ответа
+func parseWait(r *http.Request, expressionService *expression.ExpressionService) (time.Duration, int, error) {
+	raw := r.URL.Query().Get("wait")
+	if raw == "" {
+		return 0, http.StatusOK, nil
+	}
+	wait, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, http.StatusBadRequest, errInvalidWait
+	}
+	err = expressionService.ValidateWait(wait)
+	if errors.Is(err, expression.ErrWaitTooLong) {
+		return 0, http.StatusUnprocessableEntity, err
+	} else if err != nil {
+		return 0, http.StatusBadRequest, err
+	}
+	return wait, http.StatusOK, nil
+}
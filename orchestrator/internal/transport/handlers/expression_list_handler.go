@@ -33,6 +33,13 @@ func (h *ExpressionListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
+	locale, ok := resolveLocale(w, r, h.expressionService, user_id)
+	if !ok {
+		return
+	}
+	for i := range expressions {
+		expression.FormatExpression(&expressions[i], locale)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(expressions)
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
+)
+
+// Отчет о восстановлении после перезапуска. Только для администраторов:
+// GET отдает последний отчет, POST запускает восстановление заново
+type RecoveryHandler struct {
+	expressionService *expression.ExpressionService
+}
+
+func NewRecoveryHandler(expressionService *expression.ExpressionService) *RecoveryHandler {
+	return &RecoveryHandler{
+		expressionService: expressionService,
+	}
+}
+
+func (h *RecoveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		report := h.expressionService.LastRecovery()
+		if report == nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "recovery has not run yet"})
+			return
+		}
+		json.NewEncoder(w).Encode(report)
+	case http.MethodPost:
+		report, err := h.expressionService.Recover()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(report)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
+)
+
+type SettingsHandler struct {
+	authService *auth.AuthService
+}
+
+func NewSettingsHandler(authService *auth.AuthService) *SettingsHandler {
+	return &SettingsHandler{
+		authService: authService,
+	}
+}
+
+type settings struct {
+	Locale string `json:"locale"`
+}
+
+func (h *SettingsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var request settings
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+			return
+		}
+		err := h.authService.SetLocale(user_id, request.Locale)
+		if errors.Is(err, calculation.ErrUnknownLocale) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			writeSettingsError(w, err)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	locale, err := h.authService.GetLocale(user_id)
+	if err != nil {
+		writeSettingsError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings{Locale: locale})
+}
+
+func writeSettingsError(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrUserNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
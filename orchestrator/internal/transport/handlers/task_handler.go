@@ -44,8 +44,9 @@ func (h *TaskHandler) giveTask(w http.ResponseWriter) {
 
 func (h *TaskHandler) receiveTask(w http.ResponseWriter, r *http.Request) {
 	var agent_request struct {
-		TaskID int     `json:"id"`
-		Result float64 `json:"result"`
+		TaskID       int     `json:"id"`
+		Result       float64 `json:"result"`
+		AttemptToken string  `json:"attempt_token"`
 	}
 
 	defer r.Body.Close()
@@ -56,5 +57,5 @@ func (h *TaskHandler) receiveTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Логика спрятана сюда
-	h.expressionService.ProcessIncomingTask(agent_request.TaskID, agent_request.Result)
+	h.expressionService.ProcessIncomingTask(agent_request.TaskID, agent_request.AttemptToken, agent_request.Result)
 }
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
+	"github.com/gorilla/mux"
+)
+
+// История выполнения выражения: GET /api/v1/expressions/{id}/timeline.
+// По умолчанию JSON, с ?format=text или Accept: text/plain - диаграмма Ганта текстом
+type TimelineHandler struct {
+	expressionService *expression.ExpressionService
+}
+
+func NewTimelineHandler(expressionService *expression.ExpressionService) *TimelineHandler {
+	return &TimelineHandler{
+		expressionService: expressionService,
+	}
+}
+
+func (h *TimelineHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	expression_id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "id must be a number"})
+		return
+	}
+
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+	timeline, err := h.expressionService.Timeline(expression_id, user_id)
+	if errors.Is(err, expression.ErrExpressionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "expression not found"})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if r.URL.Query().Get("format") == "text" || strings.HasPrefix(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, timeline.Render())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(timeline)
+}
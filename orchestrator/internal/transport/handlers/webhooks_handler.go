@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/webhook"
+	"github.com/gorilla/mux"
+)
+
+// Вебхуки пользователя по умолчанию: GET - список и ключ подписи, POST - новый вебхук
+type WebhooksHandler struct {
+	webhookService *webhook.Service
+}
+
+func NewWebhooksHandler(webhookService *webhook.Service) *WebhooksHandler {
+	return &WebhooksHandler{
+		webhookService: webhookService,
+	}
+}
+
+func (h *WebhooksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+
+	switch r.Method {
+	case http.MethodGet:
+		secret, err := h.webhookService.Secret(user_id)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+		webhooks, err := h.webhookService.GetWebhooks(user_id)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(struct {
+			Secret   string           `json:"secret"`
+			Webhooks []models.Webhook `json:"webhooks"`
+		}{secret, webhooks})
+	case http.MethodPost:
+		var request struct {
+			URL string `json:"url"`
+		}
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+			return
+		}
+		created, err := h.webhookService.CreateWebhook(user_id, request.URL)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+	}
+}
+
+// Удаление вебхука: DELETE /api/v1/webhooks/{id}
+type DeleteWebhookHandler struct {
+	webhookService *webhook.Service
+}
+
+func NewDeleteWebhookHandler(webhookService *webhook.Service) *DeleteWebhookHandler {
+	return &DeleteWebhookHandler{
+		webhookService: webhookService,
+	}
+}
+
+func (h *DeleteWebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	webhook_id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "id must be a number"})
+		return
+	}
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+	if err := h.webhookService.DeleteWebhook(webhook_id, user_id); err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Новый ключ подписи: POST /api/v1/webhooks/secret
+type WebhookSecretHandler struct {
+	webhookService *webhook.Service
+}
+
+func NewWebhookSecretHandler(webhookService *webhook.Service) *WebhookSecretHandler {
+	return &WebhookSecretHandler{
+		webhookService: webhookService,
+	}
+}
+
+func (h *WebhookSecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+	secret, err := h.webhookService.RotateSecret(user_id)
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret})
+}
+
+const (
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 500
+)
+
+// История доставок: GET /api/v1/webhooks/deliveries?expression_id=&limit=
+type WebhookDeliveriesHandler struct {
+	webhookService *webhook.Service
+}
+
+func NewWebhookDeliveriesHandler(webhookService *webhook.Service) *WebhookDeliveriesHandler {
+	return &WebhookDeliveriesHandler{
+		webhookService: webhookService,
+	}
+}
+
+func (h *WebhookDeliveriesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	expression_id := 0
+	if raw := query.Get("expression_id"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil || id <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "expression_id must be a positive number"})
+			return
+		}
+		expression_id = id
+	}
+	limit := defaultDeliveriesLimit
+	if raw := query.Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > maxDeliveriesLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "limit must be between 1 and 500"})
+			return
+		}
+		limit = parsed
+	}
+
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+	deliveries, err := h.webhookService.GetDeliveries(user_id, expression_id, limit)
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func writeWebhookError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, webhook.ErrInvalidURL):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case errors.Is(err, webhook.ErrTooManyWebhooks):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, webhook.ErrWebhookNotFound), errors.Is(err, webhook.ErrUserNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/RichCake/calc_api_go/orchestrator/internal/models"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/calculation"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/events"
+	"github.com/RichCake/calc_api_go/orchestrator/internal/services/expression"
+	"github.com/gorilla/websocket"
+)
+
+// Раз в это время сервер шлет ping. Клиент, который не ответил за два интервала, отключается
+const wsPingInterval = 30 * time.Second
+
+// Сколько ждем, пока сообщение уйдет клиенту
+const wsWriteWait = 10 * time.Second
+
+// Сообщения длиннее считаются ошибкой клиента, соединение закрывается с кодом 1009
+const wsMaxMessageSize = 1 << 20
+
+// Сообщение клиента
+type wsRequest struct {
+	Type      string `json:"type"`                 // submit, subscribe или cancel
+	RequestID string `json:"request_id,omitempty"` // вернется в ответе, чтобы клиент сопоставил ответ с запросом
+	ID        int    `json:"id,omitempty"`         // выражение для subscribe и cancel
+	// Поля submit, как в POST /api/v1/calculate
+	Expression  string          `json:"expression,omitempty"`
+	Locale      string          `json:"locale,omitempty"`
+	Timeout     string          `json:"timeout,omitempty"`
+	Priority    json.RawMessage `json:"priority,omitempty"`
+	CallbackURL string          `json:"callback_url,omitempty"`
+	NoCache     bool            `json:"no_cache,omitempty"`
+}
+
+// Сообщение сервера
+type wsResponse struct {
+	Type       string             `json:"type"` // submitted, progress, result или error
+	RequestID  string             `json:"request_id,omitempty"`
+	ID         int                `json:"id,omitempty"`
+	Event      string             `json:"event,omitempty"` // у progress: snapshot или тип события, как в SSE
+	Expression *models.Expression `json:"expression,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// Интерактивная сессия по WebSocket: GET /api/v1/ws.
+// Клиент отправляет выражения, подписывается на них и отменяет их, сервер присылает прогресс и результаты
+type WebSocketHandler struct {
+	expressionService *expression.ExpressionService
+	upgrader          websocket.Upgrader
+}
+
+// allowedOrigins - страницы, которым кроме страниц самого API можно открывать сессию
+func NewWebSocketHandler(expressionService *expression.ExpressionService, allowedOrigins []string) *WebSocketHandler {
+	origins := map[string]bool{}
+	for _, origin := range allowedOrigins {
+		if origin = normalizeOrigin(origin); origin != "" {
+			origins[origin] = true
+		}
+	}
+	return &WebSocketHandler{
+		expressionService: expressionService,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return checkOrigin(r, origins)
+			},
+		},
+	}
+}
+
+// Токен можно передать в ?token=, а браузер отправляет его с любой страницы, которая откроет сессию.
+// Поэтому чужим страницам сессию не открываем. Клиенты не из браузера Origin не присылают
+func checkOrigin(r *http.Request, allowed map[string]bool) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host) || allowed[normalizeOrigin(origin)]
+}
+
+func normalizeOrigin(origin string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+}
+
+type wsSession struct {
+	expressionService *expression.ExpressionService
+	conn              *websocket.Conn
+	user_id           int
+	role              string
+	locale            calculation.Locale
+	watched           map[int]bool // выражения, о которых клиент получает progress и result
+}
+
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user_id := r.Context().Value(auth.ContextKeyUserID).(int)
+	role, _ := r.Context().Value(auth.ContextKeyRole).(string)
+	locale, ok := resolveLocale(w, r, h.expressionService, user_id)
+	if !ok {
+		return
+	}
+	// Подписка до рукопожатия, чтобы не потерять события выражений, отправленных сразу после него
+	sub := h.expressionService.SubscribeUser(user_id)
+	defer sub.Close()
+
+	// При ошибке Upgrade отвечает клиенту сам
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	})
+
+	session := &wsSession{
+		expressionService: h.expressionService,
+		conn:              conn,
+		user_id:           user_id,
+		role:              role,
+		locale:            locale,
+		watched:           map[int]bool{},
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	messages := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+			// Текст обязан быть в UTF-8 (RFC 6455, 8.1), а проверять это библиотека оставляет нам
+			if messageType == websocket.TextMessage && !utf8.Valid(message) {
+				session.close(websocket.CloseInvalidFramePayloadData, "invalid utf-8")
+				readErr <- errors.New("invalid utf-8 in text message")
+				return
+			}
+			select {
+			case messages <- message:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case err = <-readErr:
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Info("WebSocketHandler: connection lost", "user_id", user_id, "error", err)
+			}
+			return
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+		case message := <-messages:
+			err = session.handle(message)
+		case event, ok := <-sub.C:
+			if !ok {
+				session.close(websocket.CloseGoingAway, "server is shutting down")
+				return
+			}
+			err = session.forward(event)
+		case <-sub.Lagged:
+			sub.Drain()
+			err = session.resync()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *wsSession) handle(message []byte) error {
+	var request wsRequest
+	if err := json.Unmarshal(message, &request); err != nil {
+		return s.write(wsResponse{Type: "error", Error: "invalid request"})
+	}
+	fail := func(err error) error {
+		return s.write(wsResponse{Type: "error", RequestID: request.RequestID, ID: request.ID, Error: err.Error()})
+	}
+
+	switch request.Type {
+	case "submit":
+		opts, _, err := processOptions(request.Locale, request.Timeout, request.Priority, s.role)
+		if err != nil {
+			return fail(err)
+		}
+		opts.CallbackURL = request.CallbackURL
+		opts.NoCache = request.NoCache
+		id, err := s.expressionService.ProcessExpressionWithOptions(request.Expression, s.user_id, opts)
+		if err != nil {
+			return fail(err)
+		}
+		// События о выражении уже в очереди подписки и придут после ответа
+		s.watched[id] = true
+		return s.write(wsResponse{Type: "submitted", RequestID: request.RequestID, ID: id})
+
+	case "subscribe":
+		e, err := s.expressionService.GetExpressionByID(request.ID, s.user_id)
+		if errors.Is(err, expression.ErrExpressionNotFound) {
+			return fail(errors.New("expression not found"))
+		} else if err != nil {
+			return fail(err)
+		}
+		if e.Status.Finished() {
+			return s.send(wsResponse{Type: "result", RequestID: request.RequestID}, e)
+		}
+		s.watched[e.ID] = true
+		return s.send(wsResponse{Type: "progress", RequestID: request.RequestID, Event: "snapshot"}, e)
+
+	case "cancel":
+		e, err := s.expressionService.CancelExpression(request.ID, s.user_id)
+		if errors.Is(err, expression.ErrExpressionNotFound) {
+			return fail(errors.New("expression not found"))
+		} else if err != nil {
+			return fail(err)
+		}
+		// За подписанным выражением result придет с событием expression_finished
+		if s.watched[e.ID] {
+			return nil
+		}
+		return s.send(wsResponse{Type: "result", RequestID: request.RequestID}, e)
+
+	default:
+		return fail(errors.New("unknown message type"))
+	}
+}
+
+func (s *wsSession) forward(event events.Event) error {
+	if !s.watched[event.ExpressionID] {
+		return nil
+	}
+	if event.Type == events.ExpressionFinished {
+		delete(s.watched, event.ExpressionID)
+		return s.send(wsResponse{Type: "result"}, event.Expression)
+	}
+	return s.send(wsResponse{Type: "progress", Event: event.Type}, event.Expression)
+}
+
+// События терялись: по каждому подписанному выражению отправляем его состояние заново,
+// закрытые получают result, как если бы пришло expression_finished
+func (s *wsSession) resync() error {
+	for id := range s.watched {
+		e, err := s.expressionService.GetExpressionByID(id, s.user_id)
+		if errors.Is(err, expression.ErrExpressionNotFound) {
+			delete(s.watched, id)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if e.Status.Finished() {
+			delete(s.watched, id)
+			err = s.send(wsResponse{Type: "result"}, e)
+		} else {
+			err = s.send(wsResponse{Type: "progress", Event: "snapshot"}, e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *wsSession) write(v any) error {
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return s.conn.WriteJSON(v)
+}
+
+// Закрывает сессию с кодом code. Можно вызывать из любой горутины
+func (s *wsSession) close(code int, reason string) error {
+	return s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+}
+
+// Отправляет сообщение с выражением, его прогрессом и результатом в формате локали
+func (s *wsSession) send(response wsResponse, e models.Expression) error {
+	if progress, err := s.expressionService.Progress(e); err == nil {
+		e.Progress = &progress
+	}
+	expression.FormatExpression(&e, s.locale)
+	response.ID = e.ID
+	response.Expression = &e
+	return s.write(response)
+}
@@ -2,18 +2,27 @@ package middlewares
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/RichCake/calc_api_go/orchestrator/internal/services/auth"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
-func NewAuthMiddleware(secret_key []byte) mux.MiddlewareFunc {
+// Проверяет токен и кладет в контекст ID пользователя и его роль.
+// Роль определяется по ADMIN_LOGINS при каждом запросе, поэтому снятая роль пропадает сразу после перезапуска
+// с новым списком, а не когда истечет токен
+func NewAuthMiddleware(secret_key []byte, authService *auth.AuthService) mux.MiddlewareFunc {
     return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
+			// Браузер не дает выставить заголовки при открытии WebSocket, поэтому там токен можно передать в ?token=
+			if authHeader == "" && websocket.IsWebSocketUpgrade(r) && r.URL.Query().Get("token") != "" {
+				authHeader = "Bearer " + r.URL.Query().Get("token")
+			}
 			if authHeader == "" {
 				http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
 				return
@@ -43,9 +52,34 @@ func NewAuthMiddleware(secret_key []byte) mux.MiddlewareFunc {
 				return
 			}
 	
+			role, err := authService.GetRole(int(user_id))
+			if errors.Is(err, auth.ErrUserNotFound) {
+				// Пользователя удалили, а токен еще действует
+				http.Error(w, "User not found", http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
 			ctx := context.WithValue(r.Context(), auth.ContextKeyUserID, int(user_id))
+			ctx = context.WithValue(ctx, auth.ContextKeyRole, role)
 	
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+
+// Пропускает только пользователей с ролью role. Ставится после NewAuthMiddleware
+func NewRoleMiddleware(role string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Context().Value(auth.ContextKeyRole) != role {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
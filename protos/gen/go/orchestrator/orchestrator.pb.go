@@ -23,6 +23,7 @@ const (
 
 type SendTaskRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -57,6 +58,13 @@ func (*SendTaskRequest) Descriptor() ([]byte, []int) {
 	return file_orchestrator_orchestrator_proto_rawDescGZIP(), []int{0}
 }
 
+func (x *SendTaskRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
 type SendTaskResponse struct {
 	state           protoimpl.MessageState `protogen:"open.v1"`
 	Id              int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
@@ -64,6 +72,8 @@ type SendTaskResponse struct {
 	Arg2            float64                `protobuf:"fixed64,3,opt,name=arg2,proto3" json:"arg2,omitempty"`
 	Operation       string                 `protobuf:"bytes,4,opt,name=operation,proto3" json:"operation,omitempty"`
 	OperationTimeMs int64                  `protobuf:"varint,5,opt,name=operation_time_ms,json=operationTimeMs,proto3" json:"operation_time_ms,omitempty"`
+	Args            []float64              `protobuf:"fixed64,6,rep,packed,name=args,proto3" json:"args,omitempty"`
+	AttemptToken    string                 `protobuf:"bytes,7,opt,name=attempt_token,json=attemptToken,proto3" json:"attempt_token,omitempty"`
 	unknownFields   protoimpl.UnknownFields
 	sizeCache       protoimpl.SizeCache
 }
@@ -133,10 +143,25 @@ func (x *SendTaskResponse) GetOperationTimeMs() int64 {
 	return 0
 }
 
+func (x *SendTaskResponse) GetArgs() []float64 {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+func (x *SendTaskResponse) GetAttemptToken() string {
+	if x != nil {
+		return x.AttemptToken
+	}
+	return ""
+}
+
 type ReceiveTaskRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Id            int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
 	Result        float64                `protobuf:"fixed64,2,opt,name=result,proto3" json:"result,omitempty"`
+	AttemptToken  string                 `protobuf:"bytes,3,opt,name=attempt_token,json=attemptToken,proto3" json:"attempt_token,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -185,6 +210,13 @@ func (x *ReceiveTaskRequest) GetResult() float64 {
 	return 0
 }
 
+func (x *ReceiveTaskRequest) GetAttemptToken() string {
+	if x != nil {
+		return x.AttemptToken
+	}
+	return ""
+}
+
 type ReceiveTaskResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	unknownFields protoimpl.UnknownFields
@@ -221,25 +253,122 @@ func (*ReceiveTaskResponse) Descriptor() ([]byte, []int) {
 	return file_orchestrator_orchestrator_proto_rawDescGZIP(), []int{3}
 }
 
+type CancelledTasksRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CancelledTasksRequest) Reset() {
+	*x = CancelledTasksRequest{}
+	mi := &file_orchestrator_orchestrator_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CancelledTasksRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CancelledTasksRequest) ProtoMessage() {}
+
+func (x *CancelledTasksRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_orchestrator_orchestrator_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CancelledTasksRequest.ProtoReflect.Descriptor instead.
+func (*CancelledTasksRequest) Descriptor() ([]byte, []int) {
+	return file_orchestrator_orchestrator_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *CancelledTasksRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+type CancelledTasksResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ids           []int64                `protobuf:"varint,1,rep,packed,name=ids,proto3" json:"ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CancelledTasksResponse) Reset() {
+	*x = CancelledTasksResponse{}
+	mi := &file_orchestrator_orchestrator_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CancelledTasksResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CancelledTasksResponse) ProtoMessage() {}
+
+func (x *CancelledTasksResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_orchestrator_orchestrator_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CancelledTasksResponse.ProtoReflect.Descriptor instead.
+func (*CancelledTasksResponse) Descriptor() ([]byte, []int) {
+	return file_orchestrator_orchestrator_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *CancelledTasksResponse) GetIds() []int64 {
+	if x != nil {
+		return x.Ids
+	}
+	return nil
+}
+
 var File_orchestrator_orchestrator_proto protoreflect.FileDescriptor
 
 const file_orchestrator_orchestrator_proto_rawDesc = "" +
 	"\n" +
-	"\x1forchestrator/orchestrator.proto\x12\forchestrator\"\x11\n" +
-	"\x0fSendTaskRequest\"\x94\x01\n" +
+	"\x1forchestrator/orchestrator.proto\x12\forchestrator\",\n" +
+	"\x0fSendTaskRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\"\xcd\x01\n" +
 	"\x10SendTaskResponse\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x12\n" +
 	"\x04arg1\x18\x02 \x01(\x01R\x04arg1\x12\x12\n" +
 	"\x04arg2\x18\x03 \x01(\x01R\x04arg2\x12\x1c\n" +
 	"\toperation\x18\x04 \x01(\tR\toperation\x12*\n" +
-	"\x11operation_time_ms\x18\x05 \x01(\x03R\x0foperationTimeMs\"<\n" +
+	"\x11operation_time_ms\x18\x05 \x01(\x03R\x0foperationTimeMs\x12\x12\n" +
+	"\x04args\x18\x06 \x03(\x01R\x04args\x12#\n" +
+	"\rattempt_token\x18\a \x01(\tR\fattemptToken\"a\n" +
 	"\x12ReceiveTaskRequest\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x16\n" +
-	"\x06result\x18\x02 \x01(\x01R\x06result\"\x15\n" +
-	"\x13ReceiveTaskResponse2\xa6\x01\n" +
+	"\x06result\x18\x02 \x01(\x01R\x06result\x12#\n" +
+	"\rattempt_token\x18\x03 \x01(\tR\fattemptToken\"\x15\n" +
+	"\x13ReceiveTaskResponse\"2\n" +
+	"\x15CancelledTasksRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\"*\n" +
+	"\x16CancelledTasksResponse\x12\x10\n" +
+	"\x03ids\x18\x01 \x03(\x03R\x03ids2\x83\x02\n" +
 	"\x05Tasks\x12I\n" +
 	"\bSendTask\x12\x1d.orchestrator.SendTaskRequest\x1a\x1e.orchestrator.SendTaskResponse\x12R\n" +
-	"\vReceiveTask\x12 .orchestrator.ReceiveTaskRequest\x1a!.orchestrator.ReceiveTaskResponseB'Z%github.com/RichCake/calc_api_go/protob\x06proto3"
+	"\vReceiveTask\x12 .orchestrator.ReceiveTaskRequest\x1a!.orchestrator.ReceiveTaskResponse\x12[\n" +
+	"\x0eCancelledTasks\x12#.orchestrator.CancelledTasksRequest\x1a$.orchestrator.CancelledTasksResponseB'Z%github.com/RichCake/calc_api_go/protob\x06proto3"
 
 var (
 	file_orchestrator_orchestrator_proto_rawDescOnce sync.Once
@@ -253,20 +382,24 @@ func file_orchestrator_orchestrator_proto_rawDescGZIP() []byte {
 	return file_orchestrator_orchestrator_proto_rawDescData
 }
 
-var file_orchestrator_orchestrator_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_orchestrator_orchestrator_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
 var file_orchestrator_orchestrator_proto_goTypes = []any{
-	(*SendTaskRequest)(nil),     // 0: orchestrator.SendTaskRequest
-	(*SendTaskResponse)(nil),    // 1: orchestrator.SendTaskResponse
-	(*ReceiveTaskRequest)(nil),  // 2: orchestrator.ReceiveTaskRequest
-	(*ReceiveTaskResponse)(nil), // 3: orchestrator.ReceiveTaskResponse
+	(*SendTaskRequest)(nil),        // 0: orchestrator.SendTaskRequest
+	(*SendTaskResponse)(nil),       // 1: orchestrator.SendTaskResponse
+	(*ReceiveTaskRequest)(nil),     // 2: orchestrator.ReceiveTaskRequest
+	(*ReceiveTaskResponse)(nil),    // 3: orchestrator.ReceiveTaskResponse
+	(*CancelledTasksRequest)(nil),  // 4: orchestrator.CancelledTasksRequest
+	(*CancelledTasksResponse)(nil), // 5: orchestrator.CancelledTasksResponse
 }
 var file_orchestrator_orchestrator_proto_depIdxs = []int32{
 	0, // 0: orchestrator.Tasks.SendTask:input_type -> orchestrator.SendTaskRequest
 	2, // 1: orchestrator.Tasks.ReceiveTask:input_type -> orchestrator.ReceiveTaskRequest
-	1, // 2: orchestrator.Tasks.SendTask:output_type -> orchestrator.SendTaskResponse
-	3, // 3: orchestrator.Tasks.ReceiveTask:output_type -> orchestrator.ReceiveTaskResponse
-	2, // [2:4] is the sub-list for method output_type
-	0, // [0:2] is the sub-list for method input_type
+	4, // 2: orchestrator.Tasks.CancelledTasks:input_type -> orchestrator.CancelledTasksRequest
+	1, // 3: orchestrator.Tasks.SendTask:output_type -> orchestrator.SendTaskResponse
+	3, // 4: orchestrator.Tasks.ReceiveTask:output_type -> orchestrator.ReceiveTaskResponse
+	5, // 5: orchestrator.Tasks.CancelledTasks:output_type -> orchestrator.CancelledTasksResponse
+	3, // [3:6] is the sub-list for method output_type
+	0, // [0:3] is the sub-list for method input_type
 	0, // [0:0] is the sub-list for extension type_name
 	0, // [0:0] is the sub-list for extension extendee
 	0, // [0:0] is the sub-list for field type_name
@@ -283,7 +416,7 @@ func file_orchestrator_orchestrator_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_orchestrator_orchestrator_proto_rawDesc), len(file_orchestrator_orchestrator_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   6,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
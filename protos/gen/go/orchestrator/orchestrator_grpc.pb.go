@@ -19,8 +19,9 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	Tasks_SendTask_FullMethodName    = "/orchestrator.Tasks/SendTask"
-	Tasks_ReceiveTask_FullMethodName = "/orchestrator.Tasks/ReceiveTask"
+	Tasks_SendTask_FullMethodName       = "/orchestrator.Tasks/SendTask"
+	Tasks_ReceiveTask_FullMethodName    = "/orchestrator.Tasks/ReceiveTask"
+	Tasks_CancelledTasks_FullMethodName = "/orchestrator.Tasks/CancelledTasks"
 )
 
 // TasksClient is the client API for Tasks service.
@@ -29,6 +30,7 @@ const (
 type TasksClient interface {
 	SendTask(ctx context.Context, in *SendTaskRequest, opts ...grpc.CallOption) (*SendTaskResponse, error)
 	ReceiveTask(ctx context.Context, in *ReceiveTaskRequest, opts ...grpc.CallOption) (*ReceiveTaskResponse, error)
+	CancelledTasks(ctx context.Context, in *CancelledTasksRequest, opts ...grpc.CallOption) (*CancelledTasksResponse, error)
 }
 
 type tasksClient struct {
@@ -59,12 +61,23 @@ func (c *tasksClient) ReceiveTask(ctx context.Context, in *ReceiveTaskRequest, o
 	return out, nil
 }
 
+func (c *tasksClient) CancelledTasks(ctx context.Context, in *CancelledTasksRequest, opts ...grpc.CallOption) (*CancelledTasksResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CancelledTasksResponse)
+	err := c.cc.Invoke(ctx, Tasks_CancelledTasks_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TasksServer is the server API for Tasks service.
 // All implementations must embed UnimplementedTasksServer
 // for forward compatibility.
 type TasksServer interface {
 	SendTask(context.Context, *SendTaskRequest) (*SendTaskResponse, error)
 	ReceiveTask(context.Context, *ReceiveTaskRequest) (*ReceiveTaskResponse, error)
+	CancelledTasks(context.Context, *CancelledTasksRequest) (*CancelledTasksResponse, error)
 	mustEmbedUnimplementedTasksServer()
 }
 
@@ -81,6 +94,9 @@ func (UnimplementedTasksServer) SendTask(context.Context, *SendTaskRequest) (*Se
 func (UnimplementedTasksServer) ReceiveTask(context.Context, *ReceiveTaskRequest) (*ReceiveTaskResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ReceiveTask not implemented")
 }
+func (UnimplementedTasksServer) CancelledTasks(context.Context, *CancelledTasksRequest) (*CancelledTasksResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelledTasks not implemented")
+}
 func (UnimplementedTasksServer) mustEmbedUnimplementedTasksServer() {}
 func (UnimplementedTasksServer) testEmbeddedByValue()               {}
 
@@ -138,6 +154,24 @@ func _Tasks_ReceiveTask_Handler(srv interface{}, ctx context.Context, dec func(i
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Tasks_CancelledTasks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelledTasksRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TasksServer).CancelledTasks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Tasks_CancelledTasks_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TasksServer).CancelledTasks(ctx, req.(*CancelledTasksRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Tasks_ServiceDesc is the grpc.ServiceDesc for Tasks service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -153,6 +187,10 @@ var Tasks_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ReceiveTask",
 			Handler:    _Tasks_ReceiveTask_Handler,
 		},
+		{
+			MethodName: "CancelledTasks",
+			Handler:    _Tasks_CancelledTasks_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "orchestrator/orchestrator.proto",